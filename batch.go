@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Most operations accepted in a single batch
+const maxBatchSize = 1000
+
+//Key operation in a batch. Token and the expiry of puts with a TTL are set by the receiving node
+//before it is sent to the owning node
+type batchOp struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Token uint64  `json:"token,omitempty"`
+
+	TTL     *int64 `json:"ttl,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+//Result of a single operation with the status code the same request to /kvs/keys would return
+type batchResult struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Status    int    `json:"status"`
+	DoesExist bool   `json:"doesExist,omitempty"`
+	Replaced  bool   `json:"replaced,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Address   string `json:"address,omitempty"`
+
+	TTL      int64  `json:"ttl,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+//Node which could not execute its operations of a batch
+type batchFailure struct {
+	Address string `json:"address"`
+	Error   string `json:"error"`
+	Keys    int    `json:"keys"`
+}
+
+//Check that an operation can be executed. Returns a message for the client if it cannot
+func validateBatchOp(op batchOp) string {
+	switch op.Op {
+	case "get", "delete":
+	case "put":
+		if op.Value == nil {
+			return "Value is missing"
+		} else if op.TTL != nil && (*op.TTL < 1 || *op.TTL > maxTTL) {
+			return fmt.Sprintf("TTL must be between 1 and %d seconds", maxTTL)
+		}
+	default:
+		return fmt.Sprintf("Unknown operation %q", op.Op)
+	}
+
+	return keyError(op.Key)
+}
+
+//Execute the operations of a batch on the local partitions in order
+func applyBatch(ops []batchOp) []batchResult {
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		res := batchResult{Op: op.Op, Key: op.Key}
+
+		switch op.Op {
+		case "get":
+			if value, meta, exists := kvs.GetItem(op.Token, op.Key); exists {
+				res.Status, res.DoesExist, res.Value = http.StatusOK, true, value
+				res.TTL, res.Revision = ttlRemaining(meta.Expires), meta.Revision
+			} else {
+				res.Status, res.Error = http.StatusNotFound, "Key does not exist"
+			}
+		case "put":
+			updated, revision, err := kvs.Set(op.Token, op.Key, *op.Value, expiryTime(op.Expires), nil)
+			res.Revision = revision
+			if err == kvs.ErrLocked {
+				res.Status, res.Error = http.StatusLocked, err.Error()
+			} else if err != nil {
+				res.Status, res.Error = http.StatusInternalServerError, err.Error()
+			} else if updated {
+				res.Status, res.Replaced = http.StatusOK, true
+			} else {
+				res.Status = http.StatusCreated
+			}
+		case "delete":
+			if err := kvs.Delete(op.Token, op.Key); err == nil {
+				res.Status, res.DoesExist = http.StatusOK, true
+			} else if err == kvs.ErrLocked {
+				res.Status, res.DoesExist, res.Error = http.StatusLocked, true, err.Error()
+			} else {
+				res.Status, res.Error = http.StatusNotFound, "Key does not exist"
+			}
+		}
+		results[i] = res
+	}
+	return results
+}
+
+//Execute the operations of a batch on another node with a single request
+func executeBatch(ctx context.Context, node string, ops []batchOp) ([]batchResult, error) {
+	//Repeating gets and puts has the same result so only batches with deletes are not retried
+	idempotent := true
+	for _, op := range ops {
+		if op.Op == "delete" {
+			idempotent = false
+		}
+	}
+
+	uri := fmt.Sprintf("http://%s/kvs/int/batch", node)
+	res, err := internalRequest(ctx, http.MethodPost, uri, ops, quickPolicy(idempotent))
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+
+	results := []batchResult{}
+	if err := json.Unmarshal(res.Body, &results); err != nil {
+		return nil, err
+	} else if len(results) != len(ops) {
+		return nil, fmt.Errorf("Node %s returned %d results for %d operations", node, len(results), len(ops))
+	}
+	return results, nil
+}
+
+//Group operations by the node owning their keys and execute each group on its node concurrently.
+//Operations on the same key are executed in the order given
+func routeBatch(ctx context.Context, ops []batchOp) ([]batchResult, []batchFailure) {
+	groups := make(map[string][]int)
+	now := time.Now()
+	for i := range ops {
+		token := MyView.FindToken(ops[i].Key)
+		ops[i].Token, ops[i].Expires = token.Value, 0
+		if ops[i].TTL != nil {
+			ops[i].Expires = now.Add(time.Duration(*ops[i].TTL) * time.Second).UnixNano()
+		}
+		groups[token.Endpoint] = append(groups[token.Endpoint], i)
+	}
+
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	results := make([]batchResult, len(ops))
+	failures := []batchFailure{}
+
+	wg.Add(len(groups))
+	for node, indices := range groups {
+		go func(node string, indices []int) {
+			defer wg.Done()
+
+			nodeOps := make([]batchOp, len(indices))
+			for i, index := range indices {
+				nodeOps[i] = ops[index]
+			}
+
+			var nodeResults []batchResult
+			var err error
+			if node == MyAddress {
+				nodeResults = applyBatch(nodeOps)
+			} else {
+				nodeResults, err = executeBatch(ctx, node, nodeOps)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Println(err)
+				failures = append(failures, batchFailure{Address: node, Error: err.Error(), Keys: len(indices)})
+			}
+
+			for i, index := range indices {
+				if err != nil {
+					results[index] = batchResult{Op: ops[index].Op, Key: ops[index].Key, Status: http.StatusServiceUnavailable, Error: err.Error()}
+				} else {
+					results[index] = nodeResults[i]
+				}
+				if node != MyAddress {
+					results[index].Address = node
+				}
+			}
+		}(node, indices)
+	}
+	wg.Wait()
+
+	return results, failures
+}
+
+//Handle external post request with a batch of key operations
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := struct {
+		Operations []batchOp `json:"operations"`
+	}{}
+	res := struct {
+		Message  string         `json:"message"`
+		Error    string         `json:"error,omitempty"`
+		Results  []batchResult  `json:"results,omitempty"`
+		Failures []batchFailure `json:"failures,omitempty"`
+	}{}
+
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		res.Error = "Invalid request body"
+	} else if len(req.Operations) == 0 {
+		res.Error = "Operations are missing"
+	} else if len(req.Operations) > maxBatchSize {
+		res.Error = fmt.Sprintf("Batch has more than %d operations", maxBatchSize)
+	}
+	for i := 0; i < len(req.Operations) && res.Error == ""; i++ {
+		if msg := validateBatchOp(req.Operations[i]); msg != "" {
+			res.Error = fmt.Sprintf("Operation %d: %s", i, msg)
+		}
+	}
+
+	if res.Error != "" {
+		res.Message = "Error in BATCH"
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		res.Results, res.Failures = routeBatch(r.Context(), req.Operations)
+		if len(res.Failures) == 0 {
+			res.Message = "Batch executed successfully"
+			w.WriteHeader(http.StatusOK)
+		} else {
+			//Operations sent to other nodes may have been executed
+			res.Message = "Batch partially failed"
+			w.WriteHeader(http.StatusMultiStatus)
+		}
+	}
+
+	b, err = json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
+
+//Handle internal post request with the operations of a batch for keys stored on this node
+func internalBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	ops := []batchOp{}
+	err = json.Unmarshal(b, &ops)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, op := range ops {
+		if validateBatchOp(op) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	b, err = json.Marshal(applyBatch(ops))
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Response body of a batch request
+type batchResponse struct {
+	Message  string         `json:"message"`
+	Error    string         `json:"error"`
+	Results  []batchResult  `json:"results"`
+	Failures []batchFailure `json:"failures"`
+}
+
+//Send a batch of operations to the batch handler
+func postBatch(t *testing.T, ops []batchOp) (int, batchResponse) {
+	b, _ := json.Marshal(struct {
+		Operations []batchOp `json:"operations"`
+	}{ops})
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest(http.MethodPost, "/kvs/batch", strings.NewReader(string(b))))
+
+	res := batchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, res
+}
+
+func TestBatchValidation(t *testing.T) {
+	defer func(c *Config, active bool) { MyConfig, AmActive = c, active }(MyConfig, AmActive)
+	MyConfig, AmActive = testConfig(), true
+
+	value := "1"
+	get := batchOp{Op: "get", Key: "a"}
+	full := make([]batchOp, maxBatchSize+1)
+	for i := range full {
+		full[i] = get
+	}
+
+	var tests = []struct {
+		name string
+		ops  []batchOp
+		want string
+	}{
+		{"No operations", []batchOp{}, "Operations are missing"},
+		{"Too many operations", full, fmt.Sprintf("Batch has more than %d operations", maxBatchSize)},
+		{"Unknown operation", []batchOp{get, {Op: "incr", Key: "a"}}, `Operation 1: Unknown operation "incr"`},
+		{"Put without value", []batchOp{{Op: "put", Key: "a"}}, "Operation 0: Value is missing"},
+		{"Key too long", []batchOp{get, {Op: "put", Key: strings.Repeat("a", MyConfig.MaxKeyLength+1), Value: &value}}, "Operation 1: Key is too long"},
+		{"Key reserved for namespaces", []batchOp{get, get, {Op: "delete", Key: nsMarker + "a"}}, "Operation 2: Key is reserved for namespaces"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := postBatch(t, tt.ops)
+			if status != http.StatusBadRequest || res.Error != tt.want || res.Message != "Error in BATCH" {
+				t.Errorf("Want: 400 %q Got: %d %q", tt.want, status, res.Error)
+			}
+			if len(res.Results) != 0 {
+				t.Errorf("Want: no operations executed Got: %v", res.Results)
+			}
+		})
+	}
+}
+
+func TestBatchAcrossNodes(t *testing.T) {
+	defer func(c *Config, active bool, address string, view kvs.View) {
+		MyConfig, AmActive, MyAddress, *MyView = c, active, address, view
+	}(MyConfig, AmActive, MyAddress, *MyView)
+	MyConfig, AmActive, MyAddress = testConfig(), true, "10.10.0.1:13800"
+	MyConfig.retryBackoff, MyConfig.requestTimeout = time.Millisecond, time.Second
+
+	server := startTestNode()
+	defer server.Close()
+	remote := server.Listener.Addr().String()
+
+	//Nothing listens on the address of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	*MyView = kvs.View{Nodes: []string{MyAddress, remote, down}, Tokens: []kvs.Token{
+		{Endpoint: MyAddress, Value: kvs.MaxHash / 3},
+		{Endpoint: remote, Value: kvs.MaxHash / 3 * 2},
+		{Endpoint: down, Value: kvs.MaxHash - 1},
+	}}
+	//The remote node shares the store of the test
+	for _, token := range MyView.Tokens[:2] {
+		kvs.MyKVS[token.Value] = kvs.NewStore(token.Value)
+		defer delete(kvs.MyKVS, token.Value)
+	}
+
+	//Find a key stored under each token
+	keys := make(map[string]string)
+	for i := 0; len(keys) < len(MyView.Tokens); i++ {
+		key := "key" + strconv.Itoa(i)
+		if node := MyView.FindToken(key).Endpoint; keys[node] == "" {
+			keys[node] = key
+		}
+	}
+	local, other, unreachable := keys[MyAddress], keys[remote], keys[down]
+
+	value := "1"
+	ops := []batchOp{
+		{Op: "put", Key: local, Value: &value},
+		{Op: "get", Key: other},
+		{Op: "put", Key: other, Value: &value},
+		{Op: "get", Key: other},
+		{Op: "delete", Key: unreachable},
+		{Op: "put", Key: local, Value: &value},
+	}
+	status, res := postBatch(t, ops)
+	if status != http.StatusMultiStatus || res.Message != "Batch partially failed" {
+		t.Errorf("Want: 207 Got: %d %q", status, res.Message)
+	}
+
+	//Results are in the order given with operations on the same key executed in order
+	want := []struct {
+		status  int
+		address string
+	}{
+		{http.StatusCreated, ""},
+		{http.StatusNotFound, remote},
+		{http.StatusCreated, remote},
+		{http.StatusOK, remote},
+		{http.StatusServiceUnavailable, down},
+		{http.StatusOK, ""},
+	}
+	if len(res.Results) != len(want) {
+		t.Fatalf("Want: %d results Got: %v", len(want), res.Results)
+	}
+	for i, w := range want {
+		r := res.Results[i]
+		if r.Op != ops[i].Op || r.Key != ops[i].Key || r.Status != w.status || r.Address != w.address {
+			t.Errorf("Want: result %d %s %s %d %q Got: %+v", i, ops[i].Op, ops[i].Key, w.status, w.address, r)
+		}
+	}
+	if res.Results[3].Value != value || !res.Results[5].Replaced {
+		t.Errorf("Want: value read and replaced Got: %+v %+v", res.Results[3], res.Results[5])
+	}
+
+	wantFailures := []batchFailure{{Address: down, Error: res.Results[4].Error, Keys: 1}}
+	if !reflect.DeepEqual(res.Failures, wantFailures) {
+		t.Errorf("Want: %v Got: %v", wantFailures, res.Failures)
+	}
+
+	//Without the unreachable node every operation succeeds
+	status, res = postBatch(t, []batchOp{{Op: "delete", Key: local}, {Op: "delete", Key: other}})
+	if status != http.StatusOK || len(res.Failures) != 0 || res.Results[0].Status != http.StatusOK || res.Results[1].Status != http.StatusOK {
+		t.Errorf("Want: 200 with both keys deleted Got: %d %+v", status, res)
+	}
+
+	//A batch of the largest size is accepted
+	full := make([]batchOp, maxBatchSize)
+	for i := range full {
+		full[i] = batchOp{Op: "get", Key: local}
+	}
+	if status, res = postBatch(t, full); status != http.StatusOK || len(res.Results) != maxBatchSize {
+		t.Errorf("Want: 200 with %d results Got: %d with %d", maxBatchSize, status, len(res.Results))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Changes returned by a request to the change feed unless a limit is given, the largest limit
+//accepted and the longest time a request may wait for changes in seconds
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+	maxChangesWait      = 60
+)
+
+//Identifies the change log of this run of the node. Sequence numbers start again from 1 when a node
+//restarts, so consumers holding an offset for another log must read the feed from the start
+var changeLogID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+//Change to a key in the change feed. Moves by a view change have the type move-in or move-out
+type change struct {
+	Seq       uint64 `json:"seq"`
+	Type      string `json:"type"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	Revision  uint64 `json:"revision,omitempty"`
+	Expires   int64  `json:"expires,omitempty"` //Unix nanoseconds
+	Time      int64  `json:"time"`              //Unix nanoseconds
+}
+
+//Handle external get request for the changes made to keys on this node after the sequence number
+//since. If there are none the request waits up to wait seconds for the next change
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	res := struct {
+		Message string   `json:"message"`
+		Error   string   `json:"error,omitempty"`
+		Node    string   `json:"node"`
+		LogID   string   `json:"log-id"`
+		Changes []change `json:"changes"`
+		Next    uint64   `json:"next"`   //Sequence number to pass as since for the next changes
+		Oldest  uint64   `json:"oldest"` //Sequence number of the oldest change kept
+	}{Node: MyAddress, LogID: changeLogID, Changes: []change{}}
+
+	query := r.URL.Query()
+	var since uint64
+	limit, wait := defaultChangesLimit, 0
+	var err error
+
+	if s := query.Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			res.Error = "Since must be a sequence number"
+		}
+	}
+	if l := query.Get("limit"); l != "" && res.Error == "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			res.Error = fmt.Sprintf("Limit must be between 1 and %d", maxChangesLimit)
+		}
+	}
+	if s := query.Get("wait"); s != "" && res.Error == "" {
+		wait, err = strconv.Atoi(s)
+		if err != nil || wait < 0 || wait > maxChangesWait {
+			res.Error = fmt.Sprintf("Wait must be between 0 and %d seconds", maxChangesWait)
+		}
+	}
+
+	if res.Error != "" {
+		res.Message = "Error in CHANGES"
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		events, oldest, last, next := kvs.Changes(since, limit)
+		if len(events) == 0 && since >= oldest-1 && since <= last && wait > 0 {
+			timer := time.NewTimer(time.Duration(wait) * time.Second)
+			select {
+			case <-next:
+				events, oldest, last, _ = kvs.Changes(since, limit)
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+			timer.Stop()
+		}
+		res.Oldest = oldest
+
+		if since < oldest-1 || since > last {
+			//Changes after since were dropped or belong to an earlier run of the node
+			res.Error = "Changes after since are no longer kept, read the feed again from oldest"
+			res.Message = "Error in CHANGES"
+			res.Next = oldest - 1
+			w.WriteHeader(http.StatusGone)
+		} else {
+			res.Next = since
+			for _, e := range events {
+				c := change{Seq: e.Seq, Type: e.Type, Value: e.Value, Revision: e.Revision}
+				c.Namespace, c.Key = splitNamespace(e.Key)
+				c.Expires, c.Time = expiryNanos(e.Expires), e.Time.UnixNano()
+				res.Changes = append(res.Changes, c)
+				res.Next = e.Seq
+			}
+			res.Message = "Changes retrieved successfully"
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	b, err := json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
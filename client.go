@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//TimeoutHeader carries the milliseconds left before the deadline of a request forwarded to another
+//node. The time left is sent rather than the deadline so node clocks do not need to agree
+const TimeoutHeader = "X-Kvs-Timeout"
+
+//EpochHeader carries the epoch of the responding node's view so clients can tell when their view is stale
+const EpochHeader = "X-Kvs-Epoch"
+
+//Client shared by all requests between nodes
+var internalClient = newInternalClient(defaultConfig())
+
+//Response to an internal request with its body already read so connections can be reused
+type internalResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+//Deadline and retry behaviour of an internal request
+type requestPolicy struct {
+	timeout    time.Duration //Deadline for each attempt
+	idempotent bool          //Only idempotent requests are retried
+}
+
+//Policy for short requests such as key operations
+func quickPolicy(idempotent bool) requestPolicy {
+	return requestPolicy{timeout: MyConfig.requestTimeout, idempotent: idempotent}
+}
+
+//Policy for requests which may move many keys such as view changes
+func bulkPolicy(idempotent bool) requestPolicy {
+	return requestPolicy{timeout: MyConfig.reshardTimeout, idempotent: idempotent}
+}
+
+//Applies the deadline of requests forwarded from other nodes to the request context
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get(TimeoutHeader); header != "" {
+			if millis, err := strconv.ParseInt(header, 10, 64); err == nil {
+				ctx, cancel := context.WithTimeout(r.Context(), time.Duration(millis)*time.Millisecond)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Set the time left before the deadline of a request in its timeout header
+func setTimeoutHeader(req *http.Request) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set(TimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
+
+//Adds the epoch of the node's view to responses
+func epochMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if AmActive {
+			w.Header().Set(EpochHeader, strconv.FormatUint(MyView.Epoch, 10))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Create client with connection pool limits from config
+func newInternalClient(c *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        c.MaxIdleConnsPerHost * 8,
+			MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+			MaxConnsPerHost:     c.MaxConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+//Make internal request with data encoded as json, retrying idempotent requests which fail
+func internalRequest(ctx context.Context, method string, uri string, data interface{}, policy requestPolicy) (*internalResponse, error) {
+	var body []byte
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	return sendInternal(ctx, method, uri, body, nil, policy)
+}
+
+//Make internal request with the given body and headers, retrying idempotent requests which fail
+func sendInternal(ctx context.Context, method string, uri string, body []byte, header http.Header, policy requestPolicy) (*internalResponse, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := attemptInternal(ctx, method, uri, body, header, policy.timeout)
+		retry := err != nil || res.StatusCode == http.StatusBadGateway ||
+			res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusGatewayTimeout
+		if !retry || !policy.idempotent || attempt >= MyConfig.Retries || ctx.Err() != nil {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+//Single attempt of an internal request. The response body is always drained and closed
+func attemptInternal(ctx context.Context, method string, uri string, body []byte, header http.Header, timeout time.Duration) (*internalResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, uri, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	//Let the other node stop working on the request once nobody is waiting for it
+	setTimeoutHeader(req)
+
+	res, err := internalClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &internalResponse{StatusCode: res.StatusCode, Body: b}, nil
+}
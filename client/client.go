@@ -0,0 +1,450 @@
+//Package client is a Go client for sharded-kvs. It keeps a copy of the view so requests are sent
+//directly to the node owning each key instead of being forwarded by another node
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//EpochHeader carries the epoch of the responding node's view
+const EpochHeader = "X-Kvs-Epoch"
+
+//Errors returned for key operations
+var (
+	ErrNotFound           = errors.New("Key does not exist")
+	ErrPreconditionFailed = errors.New("Precondition failed") //Returned when a key does not have the expected revision
+	ErrNotInteger         = errors.New("Value is not an integer")
+)
+
+//Options for a client. Zero values use the defaults
+type Options struct {
+	Timeout      time.Duration //Deadline for each attempt of a request (default 5s)
+	Retries      int           //Times a failed request is retried (default 2)
+	NoRetry      bool          //Never retry failed requests, overriding Retries
+	RetryBackoff time.Duration //Delay before the first retry, doubled for each further retry (default 100ms)
+	HTTPClient   *http.Client  //Client used to make requests (default http.DefaultClient)
+}
+
+//Client sends requests to the nodes of a cluster. It is safe for concurrent use
+type Client struct {
+	seeds   []string
+	options Options
+
+	mutex   sync.RWMutex
+	view    kvs.View
+	maxHash uint64
+	stale   bool //Set when a response shows the view has changed
+}
+
+//Request body of puts
+type valueRequest struct {
+	Value  *string `json:"value,omitempty"`
+	Binary []byte  `json:"binary,omitempty"` //Value which is not valid UTF-8, which JSON strings cannot hold
+	TTL    int64   `json:"ttl,omitempty"`
+}
+
+//Make the body of a put, sending values which are not valid UTF-8 as binary
+func putRequest(value string) valueRequest {
+	if utf8.ValidString(value) {
+		return valueRequest{Value: &value}
+	}
+	return valueRequest{Binary: []byte(value)}
+}
+
+//Response body of key operations
+type keyResponse struct {
+	DoesExist bool   `json:"doesExist"`
+	Replaced  bool   `json:"replaced"`
+	Error     string `json:"error"`
+	Value     string `json:"value"`
+	Binary    []byte `json:"binary"` //Value which is not valid UTF-8
+	Revision  uint64 `json:"revision"`
+	Address   string `json:"address"` //Set if the request was forwarded to another node
+}
+
+//New creates a client which fetches the view from the given seed nodes
+func New(ctx context.Context, seeds []string, options Options) (*Client, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("At least one seed node is required")
+	}
+
+	if options.Timeout == 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.NoRetry {
+		options.Retries = 0
+	} else if options.Retries == 0 {
+		options.Retries = 2
+	}
+	if options.RetryBackoff == 0 {
+		options.RetryBackoff = 100 * time.Millisecond
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+
+	c := &Client{seeds: seeds, options: options}
+	return c, c.Refresh(ctx)
+}
+
+//View returns the client's copy of the view
+func (c *Client) View() kvs.View {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.view.Copy()
+}
+
+//Refresh fetches the view from the first node which responds, trying known nodes before the seeds
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mutex.RLock()
+	nodes := append(append([]string{}, c.view.Nodes...), c.seeds...)
+	c.mutex.RUnlock()
+
+	var lastErr error
+	for _, node := range nodes {
+		res := struct {
+			View    kvs.View `json:"view"`
+			MaxHash uint64   `json:"max-hash"`
+		}{}
+
+		status, _, err := c.send(ctx, http.MethodGet, fmt.Sprintf("http://%s/kvs/view", node), nil, nil, &res)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("Node %s returned status %d", node, status)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		} else if res.MaxHash == 0 || len(res.View.Tokens) == 0 {
+			lastErr = fmt.Errorf("Node %s returned an empty view", node)
+			continue
+		}
+
+		//A node which has not yet received the latest view change may return an older view
+		c.mutex.Lock()
+		if res.View.Epoch >= c.view.Epoch {
+			c.view, c.maxHash = res.View, res.MaxHash
+		}
+		c.stale = false
+		c.mutex.Unlock()
+		return nil
+	}
+	return fmt.Errorf("Unable to fetch view: %v", lastErr)
+}
+
+//Get returns the value of a key or ErrNotFound
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := c.GetRevision(ctx, key)
+	return value, err
+}
+
+//GetRevision returns the value of a key and its revision, which changes every time the key is
+//written, or ErrNotFound
+func (c *Client) GetRevision(ctx context.Context, key string) (string, uint64, error) {
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodGet, true, key, "", nil, nil, &res)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		if res.Binary != nil {
+			return string(res.Binary), res.Revision, nil
+		}
+		return res.Value, res.Revision, nil
+	case http.StatusNotFound:
+		return "", 0, ErrNotFound
+	}
+	return "", 0, responseError(status, res)
+}
+
+//Put sets the value of a key and returns if an existing value was replaced
+func (c *Client) Put(ctx context.Context, key string, value string) (bool, error) {
+	return c.PutWithTTL(ctx, key, value, 0)
+}
+
+//PutWithTTL sets the value of a key which expires after the TTL, rounded up to whole seconds. A zero
+//TTL sets a key which never expires. Returns if an existing value was replaced
+func (c *Client) PutWithTTL(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	req := putRequest(value)
+	if ttl > 0 {
+		req.TTL = int64((ttl + time.Second - 1) / time.Second)
+	} else if ttl < 0 {
+		return false, errors.New("TTL must not be negative")
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodPut, true, key, "", body, nil, &res)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return res.Replaced, nil
+	}
+	return false, responseError(status, res)
+}
+
+//PutIfRevision sets the value of a key only if it still has the given revision, or only if it does
+//not exist when the revision is zero. Returns the new revision or ErrPreconditionFailed. A retried
+//put may return ErrPreconditionFailed even if an earlier attempt set the key
+func (c *Client) PutIfRevision(ctx context.Context, key string, value string, revision uint64) (uint64, error) {
+	body, err := json.Marshal(putRequest(value))
+	if err != nil {
+		return 0, err
+	}
+
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodPut, true, key, "", body, revisionHeader(revision), &res)
+	if err != nil {
+		return 0, err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return res.Revision, nil
+	case http.StatusPreconditionFailed:
+		return 0, ErrPreconditionFailed
+	}
+	return 0, responseError(status, res)
+}
+
+//Delete deletes a key or returns ErrNotFound. A retried delete may return ErrNotFound even if
+//an earlier attempt deleted the key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodDelete, true, key, "", nil, nil, &res)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return responseError(status, res)
+}
+
+//DeleteIfRevision deletes a key only if it still has the given revision. Returns ErrPreconditionFailed
+//if it has another revision or does not exist
+func (c *Client) DeleteIfRevision(ctx context.Context, key string, revision uint64) error {
+	if revision == 0 {
+		return errors.New("Revision must not be zero")
+	}
+
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodDelete, true, key, "", nil, revisionHeader(revision), &res)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	}
+	return responseError(status, res)
+}
+
+//Incr adds to the integer value of a key and returns the new value, treating a missing key as 0. A
+//negative amount decrements the key. Returns ErrNotInteger if the key holds another value. A failed
+//increment is only retried if it cannot have been applied, so it is never applied twice
+func (c *Client) Incr(ctx context.Context, key string, by int64) (int64, error) {
+	body, err := json.Marshal(struct {
+		By int64 `json:"by"`
+	}{by})
+	if err != nil {
+		return 0, err
+	}
+
+	res := keyResponse{}
+	status, err := c.do(ctx, http.MethodPost, false, key, "/incr", body, nil, &res)
+	if err != nil {
+		return 0, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return strconv.ParseInt(res.Value, 10, 64)
+	case http.StatusConflict:
+		if res.Error == ErrNotInteger.Error() {
+			return 0, ErrNotInteger
+		}
+	}
+	return 0, responseError(status, res)
+}
+
+//Precondition header requiring a key to have a revision, or to not exist if the revision is zero
+func revisionHeader(revision uint64) http.Header {
+	header := http.Header{}
+	if revision == 0 {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", strconv.Quote(strconv.FormatUint(revision, 10)))
+	}
+	return header
+}
+
+//MultiGet gets several keys concurrently. Keys which do not exist are left out of the result
+func (c *Client) MultiGet(ctx context.Context, keys []string) (map[string]string, error) {
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	values := make(map[string]string, len(keys))
+	var firstErr error
+
+	wg.Add(len(keys))
+	for _, key := range keys {
+		go func(key string) {
+			defer wg.Done()
+
+			value, err := c.Get(ctx, key)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				values[key] = value
+			} else if err != ErrNotFound && firstErr == nil {
+				firstErr = err
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	return values, firstErr
+}
+
+//Find the node owning a key, refreshing the view first if it is stale
+func (c *Client) owner(ctx context.Context, key string) (string, error) {
+	c.mutex.RLock()
+	stale := c.stale
+	c.mutex.RUnlock()
+
+	if stale {
+		if err := c.Refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.view.TokenForHash(kvs.Hash(key, c.maxHash)).Endpoint, nil
+}
+
+//Make a key request to the node owning the key, retrying with a refreshed view on failures. Requests
+//which are not idempotent are only retried if they cannot have been executed: the node was not in the
+//view or could not be connected to. Action is appended to the path of the key
+func (c *Client) do(ctx context.Context, method string, idempotent bool, key string, action string, body []byte, header http.Header, res *keyResponse) (int, error) {
+	for attempt := 0; ; attempt++ {
+		node, err := c.owner(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		*res = keyResponse{}
+		uri := fmt.Sprintf("http://%s/kvs/keys/%s%s", node, url.PathEscape(key), action)
+		status, epoch, err := c.send(ctx, method, uri, body, header, res)
+		c.checkView(epoch, res.Address)
+
+		//Nodes outside the view, unavailable nodes and failed forwards are retried with a new view
+		retry := status == http.StatusForbidden || notSent(err)
+		if idempotent {
+			retry = retry || err != nil || status >= http.StatusInternalServerError
+		}
+		if !retry || attempt >= c.options.Retries || ctx.Err() != nil {
+			return status, err
+		}
+
+		c.mutex.Lock()
+		c.stale = true
+		c.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(c.options.RetryBackoff << uint(attempt)):
+		}
+	}
+}
+
+//Check if a request failed because no connection could be made, so it never reached a node
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+//Mark the view stale if the response came from a newer view or was forwarded to another node
+func (c *Client) checkView(epoch uint64, forwardedTo string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if epoch > c.view.Epoch || forwardedTo != "" {
+		c.stale = true
+	}
+}
+
+//Single attempt of a request with optional headers. Returns the response status and the epoch of the
+//node's view
+func (c *Client) send(ctx context.Context, method string, uri string, body []byte, header http.Header, res interface{}) (int, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	r, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Body.Close()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	epoch, _ := strconv.ParseUint(r.Header.Get(EpochHeader), 10, 64)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, res); err != nil {
+			return r.StatusCode, epoch, fmt.Errorf("Invalid response from %s: %v", uri, err)
+		}
+	}
+	return r.StatusCode, epoch, nil
+}
+
+//Convert an unexpected response to an error
+func responseError(status int, res keyResponse) error {
+	if res.Error != "" {
+		return fmt.Errorf("%s (status %d)", res.Error, status)
+	}
+	return fmt.Errorf("Unexpected status %d", status)
+}
@@ -0,0 +1,370 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+const testMaxHash = 1000
+
+//Fake cluster whose nodes store keys in a shared map and count the requests each node receives
+type fakeCluster struct {
+	mutex      sync.Mutex
+	view       kvs.View
+	values     map[string]string
+	requests   map[string][]string
+	failures   int //Requests to fail before succeeding
+	failStatus int //Status of failed requests, 503 if zero
+	nodes      []*httptest.Server
+
+	revisions    map[string]uint64
+	lastRevision uint64
+}
+
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	c := &fakeCluster{values: map[string]string{}, requests: map[string][]string{}, revisions: map[string]uint64{}}
+	for i := 0; i < n; i++ {
+		c.nodes = append(c.nodes, httptest.NewServer(nil))
+	}
+
+	addresses := make([]string, n)
+	for i, node := range c.nodes {
+		address := strings.TrimPrefix(node.URL, "http://")
+		addresses[i] = address
+		node.Config.Handler = c.handler(address)
+	}
+	c.setView(addresses, 1)
+
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Close()
+		}
+	})
+	return c
+}
+
+//Give each node an equal range of the hash space in the order given
+func (c *fakeCluster) setView(nodes []string, epoch uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.view = kvs.View{Nodes: nodes, Epoch: epoch}
+	for i, node := range nodes {
+		c.view.Tokens = append(c.view.Tokens, kvs.Token{Endpoint: node, Value: uint64(i) * testMaxHash / uint64(len(nodes))})
+	}
+}
+
+func (c *fakeCluster) handler(address string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		w.Header().Set(EpochHeader, strconv.FormatUint(c.view.Epoch, 10))
+		if r.URL.Path == "/kvs/view" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"view": c.view, "max-hash": testMaxHash})
+			return
+		}
+
+		key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/kvs/keys/"), "/incr")
+		c.requests[address] = append(c.requests[address], key)
+		if c.failures > 0 {
+			c.failures--
+			if c.failStatus != 0 {
+				w.WriteHeader(c.failStatus)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		res := keyResponse{}
+		if owner := c.view.TokenForHash(kvs.Hash(key, testMaxHash)).Endpoint; owner != address {
+			res.Address = owner
+		}
+
+		value, exists := c.values[key]
+		if !c.preconditionHolds(r, key, exists) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			if utf8.ValidString(value) {
+				res.Value = value
+			} else {
+				res.Binary = []byte(value)
+			}
+			res.Revision = c.revisions[key]
+		case http.MethodPut:
+			b, _ := ioutil.ReadAll(r.Body)
+			v := struct {
+				Value  string
+				Binary []byte
+			}{}
+			json.Unmarshal(b, &v)
+			c.lastRevision++
+			c.values[key] = v.Value
+			if v.Binary != nil {
+				c.values[key] = string(v.Binary)
+			}
+			c.revisions[key] = c.lastRevision
+			res.Replaced = exists
+			res.Revision = c.lastRevision
+		case http.MethodDelete:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			delete(c.values, key)
+			delete(c.revisions, key)
+		case http.MethodPost:
+			b, _ := ioutil.ReadAll(r.Body)
+			v := struct{ By int64 }{}
+			json.Unmarshal(b, &v)
+			n, _ := strconv.ParseInt(value, 10, 64)
+			c.lastRevision++
+			c.values[key] = strconv.FormatInt(n+v.By, 10)
+			c.revisions[key] = c.lastRevision
+			res.Value = c.values[key]
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+//Check the If-Match and If-None-Match headers sent by the client against the revision of a key
+func (c *fakeCluster) preconditionHolds(r *http.Request, key string, exists bool) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		return exists && ifMatch == strconv.Quote(strconv.FormatUint(c.revisions[key], 10))
+	} else if r.Header.Get("If-None-Match") == "*" {
+		return !exists
+	}
+	return true
+}
+
+//Check that every key was sent to the node owning it in the current view
+func (c *fakeCluster) checkRouting(t *testing.T) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for node, keys := range c.requests {
+		for _, key := range keys {
+			if owner := c.view.TokenForHash(kvs.Hash(key, testMaxHash)).Endpoint; owner != node {
+				t.Errorf("Key %s sent to %s instead of %s", key, node, owner)
+			}
+		}
+	}
+	c.requests = map[string][]string{}
+}
+
+//Number of key requests the nodes received since the last call
+func (c *fakeCluster) requestCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := 0
+	for _, keys := range c.requests {
+		count += len(keys)
+	}
+	c.requests = map[string][]string{}
+	return count
+}
+
+func TestClientRouting(t *testing.T) {
+	ctx := context.Background()
+	cluster := newFakeCluster(t, 3)
+	c, err := New(ctx, []string{cluster.view.Nodes[0]}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if replaced, err := c.Put(ctx, key, key+"1"); err != nil || replaced {
+			t.Errorf("Put %s: Want: false <nil> Got: %v %v", key, replaced, err)
+		}
+	}
+
+	values, err := c.MultiGet(ctx, append(keys, "missing"))
+	if err != nil || len(values) != len(keys) || values["c"] != "c1" {
+		t.Errorf("MultiGet: Want: %d values Got: %v %v", len(keys), values, err)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Delete: Want: <nil> Got: %v", err)
+	}
+	if _, err := c.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Get deleted key: Want: %v Got: %v", ErrNotFound, err)
+	}
+	cluster.checkRouting(t)
+
+	//Nodes in a new order own different keys, the client learns this from the epoch of a response
+	nodes := cluster.view.Nodes
+	cluster.setView([]string{nodes[2], nodes[0], nodes[1]}, 2)
+	c.Get(ctx, "b")
+	cluster.requests = map[string][]string{}
+
+	for _, key := range keys[1:] {
+		if value, err := c.Get(ctx, key); err != nil || value != key+"1" {
+			t.Errorf("Get %s: Want: %s <nil> Got: %v %v", key, key+"1", value, err)
+		}
+	}
+	cluster.checkRouting(t)
+
+	if epoch := c.View().Epoch; epoch != 2 {
+		t.Errorf("Want: epoch 2 Got: %d", epoch)
+	}
+}
+
+func TestClientBinaryValues(t *testing.T) {
+	ctx := context.Background()
+	cluster := newFakeCluster(t, 1)
+	c, err := New(ctx, []string{cluster.view.Nodes[0]}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		value string
+	}{
+		{"text", "value"},
+		{"empty", ""},
+		{"invalid utf8", "\xff\xfe\x00value"},
+		{"truncated rune", "\xe2\x82"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Put(ctx, tt.name, tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			if value, err := c.Get(ctx, tt.name); err != nil || value != tt.value {
+				t.Errorf("Want: %q <nil> Got: %q %v", tt.value, value, err)
+			}
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+	cluster := newFakeCluster(t, 2)
+	c, err := New(ctx, cluster.view.Nodes, Options{Retries: 2, RetryBackoff: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRetry, err := New(ctx, cluster.view.Nodes, Options{NoRetry: true, RetryBackoff: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		client     *Client
+		request    func() error
+		failures   int
+		failStatus int
+		wantErr    bool
+		wantCount  int
+	}{
+		{"Put retried", c, func() error { _, err := c.Put(ctx, "a", "1"); return err }, 2, 0, false, 3},
+		{"Get retries exhausted", c, func() error { _, err := c.Get(ctx, "a"); return err }, 3, 0, true, 3},
+		{"No retry", noRetry, func() error { _, err := noRetry.Get(ctx, "a"); return err }, 1, 0, true, 1},
+		{"Incr not retried once it may have been applied", c, func() error { _, err := c.Incr(ctx, "n", 1); return err }, 1, http.StatusServiceUnavailable, true, 1},
+		{"Incr retried from node outside the view", c, func() error { _, err := c.Incr(ctx, "n", 1); return err }, 1, http.StatusForbidden, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster.requestCount()
+			cluster.mutex.Lock()
+			cluster.failures, cluster.failStatus = tt.failures, tt.failStatus
+			cluster.mutex.Unlock()
+
+			if err := tt.request(); (err != nil) != tt.wantErr {
+				t.Errorf("Want: error %v Got: %v", tt.wantErr, err)
+			}
+			if count := cluster.requestCount(); count != tt.wantCount {
+				t.Errorf("Want: %d requests Got: %d", tt.wantCount, count)
+			}
+		})
+	}
+
+	if value, err := c.Get(ctx, "n"); err != nil || value != "1" {
+		t.Errorf("Want: increment applied once Got: %s %v", value, err)
+	}
+}
+
+func TestNotSent(t *testing.T) {
+	//Nothing listens on the address of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	c := &Client{options: Options{Timeout: time.Second, HTTPClient: http.DefaultClient}}
+	_, _, err = c.send(context.Background(), http.MethodPost, "http://"+down+"/kvs/keys/a/incr", nil, nil, &keyResponse{})
+	if !notSent(err) {
+		t.Errorf("Want: request not sent Got: %v", err)
+	}
+	if notSent(context.DeadlineExceeded) {
+		t.Errorf("Want: timeout may have been sent Got: not sent")
+	}
+}
+
+func TestClientRevisions(t *testing.T) {
+	ctx := context.Background()
+	cluster := newFakeCluster(t, 2)
+	c, err := New(ctx, cluster.view.Nodes, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revision, err := c.PutIfRevision(ctx, "a", "1", 0)
+	if err != nil || revision == 0 {
+		t.Fatalf("Create: Want: revision <nil> Got: %d %v", revision, err)
+	}
+	if _, err := c.PutIfRevision(ctx, "a", "2", 0); err != ErrPreconditionFailed {
+		t.Errorf("Create existing key: Want: %v Got: %v", ErrPreconditionFailed, err)
+	}
+
+	value, got, err := c.GetRevision(ctx, "a")
+	if err != nil || value != "1" || got != revision {
+		t.Errorf("GetRevision: Want: 1 %d <nil> Got: %s %d %v", revision, value, got, err)
+	}
+
+	updated, err := c.PutIfRevision(ctx, "a", "2", revision)
+	if err != nil || updated <= revision {
+		t.Errorf("Update: Want: revision after %d <nil> Got: %d %v", revision, updated, err)
+	}
+	if _, err := c.PutIfRevision(ctx, "a", "3", revision); err != ErrPreconditionFailed {
+		t.Errorf("Update with stale revision: Want: %v Got: %v", ErrPreconditionFailed, err)
+	}
+
+	if err := c.DeleteIfRevision(ctx, "a", revision); err != ErrPreconditionFailed {
+		t.Errorf("Delete with stale revision: Want: %v Got: %v", ErrPreconditionFailed, err)
+	}
+	if err := c.DeleteIfRevision(ctx, "a", updated); err != nil {
+		t.Errorf("Delete: Want: <nil> Got: %v", err)
+	}
+	if _, err := c.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Get deleted key: Want: %v Got: %v", ErrNotFound, err)
+	}
+}
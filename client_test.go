@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicies(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+	MyConfig.requestTimeout, MyConfig.reshardTimeout = time.Second, time.Minute
+
+	var tests = []struct {
+		name   string
+		policy requestPolicy
+		want   requestPolicy
+	}{
+		{"Quick idempotent", quickPolicy(true), requestPolicy{timeout: time.Second, idempotent: true}},
+		{"Quick", quickPolicy(false), requestPolicy{timeout: time.Second}},
+		{"Bulk idempotent", bulkPolicy(true), requestPolicy{timeout: time.Minute, idempotent: true}},
+		{"Bulk", bulkPolicy(false), requestPolicy{timeout: time.Minute}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.policy != tt.want {
+				t.Errorf("Want: %+v Got: %+v", tt.want, tt.policy)
+			}
+		})
+	}
+}
+
+func TestSendInternal(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+	MyConfig.retryBackoff = time.Millisecond
+
+	var tests = []struct {
+		name       string
+		idempotent bool
+		failures   int //Requests failing before one succeeds
+		status     int //Status of failing requests, or 0 to close the connection
+		wantStatus int
+		wantCalls  int
+	}{
+		{"Success", true, 0, 0, http.StatusOK, 1},
+		{"Unavailable idempotent", true, 2, http.StatusServiceUnavailable, http.StatusOK, 3},
+		{"Unavailable not idempotent", false, 2, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"Bad gateway idempotent", true, 1, http.StatusBadGateway, http.StatusOK, 2},
+		{"Gateway timeout idempotent", true, 1, http.StatusGatewayTimeout, http.StatusOK, 2},
+		{"Retries exhausted", true, 5, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 3},
+		{"Internal error may have executed", true, 1, http.StatusInternalServerError, http.StatusInternalServerError, 1},
+		{"Client error", true, 1, http.StatusNotFound, http.StatusNotFound, 1},
+		{"Connection error idempotent", true, 2, 0, http.StatusOK, 3},
+		{"Connection error not idempotent", false, 2, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				calls++
+				failed := calls <= tt.failures
+				mutex.Unlock()
+
+				if !failed {
+					w.Write([]byte("ok"))
+				} else if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				} else {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+				}
+			}))
+			defer server.Close()
+
+			res, err := sendInternal(context.Background(), http.MethodPost, server.URL, []byte("{}"), nil, quickPolicy(tt.idempotent))
+			if tt.wantStatus == 0 {
+				if err == nil {
+					t.Errorf("Want: error Got: status %d", res.StatusCode)
+				}
+			} else if err != nil || res.StatusCode != tt.wantStatus {
+				t.Errorf("Want: status %d Got: %+v %v", tt.wantStatus, res, err)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if calls != tt.wantCalls {
+				t.Errorf("Want: %d calls Got: %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestAttemptInternalDrainsBody(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+
+	var mutex sync.Mutex
+	conns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 64*1024))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			conns++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	//Reading every body lets each request reuse the connection of the last
+	for i := 0; i < 5; i++ {
+		res, err := attemptInternal(context.Background(), http.MethodGet, server.URL, nil, nil, time.Second)
+		if err != nil || len(res.Body) != 64*1024 {
+			t.Fatalf("Want: body of %d bytes Got: %+v %v", 64*1024, res, err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conns != 1 {
+		t.Errorf("Want: 1 connection Got: %d", conns)
+	}
+}
+
+func TestAttemptInternalTimeout(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+	MyConfig.requestTimeout = 50 * time.Millisecond
+
+	timeouts := make(chan int64, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		millis, _ := strconv.ParseInt(r.Header.Get(TimeoutHeader), 10, 64)
+		timeouts <- millis
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := attemptInternal(context.Background(), http.MethodGet, server.URL, nil, nil, quickPolicy(true).timeout)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Want: %v Got: %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Want: request stopped after 50ms Got: %v", elapsed)
+	}
+	if millis := <-timeouts; millis <= 0 || millis > 50 {
+		t.Errorf("Want: timeout header of at most 50ms Got: %d", millis)
+	}
+}
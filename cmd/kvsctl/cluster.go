@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Response of /kvs/view
+type viewResponse struct {
+	View    kvs.View `json:"view"`
+	MaxHash uint64   `json:"max-hash"`
+}
+
+//Key count of a node as in view change responses
+type shardCount struct {
+	Address  string `json:"address"`
+	KeyCount int    `json:"key-count"`
+}
+
+//State of a single node reported by status and watch
+type nodeState struct {
+	Address      string `json:"address"`
+	Reachable    bool   `json:"reachable"`
+	Active       bool   `json:"active"`
+	Coordinating bool   `json:"coordinating"`
+	Epoch        uint64 `json:"epoch"`
+	InView       bool   `json:"in-view"`
+	Error        string `json:"error,omitempty"`
+}
+
+//Run a view subcommand
+func viewCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "show":
+		return viewShow(ctx, c, args[1:])
+	case "change":
+		return viewChange(ctx, c, args[1:])
+	}
+	return errUsage
+}
+
+func viewShow(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	res := viewResponse{}
+	if _, err := c.requestAny(ctx, http.MethodGet, "/kvs/view", nil, &res); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(res)
+	}
+
+	kvs.MaxHash = res.MaxHash
+	ownership := res.View.NodeOwnership()
+	tokens := map[string]int{}
+	for _, t := range res.View.Tokens {
+		tokens[t.Endpoint]++
+	}
+
+	fmt.Printf("Epoch %d with %d nodes and %d tokens\n\n", res.View.Epoch, len(res.View.Nodes), len(res.View.Tokens))
+	rows := [][]string{}
+	for _, node := range res.View.Nodes {
+		rows = append(rows, []string{node, strconv.Itoa(tokens[node]), formatPercent(ownership[node])})
+	}
+	printTable([]string{"NODE", "TOKENS", "OWNERSHIP"}, rows)
+	return nil
+}
+
+//Preview a view change with a simulation of the new ring, then apply it once confirmed
+func viewChange(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("view change", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "Apply the view change without asking")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	req := struct {
+		View string `json:"view"`
+	}{View: flags.Arg(0)}
+
+	current := struct {
+		Nodes           []shardCount `json:"nodes"`
+		OwnershipStdDev float64      `json:"ownership-stddev"`
+	}{}
+	node, err := c.requestAny(ctx, http.MethodGet, "/kvs/ring", nil, &current)
+	if err != nil {
+		return err
+	}
+
+	//The coordinator chooses tokens for added nodes at random so the preview is one possible outcome
+	preview := struct {
+		Added           []string `json:"added"`
+		Removed         []string `json:"removed"`
+		KeysMoved       int      `json:"keys-moved"`
+		OwnershipStdDev float64  `json:"ownership-stddev"`
+	}{}
+	status, _, err := c.request(ctx, http.MethodPost, node, "/kvs/ring/simulate", req, &preview)
+	if err := checkStatus(node, status, err); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		if err := printJSON(preview); err != nil {
+			return err
+		}
+	} else {
+		nodes := make([]string, len(current.Nodes))
+		for i, n := range current.Nodes {
+			nodes[i] = n.Address
+		}
+
+		fmt.Println("Current nodes:", strings.Join(nodes, ","))
+		for _, n := range preview.Added {
+			fmt.Println("  + " + n)
+		}
+		for _, n := range preview.Removed {
+			fmt.Println("  - " + n)
+		}
+		fmt.Printf("Estimated keys moved: %d\n", preview.KeysMoved)
+		fmt.Printf("Ownership standard deviation: %.4f -> %.4f\n", current.OwnershipStdDev, preview.OwnershipStdDev)
+	}
+
+	if len(preview.Added) == 0 && len(preview.Removed) == 0 {
+		fmt.Fprintln(os.Stderr, "View is unchanged")
+		return nil
+	} else if !*yes && !confirm("Apply view change?") {
+		return fmt.Errorf("View change cancelled")
+	}
+
+	res := struct {
+		Shards []shardCount `json:"shards"`
+	}{}
+	status, _, err = c.request(ctx, http.MethodPut, node, "/kvs/view-change", req, &res)
+	if err := checkStatus(node, status, err); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(res)
+	}
+	fmt.Println()
+	printShards(res.Shards)
+	return nil
+}
+
+//Ask the user to confirm an action on stdin
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+//Print the balance of the ring for each node
+func ringCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	res := struct {
+		Nodes []struct {
+			Address   string  `json:"address"`
+			Ownership float64 `json:"ownership"`
+			Tokens    int     `json:"tokens"`
+			KeyCount  int     `json:"key-count"`
+		} `json:"nodes"`
+		Tokens          json.RawMessage `json:"tokens"`
+		OwnershipStdDev float64         `json:"ownership-stddev"`
+	}{}
+	if _, err := c.requestAny(ctx, http.MethodGet, "/kvs/ring", nil, &res); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(res)
+	}
+
+	total := 0
+	for _, n := range res.Nodes {
+		total += n.KeyCount
+	}
+
+	rows := [][]string{}
+	for _, n := range res.Nodes {
+		share := 0.0
+		if total > 0 {
+			share = float64(n.KeyCount) / float64(total)
+		}
+		rows = append(rows, []string{n.Address, strconv.Itoa(n.Tokens), formatPercent(n.Ownership), strconv.Itoa(n.KeyCount), formatPercent(share)})
+	}
+	printTable([]string{"NODE", "TOKENS", "OWNERSHIP", "KEYS", "KEY SHARE"}, rows)
+	fmt.Printf("\nOwnership standard deviation: %.4f\n", res.OwnershipStdDev)
+	return nil
+}
+
+//Print the number of keys on each node in the view
+func keyCountCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	view := viewResponse{}
+	if _, err := c.requestAny(ctx, http.MethodGet, "/kvs/view", nil, &view); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	var firstErr error
+	shards := make([]shardCount, len(view.View.Nodes))
+
+	wg.Add(len(view.View.Nodes))
+	for i, node := range view.View.Nodes {
+		go func(i int, node string) {
+			defer wg.Done()
+
+			res := shardCount{}
+			status, _, err := c.request(ctx, http.MethodGet, node, "/kvs/key-count", nil, &res)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err := checkStatus(node, status, err); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			shards[i] = shardCount{Address: node, KeyCount: res.KeyCount}
+		}(i, node)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	} else if c.output == "json" {
+		return printJSON(shards)
+	}
+	printShards(shards)
+	return nil
+}
+
+func printShards(shards []shardCount) {
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Address < shards[j].Address })
+
+	total := 0
+	rows := [][]string{}
+	for _, s := range shards {
+		total += s.KeyCount
+		rows = append(rows, []string{s.Address, strconv.Itoa(s.KeyCount)})
+	}
+	rows = append(rows, []string{"TOTAL", strconv.Itoa(total)})
+	printTable([]string{"NODE", "KEYS"}, rows)
+}
+
+//Print the state of every node given and every node in the latest view
+func statusCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	states, _ := c.clusterStatus(ctx)
+	if c.output == "json" {
+		return printJSON(states)
+	}
+	printStates(states)
+	return nil
+}
+
+//Print node states until every node in the view is active with the same view epoch, which happens
+//once a view change has been applied by every node
+func watchCommand(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Second, "Time between checks")
+	epoch := flags.Uint64("epoch", 0, "Wait until the view reaches at least this epoch")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *interval <= 0 {
+		return errUsage
+	}
+
+	for {
+		states, latest := c.clusterStatus(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		converged := latest >= *epoch && latest > 0
+		for _, s := range states {
+			if s.InView && (!s.Active || s.Epoch != latest) {
+				converged = false
+			}
+		}
+
+		if c.output == "json" {
+			//One line for each check so the output can be streamed
+			b, err := json.Marshal(struct {
+				Time      time.Time   `json:"time"`
+				Epoch     uint64      `json:"epoch"`
+				Converged bool        `json:"converged"`
+				Nodes     []nodeState `json:"nodes"`
+			}{Time: time.Now(), Epoch: latest, Converged: converged, Nodes: states})
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		} else {
+			fmt.Printf("%s epoch %d\n", time.Now().Format("15:04:05"), latest)
+			printStates(states)
+			fmt.Println()
+		}
+
+		if converged {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*interval):
+		}
+	}
+}
+
+//Get the state of the given nodes and of every node in the latest view they report. Returns the
+//states and the epoch of the latest view
+func (c *ctl) clusterStatus(ctx context.Context) ([]nodeState, uint64) {
+	states, views := c.nodeStates(ctx, c.nodes)
+
+	latest := kvs.View{}
+	for _, v := range views {
+		if v.Epoch >= latest.Epoch && len(v.Nodes) > 0 {
+			latest = v
+		}
+	}
+
+	queried := make(map[string]bool, len(states))
+	for _, s := range states {
+		queried[s.Address] = true
+	}
+
+	missing := []string{}
+	for _, node := range latest.Nodes {
+		if !queried[node] {
+			missing = append(missing, node)
+		}
+	}
+	more, _ := c.nodeStates(ctx, missing)
+	states = append(states, more...)
+
+	inView := make(map[string]bool, len(latest.Nodes))
+	for _, node := range latest.Nodes {
+		inView[node] = true
+	}
+	for i := range states {
+		states[i].InView = inView[states[i].Address]
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Address < states[j].Address })
+	return states, latest.Epoch
+}
+
+//Get the state and view of several nodes concurrently
+func (c *ctl) nodeStates(ctx context.Context, nodes []string) ([]nodeState, []kvs.View) {
+	var wg sync.WaitGroup
+	states := make([]nodeState, len(nodes))
+	views := make([]kvs.View, len(nodes))
+
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node string) {
+			defer wg.Done()
+			states[i], views[i] = c.nodeState(ctx, node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	return states, views
+}
+
+//Get the setup status of a node and its view if it is active
+func (c *ctl) nodeState(ctx context.Context, node string) (nodeState, kvs.View) {
+	state := nodeState{Address: node}
+	status := struct {
+		Active       bool `json:"active"`
+		Coordinating bool `json:"coordinating"`
+	}{}
+
+	code, _, err := c.request(ctx, http.MethodGet, node, "/kvs/int/status", nil, &status)
+	if err = checkStatus(node, code, err); err != nil {
+		state.Error = err.Error()
+		return state, kvs.View{}
+	}
+	state.Reachable, state.Active, state.Coordinating = true, status.Active, status.Coordinating
+
+	if !state.Active {
+		return state, kvs.View{}
+	}
+
+	view := viewResponse{}
+	code, _, err = c.request(ctx, http.MethodGet, node, "/kvs/view", nil, &view)
+	if err = checkStatus(node, code, err); err != nil {
+		state.Error = err.Error()
+		return state, kvs.View{}
+	}
+	state.Epoch = view.View.Epoch
+	return state, view.View
+}
+
+func printStates(states []nodeState) {
+	rows := [][]string{}
+	for _, s := range states {
+		epoch := "-"
+		if s.Active {
+			epoch = strconv.FormatUint(s.Epoch, 10)
+		}
+		rows = append(rows, []string{s.Address, formatBool(s.Reachable), formatBool(s.Active), formatBool(s.Coordinating), formatBool(s.InView), epoch, s.Error})
+	}
+	printTable([]string{"NODE", "REACHABLE", "ACTIVE", "COORDINATING", "IN VIEW", "EPOCH", "ERROR"}, rows)
+}
+
+func formatPercent(f float64) string {
+	return strconv.FormatFloat(f*100, 'f', 1, 64) + "%"
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+//Keys fetched at once while exporting
+const exportChunkSize = 100
+
+//Line of an import or export file
+type pair struct {
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+	Binary []byte  `json:"binary,omitempty"` //Value which is not valid UTF-8, as base64
+}
+
+//Make a pair, keeping values which are not valid UTF-8 as binary since JSON strings would replace
+//their invalid bytes
+func newPair(key string, value string) pair {
+	if utf8.ValidString(value) {
+		return pair{Key: key, Value: &value}
+	}
+	return pair{Key: key, Binary: []byte(value)}
+}
+
+//Get the value of a pair, false if it has none
+func (p pair) value() (string, bool) {
+	if p.Binary != nil {
+		return string(p.Binary), true
+	} else if p.Value != nil {
+		return *p.Value, true
+	}
+	return "", false
+}
+
+func getCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	value, err := kv.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(newPair(args[0], value))
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func putCommand(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", 0, "Time until the key expires (default never)")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 || *ttl < 0 {
+		return errUsage
+	}
+	args = flags.Args()
+
+	var value string
+	if len(args) == 2 {
+		value = args[1]
+	} else {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	replaced, err := kv.PutWithTTL(ctx, args[0], value, *ttl)
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(struct {
+			Key      string `json:"key"`
+			Replaced bool   `json:"replaced"`
+		}{Key: args[0], Replaced: replaced})
+	} else if replaced {
+		fmt.Println("Updated", args[0])
+	} else {
+		fmt.Println("Added", args[0])
+	}
+	return nil
+}
+
+func deleteCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := kv.Delete(ctx, args[0]); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(struct {
+			Key     string `json:"key"`
+			Deleted bool   `json:"deleted"`
+		}{Key: args[0], Deleted: true})
+	}
+	fmt.Println("Deleted", args[0])
+	return nil
+}
+
+func incrCommand(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("incr", flag.ContinueOnError)
+	by := flags.Int64("by", 1, "Amount to add, negative to decrement")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	value, err := kv.Incr(ctx, flags.Arg(0), *by)
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return printJSON(struct {
+			Key   string `json:"key"`
+			Value int64  `json:"value"`
+		}{Key: flags.Arg(0), Value: value})
+	}
+	fmt.Println(value)
+	return nil
+}
+
+//Set keys read from a file with several requests in flight. Stops at the first failed key
+func importCommand(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	parallel := flags.Int("parallel", 8, "Keys set concurrently")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 || *parallel < 1 {
+		return errUsage
+	}
+
+	in := io.Reader(os.Stdin)
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	var firstErr error
+	imported := 0
+	pairs := make(chan pair)
+
+	wg.Add(*parallel)
+	for i := 0; i < *parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range pairs {
+				value, _ := p.value()
+				_, err := kv.Put(ctx, p.Key, value)
+
+				mutex.Lock()
+				if err == nil {
+					imported++
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("Unable to set %q: %v", p.Key, err)
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(in))
+	for ctx.Err() == nil {
+		p := pair{}
+		err := decoder.Decode(&p)
+		if err == io.EOF {
+			break
+		} else if _, hasValue := p.value(); err == nil && !hasValue {
+			err = fmt.Errorf("Key %q has no value or binary", p.Key)
+		}
+
+		if err != nil {
+			mutex.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Invalid input after %d keys: %v", imported, err)
+			}
+			mutex.Unlock()
+			break
+		}
+
+		select {
+		case pairs <- p:
+		case <-ctx.Done():
+		}
+	}
+	close(pairs)
+	wg.Wait()
+
+	if c.output == "json" {
+		if err := printJSON(struct {
+			Imported int `json:"imported"`
+		}{Imported: imported}); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "Imported %d keys\n", imported)
+	}
+	return firstErr
+}
+
+//Write every key outside namespaces to a file by listing the keys of each token from the node owning
+//it. Keys set during the export may be left out
+func exportCommand(ctx context.Context, c *ctl, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	kv, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = bufio.NewWriter(f)
+	}
+	encoder := json.NewEncoder(out)
+
+	exported := 0
+	for _, token := range kv.View().Tokens {
+		keys := []string{}
+		path := "/kvs/int/keys?token=" + strconv.FormatUint(token.Value, 10)
+		status, _, err := c.request(ctx, http.MethodGet, token.Endpoint, path, nil, &keys)
+		if err := checkStatus(token.Endpoint, status, err); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(keys); start += exportChunkSize {
+			end := start + exportChunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			values, err := kv.MultiGet(ctx, keys[start:end])
+			if err != nil {
+				return err
+			}
+
+			//Keys deleted since they were listed are skipped
+			for _, key := range keys[start:end] {
+				if value, exists := values[key]; exists {
+					if err := encoder.Encode(newPair(key, value)); err != nil {
+						return err
+					}
+					exported++
+				}
+			}
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		if c.output == "json" {
+			return printJSON(struct {
+				Exported int `json:"exported"`
+			}{Exported: exported})
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d keys\n", exported)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Fake single node cluster storing keys in a map
+type fakeNode struct {
+	mutex  sync.Mutex
+	values map[string]string
+	server *httptest.Server
+}
+
+func newFakeNode(t *testing.T, values map[string]string) *fakeNode {
+	n := &fakeNode{values: values}
+	n.server = httptest.NewServer(http.HandlerFunc(n.handle))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+func (n *fakeNode) address() string {
+	return strings.TrimPrefix(n.server.URL, "http://")
+}
+
+//Answer the view, key listing and key requests made by the client and kvsctl like a node
+func (n *fakeNode) handle(w http.ResponseWriter, r *http.Request) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if r.URL.Path == "/kvs/view" {
+		view := kvs.View{Nodes: []string{n.address()}, Epoch: 1, Tokens: []kvs.Token{{Endpoint: n.address(), Value: 0}}}
+		json.NewEncoder(w).Encode(map[string]interface{}{"view": view, "max-hash": 1000})
+		return
+	} else if r.URL.Path == "/kvs/int/keys" {
+		keys := []string{}
+		for key := range n.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/kvs/keys/")
+	res := struct {
+		Value  string `json:"value,omitempty"`
+		Binary []byte `json:"binary,omitempty"`
+	}{}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, exists := n.values[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+		} else if utf8.ValidString(value) {
+			res.Value = value
+		} else {
+			res.Binary = []byte(value)
+		}
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		req := struct {
+			Value  string
+			Binary []byte
+		}{}
+		json.Unmarshal(b, &req)
+		n.values[key] = req.Value
+		if req.Binary != nil {
+			n.values[key] = string(req.Binary)
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func testCtl(node *fakeNode) *ctl {
+	return &ctl{output: "table", timeout: time.Second, http: &http.Client{}, nodes: []string{node.address()}}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	values := map[string]string{
+		"text":           "value",
+		"empty":          "",
+		"unicode":        "héllo wörld",
+		"lines":          "a\nb\r\n",
+		"binary":         "\xff\xfe\x00\x01value",
+		"truncated rune": "abc\xe2\x82",
+	}
+	source := newFakeNode(t, map[string]string{})
+	for key, value := range values {
+		source.values[key] = value
+	}
+	file := filepath.Join(t.TempDir(), "keys.jsonl")
+
+	if err := exportCommand(ctx, testCtl(source), []string{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.Valid(b) {
+		t.Errorf("Export file is not valid UTF-8: %q", b)
+	}
+
+	destination := newFakeNode(t, map[string]string{})
+	if err := importCommand(ctx, testCtl(destination), []string{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range values {
+		if got, exists := destination.values[key]; !exists || got != value {
+			t.Errorf("%s: Want: %q true Got: %q %v", key, value, got, exists)
+		}
+	}
+	if len(destination.values) != len(values) {
+		t.Errorf("Want: %d keys Got: %v", len(values), destination.values)
+	}
+}
+
+func TestImport(t *testing.T) {
+	var tests = []struct {
+		name   string
+		input  string
+		values map[string]string
+		err    string //Prefix of the error
+	}{
+		{"value", `{"key": "a", "value": "1"}`, map[string]string{"a": "1"}, ""},
+		{"empty value", `{"key": "a", "value": ""}`, map[string]string{"a": ""}, ""},
+		{"binary", `{"key": "a", "binary": "/wA="}`, map[string]string{"a": "\xff\x00"}, ""},
+		{"binary over value", `{"key": "a", "value": "1", "binary": "Mg=="}`, map[string]string{"a": "2"}, ""},
+		{"missing value", `{"key": "a"}`, map[string]string{}, `Invalid input after 0 keys: Key "a" has no value or binary`},
+		{"invalid base64", `{"key": "a", "binary": "!"}`, map[string]string{}, "Invalid input after 0 keys: json: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "keys.jsonl")
+			if err := ioutil.WriteFile(file, []byte(tt.input+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			node := newFakeNode(t, map[string]string{})
+			err := importCommand(context.Background(), testCtl(node), []string{file})
+			if got := errorString(err); (got == "") != (tt.err == "") || !strings.HasPrefix(got, tt.err) {
+				t.Errorf("Want: %q Got: %q", tt.err, got)
+			}
+
+			if len(node.values) != len(tt.values) {
+				t.Errorf("Want: %v Got: %v", tt.values, node.values)
+			}
+			for key, value := range tt.values {
+				if node.values[key] != value {
+					t.Errorf("Want: %v Got: %v", tt.values, node.values)
+				}
+			}
+		})
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,216 @@
+//Command kvsctl administers a sharded-kvs cluster and reads and writes its keys
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kailask/sharded-kvs/client"
+)
+
+const usage = `Usage: kvsctl [flags] <command> [arguments]
+
+Key commands:
+  get <key>                        Print the value of a key
+  put [-ttl d] <key> [value]       Set a key, reading the value from stdin if it is not given
+  delete <key>                     Delete a key
+  incr [-by n] <key>               Add to the integer value of a key and print the result
+  import [-parallel n] [file]      Set keys from JSON lines of {"key", "value" or "binary"} (default stdin)
+  export [file]                    Write every key outside namespaces as JSON lines of {"key", "value" or "binary"} (default stdout)
+
+Cluster commands:
+  view show                        Print the nodes and tokens of the view
+  view change [-yes] <nodes>       Preview and then apply a view change to a comma separated list of nodes
+  ring                             Print the share of the hash space and keys of each node and token
+  status                           Print whether each node is reachable and active and its view epoch
+  key-count                        Print the number of keys stored on each node
+  watch [-interval d] [-epoch n]   Print node status until every node has the same view epoch
+
+Flags:
+`
+
+//Error printed for commands given the wrong arguments
+var errUsage = errors.New("Invalid arguments, see kvsctl -h")
+
+//Command line tool state shared by commands
+type ctl struct {
+	nodes   []string
+	output  string
+	timeout time.Duration
+	http    *http.Client
+}
+
+//Command taking the arguments after its name
+type command func(ctx context.Context, c *ctl, args []string) error
+
+var commands = map[string]command{
+	"get":       getCommand,
+	"put":       putCommand,
+	"delete":    deleteCommand,
+	"incr":      incrCommand,
+	"import":    importCommand,
+	"export":    exportCommand,
+	"view":      viewCommand,
+	"ring":      ringCommand,
+	"status":    statusCommand,
+	"key-count": keyCountCommand,
+	"watch":     watchCommand,
+}
+
+func main() {
+	defaultNodes := os.Getenv("KVSCTL_NODES")
+	if defaultNodes == "" {
+		defaultNodes = "localhost:13800"
+	}
+
+	nodes := flag.String("nodes", defaultNodes, "Comma separated nodes to contact (env KVSCTL_NODES)")
+	output := flag.String("o", "table", "Output format, table or json")
+	timeout := flag.Duration("timeout", 10*time.Second, "Deadline for each request")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, exists := commands[flag.Arg(0)]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	} else if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "Output format must be table or json")
+		os.Exit(2)
+	}
+
+	c := &ctl{output: *output, timeout: *timeout, http: &http.Client{}}
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			c.nodes = append(c.nodes, node)
+		}
+	}
+	if len(c.nodes) == 0 {
+		fmt.Fprintln(os.Stderr, "At least one node is required")
+		os.Exit(2)
+	}
+
+	//Interrupts cancel in progress requests, such as a watch
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if err := cmd(ctx, c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+//Create a client which routes key requests to the nodes owning them
+func (c *ctl) client(ctx context.Context) (*client.Client, error) {
+	return client.New(ctx, c.nodes, client.Options{Timeout: c.timeout, HTTPClient: c.http})
+}
+
+//Make a request to a node. The response body is decoded into res if given. Returns the response
+//status and headers
+func (c *ctl) request(ctx context.Context, method string, node string, path string, data interface{}, res interface{}) (int, http.Header, error) {
+	var body []byte
+	if data != nil {
+		var err error
+		if body, err = json.Marshal(data); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s%s", node, path), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	r, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Body.Close()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return r.StatusCode, r.Header, err
+	}
+
+	if res != nil && len(b) > 0 && r.StatusCode < http.StatusBadRequest {
+		if err := json.Unmarshal(b, res); err != nil {
+			return r.StatusCode, r.Header, fmt.Errorf("Invalid response from %s: %v", node, err)
+		}
+	}
+	return r.StatusCode, r.Header, nil
+}
+
+//Make a request to the first given node which responds. Fails unless the response status is 200
+func (c *ctl) requestAny(ctx context.Context, method string, path string, data interface{}, res interface{}) (string, error) {
+	var lastErr error
+	for _, node := range c.nodes {
+		status, _, err := c.request(ctx, method, node, path, data, res)
+		if err = checkStatus(node, status, err); err == nil {
+			return node, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+//Check that a node accepted a request
+func checkStatus(node string, status int, err error) error {
+	if err == nil && status != http.StatusOK {
+		return fmt.Errorf("Node %s returned status %d", node, status)
+	}
+	return err
+}
+
+//Print a value as indented JSON
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+//Print rows as a table with aligned columns
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
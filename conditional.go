@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Format a revision as an entity tag
+func etag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+//Get the precondition of a conditional write from the If-Match and If-None-Match headers. Returns nil
+//if neither is given, or a message for the client if a header is invalid
+func parsePrecondition(r *http.Request) (*kvs.Precondition, string) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, ""
+	}
+
+	p := &kvs.Precondition{}
+	var ok bool
+	if ifMatch != "" {
+		if p.Match, p.MatchAny, ok = parseETags(ifMatch); !ok {
+			return nil, "If-Match must be * or a list of revisions"
+		}
+	}
+	if ifNoneMatch != "" {
+		if p.NoneMatch, p.NoneMatchAny, ok = parseETags(ifNoneMatch); !ok {
+			return nil, "If-None-Match must be * or a list of revisions"
+		}
+	}
+	return p, ""
+}
+
+//Parse a header of * or a comma separated list of revisions, which may be quoted entity tags.
+//Returns the revisions, if the header was * and if it is valid
+func parseETags(header string) ([]uint64, bool, bool) {
+	if strings.TrimSpace(header) == "*" {
+		return nil, true, true
+	}
+
+	revisions := []uint64{}
+	for _, tag := range strings.Split(header, ",") {
+		//Weak tags compare the same as strong tags since revisions identify exact values
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+			tag = tag[1 : len(tag)-1]
+		}
+
+		revision, err := strconv.ParseUint(tag, 10, 64)
+		if err != nil {
+			return nil, false, false
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, false, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseETags(t *testing.T) {
+	var tests = []struct {
+		name      string
+		header    string
+		revisions []uint64
+		any       bool
+		ok        bool
+	}{
+		{"Single tag", `"3"`, []uint64{3}, false, true},
+		{"Tag list", `"3", "5",7`, []uint64{3, 5, 7}, false, true},
+		{"Weak tag", `W/"4"`, []uint64{4}, false, true},
+		{"Unquoted tag", `9`, []uint64{9}, false, true},
+		{"Any", ` * `, nil, true, true},
+		{"Not a revision", `"abc"`, nil, false, false},
+		{"Negative revision", `"-1"`, nil, false, false},
+		{"Empty tag in list", `"3",`, nil, false, false},
+		{"Empty header", ``, nil, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revisions, any, ok := parseETags(tt.header)
+			if !reflect.DeepEqual(revisions, tt.revisions) || any != tt.any || ok != tt.ok {
+				t.Errorf("Want: %v %v %v Got: %v %v %v", tt.revisions, tt.any, tt.ok, revisions, any, ok)
+			}
+		})
+	}
+}
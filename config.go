@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+//Config contains the settings of a node. Settings are applied in order of precedence
+//from command-line flags, environment variables, the config file and finally defaults
+type Config struct {
+	Address      string `json:"address" yaml:"address" toml:"address"`
+	View         string `json:"view" yaml:"view" toml:"view"`
+	Join         string `json:"join" yaml:"join" toml:"join"`
+	Secret       string `json:"secret" yaml:"secret" toml:"secret"`
+	LeaveOnExit  bool   `json:"leave-on-exit" yaml:"leave-on-exit" toml:"leave-on-exit"`
+	SetupTimeout string `json:"setup-timeout" yaml:"setup-timeout" toml:"setup-timeout"`
+	Listen       string `json:"listen" yaml:"listen" toml:"listen"`
+	Port         string `json:"port" yaml:"port" toml:"port"`
+	NumTokens    int    `json:"num-tokens" yaml:"num-tokens" toml:"num-tokens"`
+	MaxHash      uint64 `json:"max-hash" yaml:"max-hash" toml:"max-hash"`
+	MaxKeyLength int    `json:"max-key-length" yaml:"max-key-length" toml:"max-key-length"`
+
+	RESPListen     string `json:"resp-listen" yaml:"resp-listen" toml:"resp-listen"`
+	MemcacheListen string `json:"memcache-listen" yaml:"memcache-listen" toml:"memcache-listen"`
+
+	StorageEngine string `json:"storage-engine" yaml:"storage-engine" toml:"storage-engine"`
+
+	DataDir      string `json:"data-dir" yaml:"data-dir" toml:"data-dir"`
+	MemtableSize int    `json:"memtable-size" yaml:"memtable-size" toml:"memtable-size"`
+
+	ExpirySweepInterval string `json:"expiry-sweep-interval" yaml:"expiry-sweep-interval" toml:"expiry-sweep-interval"`
+
+	ChangeLogSize int `json:"change-log-size" yaml:"change-log-size" toml:"change-log-size"`
+
+	Webhooks          []WebhookConfig `json:"webhooks" yaml:"webhooks" toml:"webhooks"`
+	WebhookBatchSize  int             `json:"webhook-batch-size" yaml:"webhook-batch-size" toml:"webhook-batch-size"`
+	WebhookBatchDelay string          `json:"webhook-batch-delay" yaml:"webhook-batch-delay" toml:"webhook-batch-delay"`
+	WebhookTimeout    string          `json:"webhook-timeout" yaml:"webhook-timeout" toml:"webhook-timeout"`
+	WebhookRetries    int             `json:"webhook-retries" yaml:"webhook-retries" toml:"webhook-retries"`
+	DeadLetterSize    int             `json:"dead-letter-size" yaml:"dead-letter-size" toml:"dead-letter-size"`
+
+	Namespaces []NamespaceConfig `json:"namespaces" yaml:"namespaces" toml:"namespaces"`
+
+	TxnLog     string `json:"txn-log" yaml:"txn-log" toml:"txn-log"`
+	TxnTimeout string `json:"txn-timeout" yaml:"txn-timeout" toml:"txn-timeout"`
+
+	RequestTimeout      string `json:"request-timeout" yaml:"request-timeout" toml:"request-timeout"`
+	ReshardTimeout      string `json:"reshard-timeout" yaml:"reshard-timeout" toml:"reshard-timeout"`
+	Retries             int    `json:"retries" yaml:"retries" toml:"retries"`
+	RetryBackoff        string `json:"retry-backoff" yaml:"retry-backoff" toml:"retry-backoff"`
+	MaxRetryBackoff     string `json:"max-retry-backoff" yaml:"max-retry-backoff" toml:"max-retry-backoff"`
+	MaxConnsPerHost     int    `json:"max-conns-per-host" yaml:"max-conns-per-host" toml:"max-conns-per-host"`
+	MaxIdleConnsPerHost int    `json:"max-idle-conns-per-host" yaml:"max-idle-conns-per-host" toml:"max-idle-conns-per-host"`
+	InternalProtocol    string `json:"internal-protocol" yaml:"internal-protocol" toml:"internal-protocol"`
+
+	//Parsed durations
+	setupTimeout    time.Duration
+	requestTimeout  time.Duration
+	reshardTimeout  time.Duration
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+
+	expirySweepInterval time.Duration
+	txnTimeout          time.Duration
+	webhookBatchDelay   time.Duration
+	webhookTimeout      time.Duration
+}
+
+//A single config setting which can be given as a flag or environment variable
+type setting struct {
+	flag    string
+	env     string
+	usage   string
+	boolean bool
+	get     func(c *Config) string
+	set     func(c *Config, value string) error
+}
+
+//Command-line value of a setting, only applied if the flag was given
+type flagValue struct {
+	value   string
+	boolean bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.boolean }
+
+var settings = []setting{
+	{"address", "ADDRESS", "endpoint other nodes use to reach this node", false,
+		func(c *Config) string { return c.Address },
+		func(c *Config, v string) error { c.Address = v; return nil }},
+	{"view", "VIEW", "comma separated endpoints of nodes in the initial view", false,
+		func(c *Config) string { return c.View },
+		func(c *Config, v string) error { c.View = v; return nil }},
+	{"join", "JOIN", "endpoint of a running node to join through instead of an initial view", false,
+		func(c *Config) string { return c.Join },
+		func(c *Config, v string) error { c.Join = v; return nil }},
+	{"secret", "SECRET", "shared secret authenticating join and leave requests", false,
+		func(c *Config) string { return "" },
+		func(c *Config, v string) error { c.Secret = v; return nil }},
+	{"leave-on-exit", "LEAVE_ON_EXIT", "leave the view when the node is stopped", true,
+		func(c *Config) string { return strconv.FormatBool(c.LeaveOnExit) },
+		func(c *Config, v string) (err error) { c.LeaveOnExit, err = strconv.ParseBool(v); return }},
+	{"setup-timeout", "SETUP_TIMEOUT", "time a setup coordinator may be unreachable before the next node takes over, and waits for the other nodes", false,
+		func(c *Config) string { return c.SetupTimeout },
+		func(c *Config, v string) error { c.SetupTimeout = v; return nil }},
+	{"listen", "LISTEN", "address to listen on (default: port of address)", false,
+		func(c *Config) string { return c.Listen },
+		func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"resp-listen", "RESP_LISTEN", "address to accept Redis clients on (default: disabled)", false,
+		func(c *Config) string { return c.RESPListen },
+		func(c *Config, v string) error { c.RESPListen = v; return nil }},
+	{"memcache-listen", "MEMCACHE_LISTEN", "address to accept memcached clients on (default: disabled)", false,
+		func(c *Config) string { return c.MemcacheListen },
+		func(c *Config, v string) error { c.MemcacheListen = v; return nil }},
+	{"storage-engine", "STORAGE_ENGINE", "engine storing the keys of each partition, map, ordered or disk", false,
+		func(c *Config) string { return c.StorageEngine },
+		func(c *Config, v string) error { c.StorageEngine = v; return nil }},
+	{"data-dir", "DATA_DIR", "directory of the disk engine, cleared at startup", false,
+		func(c *Config) string { return c.DataDir },
+		func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{"memtable-size", "MEMTABLE_SIZE", "bytes of each partition the disk engine keeps in memory before writing a segment", false,
+		func(c *Config) string { return strconv.Itoa(c.MemtableSize) },
+		func(c *Config, v string) (err error) { c.MemtableSize, err = strconv.Atoi(v); return }},
+	{"expiry-sweep-interval", "EXPIRY_SWEEP_INTERVAL", "time between checks for expired keys", false,
+		func(c *Config) string { return c.ExpirySweepInterval },
+		func(c *Config, v string) error { c.ExpirySweepInterval = v; return nil }},
+	{"change-log-size", "CHANGE_LOG_SIZE", "changes to keys kept for the change feed of this node", false,
+		func(c *Config) string { return strconv.Itoa(c.ChangeLogSize) },
+		func(c *Config, v string) (err error) { c.ChangeLogSize, err = strconv.Atoi(v); return }},
+	{"webhook-batch-size", "WEBHOOK_BATCH_SIZE", "most events sent to a webhook in one request", false,
+		func(c *Config) string { return strconv.Itoa(c.WebhookBatchSize) },
+		func(c *Config, v string) (err error) { c.WebhookBatchSize, err = strconv.Atoi(v); return }},
+	{"webhook-batch-delay", "WEBHOOK_BATCH_DELAY", "time an event waits for more events to send to a webhook with it", false,
+		func(c *Config) string { return c.WebhookBatchDelay },
+		func(c *Config, v string) error { c.WebhookBatchDelay = v; return nil }},
+	{"webhook-timeout", "WEBHOOK_TIMEOUT", "deadline for each attempt to send events to a webhook", false,
+		func(c *Config) string { return c.WebhookTimeout },
+		func(c *Config, v string) error { c.WebhookTimeout = v; return nil }},
+	{"webhook-retries", "WEBHOOK_RETRIES", "times sending events to a webhook is retried before they are dead-lettered", false,
+		func(c *Config) string { return strconv.Itoa(c.WebhookRetries) },
+		func(c *Config, v string) (err error) { c.WebhookRetries, err = strconv.Atoi(v); return }},
+	{"dead-letter-size", "DEAD_LETTER_SIZE", "batches webhooks failed to receive kept for inspection", false,
+		func(c *Config) string { return strconv.Itoa(c.DeadLetterSize) },
+		func(c *Config, v string) (err error) { c.DeadLetterSize, err = strconv.Atoi(v); return }},
+	{"txn-log", "TXN_LOG", "file this node logs the decisions of the transactions it coordinates to (default: named after address)", false,
+		func(c *Config) string { return c.TxnLog },
+		func(c *Config, v string) error { c.TxnLog = v; return nil }},
+	{"txn-timeout", "TXN_TIMEOUT", "time a prepared transaction waits before asking its coordinator for the decision", false,
+		func(c *Config) string { return c.TxnTimeout },
+		func(c *Config, v string) error { c.TxnTimeout = v; return nil }},
+	{"port", "PORT", "default port for endpoints without one", false,
+		func(c *Config) string { return c.Port },
+		func(c *Config, v string) error { c.Port = v; return nil }},
+	{"num-tokens", "NUM_TOKENS", "tokens generated for each added node", false,
+		func(c *Config) string { return strconv.Itoa(c.NumTokens) },
+		func(c *Config, v string) (err error) { c.NumTokens, err = strconv.Atoi(v); return }},
+	{"max-hash", "MAX_HASH", "size of the hash space", false,
+		func(c *Config) string { return strconv.FormatUint(c.MaxHash, 10) },
+		func(c *Config, v string) (err error) { c.MaxHash, err = strconv.ParseUint(v, 10, 64); return }},
+	{"max-key-length", "MAX_KEY_LENGTH", "maximum length of a key", false,
+		func(c *Config) string { return strconv.Itoa(c.MaxKeyLength) },
+		func(c *Config, v string) (err error) { c.MaxKeyLength, err = strconv.Atoi(v); return }},
+	{"request-timeout", "REQUEST_TIMEOUT", "deadline for each attempt of a request to another node", false,
+		func(c *Config) string { return c.RequestTimeout },
+		func(c *Config, v string) error { c.RequestTimeout = v; return nil }},
+	{"reshard-timeout", "RESHARD_TIMEOUT", "deadline for requests to another node which move keys during a view change", false,
+		func(c *Config) string { return c.ReshardTimeout },
+		func(c *Config, v string) error { c.ReshardTimeout = v; return nil }},
+	{"retries", "RETRIES", "times a failed idempotent request to another node is retried", false,
+		func(c *Config) string { return strconv.Itoa(c.Retries) },
+		func(c *Config, v string) (err error) { c.Retries, err = strconv.Atoi(v); return }},
+	{"retry-backoff", "RETRY_BACKOFF", "delay before the first retry, doubled for each further retry", false,
+		func(c *Config) string { return c.RetryBackoff },
+		func(c *Config, v string) error { c.RetryBackoff = v; return nil }},
+	{"max-retry-backoff", "MAX_RETRY_BACKOFF", "maximum delay between retries", false,
+		func(c *Config) string { return c.MaxRetryBackoff },
+		func(c *Config, v string) error { c.MaxRetryBackoff = v; return nil }},
+	{"max-conns-per-host", "MAX_CONNS_PER_HOST", "maximum connections to each other node, 0 for no limit", false,
+		func(c *Config) string { return strconv.Itoa(c.MaxConnsPerHost) },
+		func(c *Config, v string) (err error) { c.MaxConnsPerHost, err = strconv.Atoi(v); return }},
+	{"max-idle-conns-per-host", "MAX_IDLE_CONNS_PER_HOST", "idle connections kept open to each other node", false,
+		func(c *Config) string { return strconv.Itoa(c.MaxIdleConnsPerHost) },
+		func(c *Config, v string) (err error) { c.MaxIdleConnsPerHost, err = strconv.Atoi(v); return }},
+	{"internal-protocol", "INTERNAL_PROTOCOL", "protocol for requests to other nodes, grpc or http", false,
+		func(c *Config) string { return c.InternalProtocol },
+		func(c *Config, v string) error { c.InternalProtocol = v; return nil }},
+}
+
+//Returns config with default settings
+func defaultConfig() *Config {
+	c := &Config{
+		SetupTimeout:        "10s",
+		Port:                "13800",
+		NumTokens:           200,
+		MaxHash:             1000000,
+		MaxKeyLength:        50,
+		RequestTimeout:      "5s",
+		ReshardTimeout:      "60s",
+		Retries:             2,
+		RetryBackoff:        "100ms",
+		MaxRetryBackoff:     "5s",
+		MaxConnsPerHost:     64,
+		MaxIdleConnsPerHost: 16,
+		InternalProtocol:    "grpc",
+		StorageEngine:       "map",
+		DataDir:             "data",
+		MemtableSize:        1024 * 1024,
+		ExpirySweepInterval: "1s",
+		ChangeLogSize:       100000,
+		WebhookBatchSize:    100,
+		WebhookBatchDelay:   "1s",
+		WebhookTimeout:      "5s",
+		WebhookRetries:      5,
+		DeadLetterSize:      1000,
+		TxnTimeout:          "10s",
+	}
+	c.parseDurations()
+	return c
+}
+
+//Parse duration settings, returning an error for the first invalid one
+func (c *Config) parseDurations() error {
+	durations := []struct {
+		name   string
+		value  string
+		parsed *time.Duration
+	}{
+		{"Setup timeout", c.SetupTimeout, &c.setupTimeout},
+		{"Request timeout", c.RequestTimeout, &c.requestTimeout},
+		{"Reshard timeout", c.ReshardTimeout, &c.reshardTimeout},
+		{"Retry backoff", c.RetryBackoff, &c.retryBackoff},
+		{"Max retry backoff", c.MaxRetryBackoff, &c.maxRetryBackoff},
+		{"Expiry sweep interval", c.ExpirySweepInterval, &c.expirySweepInterval},
+		{"Transaction timeout", c.TxnTimeout, &c.txnTimeout},
+		{"Webhook batch delay", c.WebhookBatchDelay, &c.webhookBatchDelay},
+		{"Webhook timeout", c.WebhookTimeout, &c.webhookTimeout},
+	}
+
+	for _, d := range durations {
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("%s %q must be a positive duration such as 10s", d.name, d.value)
+		}
+		*d.parsed = parsed
+	}
+	return nil
+}
+
+//Load config from command-line arguments, environment variables and config file
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("sharded-kvs", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG"), "path to a JSON, YAML or TOML config file [$CONFIG]")
+	flags := make(map[string]*flagValue, len(settings))
+	for _, s := range settings {
+		flags[s.flag] = &flagValue{value: s.get(c), boolean: s.boolean}
+		fs.Var(flags[s.flag], s.flag, fmt.Sprintf("%s [$%s]", s.usage, s.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, exists := os.LookupEnv(s.env); exists {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("Invalid value %q for $%s: %v", value, s.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(c, flags[s.flag].value); e != nil {
+					err = fmt.Errorf("Invalid value %q for -%s: %v", flags[s.flag].value, s.flag, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.validate()
+}
+
+//Decode config file into c based on its extension. Unknown settings are rejected so a misspelled one
+//is not silently left at its default
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown setting %q", undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("Config file %s must have a .json, .yaml, .yml or .toml extension", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+//Transaction log of the node at an address, named after it so nodes sharing a working directory
+//have their own log
+func defaultTxnLog(address string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+	return "txn-" + name + ".log"
+}
+
+//Check that settings are usable and normalize endpoints
+func (c *Config) validate() error {
+	if p, err := strconv.ParseUint(c.Port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("Port %q must be a number between 1 and 65535", c.Port)
+	}
+
+	if c.Address == "" {
+		return errors.New("Address is required, set it with -address or $ADDRESS")
+	}
+	address, err := normalizeEndpoint(c.Address, c.Port)
+	if err != nil {
+		return fmt.Errorf("Invalid address: %v", err)
+	}
+	c.Address = address
+
+	nodes := 1
+	if c.View != "" {
+		view, err := parseView(c.View, c.Port)
+		if err != nil {
+			return fmt.Errorf("Invalid view: %v", err)
+		}
+		c.View = strings.Join(view, ",")
+		nodes = len(view)
+	}
+
+	if c.Join != "" {
+		if c.View != "" {
+			return errors.New("Only one of view and join can be set")
+		}
+
+		seed, err := normalizeEndpoint(c.Join, c.Port)
+		if err != nil {
+			return fmt.Errorf("Invalid join endpoint: %v", err)
+		}
+		c.Join = seed
+	}
+
+	if c.Join != "" && c.Secret == "" {
+		return errors.New("A secret is required to join through another node, set it with -secret or $SECRET")
+	}
+
+	if err := c.parseDurations(); err != nil {
+		return err
+	}
+
+	if c.Listen == "" {
+		_, port, _ := net.SplitHostPort(c.Address)
+		c.Listen = ":" + port
+	} else if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address %q, must be [host]:port", c.Listen)
+	}
+
+	if c.RESPListen != "" {
+		if _, _, err := net.SplitHostPort(c.RESPListen); err != nil {
+			return fmt.Errorf("Invalid RESP listen address %q, must be [host]:port", c.RESPListen)
+		}
+	}
+
+	if c.MemcacheListen != "" {
+		if _, _, err := net.SplitHostPort(c.MemcacheListen); err != nil {
+			return fmt.Errorf("Invalid memcache listen address %q, must be [host]:port", c.MemcacheListen)
+		}
+	}
+
+	c.StorageEngine = strings.ToLower(c.StorageEngine)
+	if _, exists := kvs.Engines[c.StorageEngine]; !exists {
+		return fmt.Errorf("Storage engine %q must be map, ordered or disk", c.StorageEngine)
+	}
+
+	if c.MemtableSize < 1 {
+		return fmt.Errorf("Memtable size %d must be at least 1", c.MemtableSize)
+	}
+
+	if c.ChangeLogSize < 1 {
+		return fmt.Errorf("Change log size %d must be at least 1", c.ChangeLogSize)
+	}
+
+	if err := validateWebhooks(c.Webhooks); err != nil {
+		return err
+	} else if c.WebhookBatchSize < 1 {
+		return fmt.Errorf("Webhook batch size %d must be at least 1", c.WebhookBatchSize)
+	} else if c.WebhookRetries < 0 {
+		return fmt.Errorf("Webhook retries %d must not be negative", c.WebhookRetries)
+	} else if c.DeadLetterSize < 1 {
+		return fmt.Errorf("Dead letter size %d must be at least 1", c.DeadLetterSize)
+	}
+
+	if err := validateNamespaces(c.Namespaces, c.MaxKeyLength); err != nil {
+		return err
+	}
+
+	//Nodes started in the same directory must not share a transaction log
+	if c.TxnLog == "" {
+		c.TxnLog = defaultTxnLog(c.Address)
+	}
+
+	if c.NumTokens < 1 {
+		return fmt.Errorf("Number of tokens %d must be at least 1", c.NumTokens)
+	}
+
+	//Tokens must be unique within the hash space
+	if c.MaxHash < uint64(c.NumTokens)*uint64(nodes)*2 {
+		return fmt.Errorf("Max hash %d is too small for %d tokens on each of %d nodes", c.MaxHash, c.NumTokens, nodes)
+	}
+
+	if c.MaxKeyLength < 1 {
+		return fmt.Errorf("Max key length %d must be at least 1", c.MaxKeyLength)
+	}
+
+	if c.Retries < 0 {
+		return fmt.Errorf("Retries %d must not be negative", c.Retries)
+	} else if c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("Max connections per host %d must not be negative", c.MaxConnsPerHost)
+	} else if c.MaxIdleConnsPerHost < 1 {
+		return fmt.Errorf("Max idle connections per host %d must be at least 1", c.MaxIdleConnsPerHost)
+	}
+
+	c.InternalProtocol = strings.ToLower(c.InternalProtocol)
+	if c.InternalProtocol != "grpc" && c.InternalProtocol != "http" {
+		return fmt.Errorf("Internal protocol %q must be grpc or http", c.InternalProtocol)
+	}
+	return nil
+}
+
+//Handle external get request for the node's effective configuration
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	config := *MyConfig
+	if config.Secret != "" {
+		config.Secret = "********"
+	}
+
+	b, err := json.Marshal(struct {
+		Message string  `json:"message"`
+		Config  *Config `json:"config"`
+	}{Message: "Configuration retrieved successfully", Config: &config})
+
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultTxnLog(t *testing.T) {
+	var tests = []struct {
+		name    string
+		address string
+		want    string
+	}{
+		{"IPv4", "10.10.0.2:8080", "txn-10.10.0.2_8080.log"},
+		{"Host name", "node-1.local:8080", "txn-node-1.local_8080.log"},
+		{"IPv6", "[::1]:8080", "txn-___1__8080.log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultTxnLog(tt.address); got != tt.want {
+				t.Errorf("Want: %v Got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	var tests = []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want int
+	}{
+		{"Default", "", nil, nil, 2},
+		{"File", `{"retries": 3}`, nil, nil, 3},
+		{"Environment over file", `{"retries": 3}`, map[string]string{"RETRIES": "4"}, nil, 4},
+		{"Flag over environment", `{"retries": 3}`, map[string]string{"RETRIES": "4"}, []string{"-retries", "5"}, 5},
+		{"Flag over file", `{"retries": 3}`, nil, []string{"-retries", "5"}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-address", "10.10.0.2"}, tt.args...)
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", path)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			c, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Retries != tt.want {
+				t.Errorf("Want: %v Got: %v", tt.want, c.Retries)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	var tests = []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{"JSON", "config.json", `{"retries": 3, "webhooks": [{"url": "http://a"}]}`, false},
+		{"JSON unknown setting", "config.json", `{"retry": 3}`, true},
+		{"JSON unknown nested setting", "config.json", `{"webhooks": [{"uri": "http://a"}]}`, true},
+		{"YAML", "config.yaml", "retries: 3\n", false},
+		{"YAML unknown setting", "config.yml", "retry: 3\n", true},
+		{"TOML", "config.toml", "retries = 3\n[[webhooks]]\nurl = \"http://a\"\n", false},
+		{"TOML unknown setting", "config.toml", "retry = 3\n", true},
+		{"TOML unknown nested setting", "config.toml", "[[webhooks]]\nuri = \"http://a\"\n", true},
+		{"Unknown format", "config.ini", "retries = 3\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := defaultConfig()
+			err := c.loadFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Want: error %v Got: %v", tt.wantErr, err)
+			}
+			if err == nil && c.Retries != 3 {
+				t.Errorf("Want: 3 retries Got: %v", c.Retries)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"Valid", func(c *Config) {}, ""},
+		{"Port", func(c *Config) { c.Port = "0" }, `Port "0" must be a number between 1 and 65535`},
+		{"No address", func(c *Config) { c.Address = "" }, "Address is required, set it with -address or $ADDRESS"},
+		{"Address", func(c *Config) { c.Address = ":8080" }, `Invalid address: Endpoint ":8080" is missing a host`},
+		{"View", func(c *Config) { c.View = "10.10.0.2,10.10.0.2" }, `Invalid view: Endpoint "10.10.0.2:13800" is in the view more than once`},
+		{"View and join", func(c *Config) { c.View, c.Join = "10.10.0.2", "10.10.0.3" }, "Only one of view and join can be set"},
+		{"Join", func(c *Config) { c.Join = "10.10.0.3:0" }, `Invalid join endpoint: Endpoint "10.10.0.3:0" has an invalid port`},
+		{"Join without secret", func(c *Config) { c.Join = "10.10.0.3" }, "A secret is required to join through another node, set it with -secret or $SECRET"},
+		{"Duration", func(c *Config) { c.RequestTimeout = "0s" }, `Request timeout "0s" must be a positive duration such as 10s`},
+		{"Listen", func(c *Config) { c.Listen = "8080" }, `Invalid listen address "8080", must be [host]:port`},
+		{"RESP listen", func(c *Config) { c.RESPListen = "6379" }, `Invalid RESP listen address "6379", must be [host]:port`},
+		{"Memcache listen", func(c *Config) { c.MemcacheListen = "11211" }, `Invalid memcache listen address "11211", must be [host]:port`},
+		{"Storage engine", func(c *Config) { c.StorageEngine = "tree" }, `Storage engine "tree" must be map, ordered or disk`},
+		{"Memtable size", func(c *Config) { c.MemtableSize = 0 }, "Memtable size 0 must be at least 1"},
+		{"Change log size", func(c *Config) { c.ChangeLogSize = 0 }, "Change log size 0 must be at least 1"},
+		{"Webhook", func(c *Config) { c.Webhooks = []WebhookConfig{{URL: "ftp://a"}} }, `Webhook URL "ftp://a" must be an http or https URL`},
+		{"Webhook batch size", func(c *Config) { c.WebhookBatchSize = 0 }, "Webhook batch size 0 must be at least 1"},
+		{"Webhook retries", func(c *Config) { c.WebhookRetries = -1 }, "Webhook retries -1 must not be negative"},
+		{"Dead letter size", func(c *Config) { c.DeadLetterSize = 0 }, "Dead letter size 0 must be at least 1"},
+		{"Namespace", func(c *Config) { c.Namespaces = []NamespaceConfig{{Name: "a"}, {Name: "a"}} }, `Namespace "a" is configured twice`},
+		{"Number of tokens", func(c *Config) { c.NumTokens = 0 }, "Number of tokens 0 must be at least 1"},
+		{"Max hash", func(c *Config) { c.MaxHash = 100 }, "Max hash 100 is too small for 200 tokens on each of 1 nodes"},
+		{"Max key length", func(c *Config) { c.MaxKeyLength = 0 }, "Max key length 0 must be at least 1"},
+		{"Retries", func(c *Config) { c.Retries = -1 }, "Retries -1 must not be negative"},
+		{"Max connections", func(c *Config) { c.MaxConnsPerHost = -1 }, "Max connections per host -1 must not be negative"},
+		{"Max idle connections", func(c *Config) { c.MaxIdleConnsPerHost = 0 }, "Max idle connections per host 0 must be at least 1"},
+		{"Internal protocol", func(c *Config) { c.InternalProtocol = "udp" }, `Internal protocol "udp" must be grpc or http`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.Address = "10.10.0.2"
+			tt.change(c)
+
+			got := ""
+			if err := c.validate(); err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("Want: %q Got: %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Outcomes of distributed transactions. Transactions unknown to their coordinator are presumed to
+//have aborted, so only commits are logged
+const (
+	txnPending   = "pending"
+	txnCommitted = "committed"
+	txnAborted   = "aborted"
+	txnDone      = "done" //Logged once every participant has committed
+)
+
+//Returned when a participant of a distributed transaction could not be reached to prepare it
+var errTxnUnavailable = errors.New("Unable to reach every node storing the keys of the transaction")
+
+//Returned when a view change cannot start since transactions are still prepared on keys it may move
+var errTxnsPrepared = errors.New("Transactions are still prepared, try the view change again")
+
+var (
+	txnMutex    sync.Mutex
+	txnOutcomes = map[string]string{} //Transactions coordinated by this node which are not done
+	txnLog      *os.File
+	txnCounter  uint64
+)
+
+//Body of requests to prepare a distributed transaction on a participant with a transaction for each
+//token it stores
+type txnPrepare struct {
+	ID          string       `json:"id"`
+	Coordinator string       `json:"coordinator"`
+	Txns        []txnRequest `json:"txns"`
+}
+
+//Body of requests to commit or abort a distributed transaction and of responses with its outcome
+type txnDecision struct {
+	ID        string            `json:"id"`
+	Outcome   string            `json:"outcome,omitempty"`
+	Revisions map[string]uint64 `json:"revisions,omitempty"`
+}
+
+//Record of the transaction log
+type txnLogRecord struct {
+	ID           string   `json:"id"`
+	Outcome      string   `json:"outcome"`
+	Participants []string `json:"participants,omitempty"`
+}
+
+//Open the transaction log, compacting it to the transactions which committed but were not done
+//before the node stopped. Commits of those transactions are sent again in the background
+func recoverTxns(path string) error {
+	undone := make(map[string][]string)
+	var order []string
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			record := txnLogRecord{}
+			//A record cut short by a crash was never acted on
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+
+			if record.Outcome == txnCommitted {
+				undone[record.ID] = record.Participants
+				order = append(order, record.ID)
+			} else {
+				delete(undone, record.ID)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	for _, id := range order {
+		if participants, exists := undone[id]; exists {
+			b, _ := json.Marshal(txnLogRecord{ID: id, Outcome: txnCommitted, Participants: participants})
+			if _, err := tmp.Write(append(b, '\n')); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	txnLog, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	for id, participants := range undone {
+		log.Printf("Recovered committed transaction %s\n", id)
+		txnOutcomes[id] = txnCommitted
+		go finishCommit(id, participants)
+	}
+	return nil
+}
+
+//Durably append a record to the transaction log
+func logTxn(record txnLogRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	txnMutex.Lock()
+	defer txnMutex.Unlock()
+	if _, err := txnLog.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return txnLog.Sync()
+}
+
+//Set the outcome of a transaction coordinated by this node, forgetting it once it is aborted or done
+func setTxnOutcome(id string, outcome string) {
+	txnMutex.Lock()
+	defer txnMutex.Unlock()
+
+	if outcome == txnAborted || outcome == txnDone {
+		delete(txnOutcomes, id)
+	} else {
+		txnOutcomes[id] = outcome
+	}
+}
+
+//Outcome of a transaction coordinated by this node
+func localTxnOutcome(id string) string {
+	txnMutex.Lock()
+	defer txnMutex.Unlock()
+
+	if outcome, exists := txnOutcomes[id]; exists {
+		return outcome
+	}
+	return txnAborted
+}
+
+//Execute a transaction with keys stored under several tokens using two phase commit. Every
+//participant prepares its part of the transaction, locking its keys, and the writes are only made
+//once all of them are prepared and the decision to commit is logged
+func coordinateTxn(ctx context.Context, t txnRequest, nodes map[string][]txnRequest) (txnResult, error) {
+	id := fmt.Sprintf("%s-%x-%d", MyAddress, time.Now().UnixNano(), atomic.AddUint64(&txnCounter, 1))
+	setTxnOutcome(id, txnPending)
+
+	type vote struct {
+		result txnResult
+		err    error
+	}
+	votes := make(chan vote, len(nodes))
+	var participants []string
+	for node, txns := range nodes {
+		participants = append(participants, node)
+		go func(node string, txns []txnRequest) {
+			result, err := prepareTxn(ctx, node, txnPrepare{ID: id, Coordinator: MyAddress, Txns: txns})
+			votes <- vote{result, err}
+		}(node, txns)
+	}
+
+	result := txnResult{Revisions: make(map[string]uint64)}
+	reads := make(map[string]txnRead)
+	var err error
+	for range nodes {
+		v := <-votes
+		for _, read := range v.result.Reads {
+			reads[read.Key] = read
+		}
+		result.Failed = append(result.Failed, v.result.Failed...)
+
+		if v.err == kvs.ErrConditionNotMet || (v.err != nil && err == nil) {
+			err = v.err
+		}
+	}
+	for _, key := range t.Reads {
+		result.Reads = append(result.Reads, reads[key])
+	}
+
+	if err == nil {
+		err = logTxn(txnLogRecord{ID: id, Outcome: txnCommitted, Participants: participants})
+	}
+	if err != nil {
+		setTxnOutcome(id, txnAborted)
+		abortTxn(ctx, id, participants)
+		if err != kvs.ErrConditionNotMet && err != kvs.ErrLocked {
+			log.Printf("Aborted transaction %s: %v\n", id, err)
+			err = errTxnUnavailable
+		}
+		return result, err
+	}
+	setTxnOutcome(id, txnCommitted)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failed []string
+	for _, node := range participants {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			revisions, err := commitTxn(ctx, node, id)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed = append(failed, node)
+			}
+			for key, revision := range revisions {
+				result.Revisions[key] = revision
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	//The decision is logged so the transaction has committed even if some nodes have not applied it yet
+	if len(failed) > 0 {
+		go finishCommit(id, failed)
+	} else {
+		finishTxn(id)
+	}
+	return result, nil
+}
+
+//Send commits to the participants of a committed transaction until every one has applied it
+func finishCommit(id string, participants []string) {
+	for attempt := 0; ; attempt++ {
+		var remaining []string
+		for _, node := range participants {
+			if _, err := commitTxn(context.Background(), node, id); err == nil {
+				continue
+			} else if AmActive && !inView(node) {
+				//Keys of a node which left the view are gone along with its locks
+				log.Printf("Dropped commit of transaction %s to %s which left the view\n", id, node)
+				continue
+			} else {
+				log.Printf("Unable to commit transaction %s on %s: %v\n", id, node, err)
+			}
+			remaining = append(remaining, node)
+		}
+
+		participants = remaining
+		if len(participants) == 0 {
+			finishTxn(id)
+			return
+		}
+		time.Sleep(backoff(attempt))
+	}
+}
+
+//How long prepares are held for a view change if they are not released. Covers waiting for prepared
+//transactions along with notifying and resharding the nodes of the view
+func txnHoldLease() time.Duration {
+	return MyConfig.txnTimeout + 2*MyConfig.reshardTimeout
+}
+
+//Hold prepares on every node of a view, waiting for prepared transactions to be decided so that no
+//keys are locked while they are moved. Returns errTxnsPrepared if transactions are still prepared
+func holdTxns(ctx context.Context, nodes []string) error {
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	var firstErr error
+
+	wg.Add(len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			defer wg.Done()
+
+			err := holdTxnsOnNode(ctx, node)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+//Hold prepares on a single node
+func holdTxnsOnNode(ctx context.Context, node string) error {
+	if node == MyAddress {
+		if err := kvs.HoldPrepares(time.Now().Add(txnHoldLease()), MyConfig.txnTimeout); err != nil {
+			return errTxnsPrepared
+		}
+		return nil
+	}
+
+	//Waiting for prepared transactions takes up to the transaction timeout
+	policy := requestPolicy{timeout: MyConfig.txnTimeout + MyConfig.reshardTimeout, idempotent: true}
+	uri := fmt.Sprintf("http://%s/kvs/int/txn/hold", node)
+	res, err := internalRequest(ctx, http.MethodPost, uri, nil, policy)
+	if err != nil {
+		return err
+	} else if res.StatusCode == http.StatusConflict {
+		return errTxnsPrepared
+	} else if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+	return nil
+}
+
+//Release prepares held on the nodes of a view. Nodes which cannot be reached release them once
+//the hold lease runs out
+func releaseTxns(nodes []string) {
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		if node == MyAddress {
+			kvs.ReleasePrepares()
+			continue
+		}
+
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			uri := fmt.Sprintf("http://%s/kvs/int/txn/hold", node)
+			internalRequest(context.Background(), http.MethodDelete, uri, nil, quickPolicy(true))
+		}(node)
+	}
+	wg.Wait()
+}
+
+//Check if a node is in the current view
+func inView(node string) bool {
+	for _, n := range MyView.Nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+//Log that every participant has committed a transaction and forget it
+func finishTxn(id string) {
+	if err := logTxn(txnLogRecord{ID: id, Outcome: txnDone}); err != nil {
+		log.Println(err)
+	}
+	setTxnOutcome(id, txnDone)
+}
+
+//Prepare the transactions of a participant. Returns kvs.ErrConditionNotMet with the keys which
+//failed their condition or kvs.ErrLocked if a key is locked by another transaction
+func prepareTxn(ctx context.Context, node string, p txnPrepare) (txnResult, error) {
+	if node == MyAddress {
+		return applyPrepare(p)
+	}
+
+	result := txnResult{}
+	//Prepares are not retried since a prepare which reached the node holds its locks
+	uri := fmt.Sprintf("http://%s/kvs/int/txn/prepare", node)
+	res, err := internalRequest(ctx, http.MethodPost, uri, p, quickPolicy(false))
+	if err != nil {
+		return result, err
+	} else if res.StatusCode == http.StatusLocked {
+		return result, kvs.ErrLocked
+	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPreconditionFailed {
+		return result, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		return result, err
+	} else if res.StatusCode == http.StatusPreconditionFailed {
+		return result, kvs.ErrConditionNotMet
+	}
+	return result, nil
+}
+
+//Prepare the transactions of a participant on the local partitions
+func applyPrepare(p txnPrepare) (txnResult, error) {
+	txns := make(map[uint64]kvs.Txn, len(p.Txns))
+	var reads []string
+	for _, t := range p.Txns {
+		txns[t.Token] = t.toKVS()
+		reads = append(reads, t.Reads...)
+	}
+
+	res, err := kvs.Prepare(p.ID, p.Coordinator, txns)
+	return fromKVSResult(reads, res), err
+}
+
+//Commit a prepared transaction on a participant and return the new revisions of the keys set.
+//Participants which already committed the transaction return no revisions
+func commitTxn(ctx context.Context, node string, id string) (map[string]uint64, error) {
+	if node == MyAddress {
+		revisions, err := kvs.Commit(id)
+		if err == kvs.ErrTxnNotFound {
+			return nil, nil
+		}
+		return revisions, err
+	}
+
+	uri := fmt.Sprintf("http://%s/kvs/int/txn/commit", node)
+	res, err := internalRequest(ctx, http.MethodPost, uri, txnDecision{ID: id}, quickPolicy(true))
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		decision := txnDecision{}
+		err = json.Unmarshal(res.Body, &decision)
+		return decision.Revisions, err
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+}
+
+//Abort a transaction on its participants. Participants which cannot be reached abort it once
+//they ask this node for the outcome
+func abortTxn(ctx context.Context, id string, participants []string) {
+	var wg sync.WaitGroup
+	for _, node := range participants {
+		if node == MyAddress {
+			kvs.Abort(id)
+			continue
+		}
+
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			uri := fmt.Sprintf("http://%s/kvs/int/txn/abort", node)
+			internalRequest(ctx, http.MethodPost, uri, txnDecision{ID: id}, quickPolicy(true))
+		}(node)
+	}
+	wg.Wait()
+}
+
+//Get the outcome of a transaction from its coordinator
+func txnOutcome(ctx context.Context, coordinator string, id string) (string, error) {
+	if coordinator == MyAddress {
+		return localTxnOutcome(id), nil
+	}
+
+	uri := fmt.Sprintf("http://%s/kvs/int/txn/outcome?id=%s", coordinator, url.QueryEscape(id))
+	res, err := internalRequest(ctx, http.MethodGet, uri, nil, quickPolicy(true))
+	if err != nil {
+		return "", err
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Node %s returned status %d", coordinator, res.StatusCode)
+	}
+
+	decision := txnDecision{}
+	err = json.Unmarshal(res.Body, &decision)
+	return decision.Outcome, err
+}
+
+//Periodically ask the coordinators of transactions prepared for longer than the timeout for their
+//outcome. Transactions whose coordinator cannot be reached keep their locks until it recovers
+func resolveInDoubtTxns(timeout time.Duration) {
+	for range time.Tick(timeout) {
+		for id, coordinator := range kvs.InDoubt(time.Now().Add(-timeout)) {
+			outcome, err := txnOutcome(context.Background(), coordinator, id)
+			if err != nil {
+				log.Printf("Unable to resolve transaction %s with coordinator %s: %v\n", id, coordinator, err)
+				continue
+			}
+
+			switch outcome {
+			case txnCommitted:
+				if _, err := kvs.Commit(id); err != nil {
+					log.Println(err)
+				}
+				log.Printf("Resolved transaction %s as committed\n", id)
+			case txnAborted:
+				kvs.Abort(id)
+				log.Printf("Resolved transaction %s as aborted\n", id)
+			}
+		}
+	}
+}
+
+//Handle internal post request to prepare a distributed transaction. Returns 412 with the result if
+//a condition did not hold and 423 if its keys are locked
+func internalTxnPrepareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := txnPrepare{}
+	err = json.Unmarshal(b, &req)
+	if err != nil || req.ID == "" || req.Coordinator == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := applyPrepare(req)
+	if err == kvs.ErrLocked {
+		w.WriteHeader(http.StatusLocked)
+		return
+	} else if err != nil && err != kvs.ErrConditionNotMet {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	b, err = json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	} else if len(result.Failed) > 0 {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+//Handle internal post request to commit a prepared transaction. Returns 404 if it is not prepared
+func internalTxnCommitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := txnDecision{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := kvs.Commit(req.ID)
+	if err == kvs.ErrTxnNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		//The transaction stays prepared so the coordinator sends the commit again
+		log.Printf("Unable to commit transaction %s: %v\n", req.ID, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err = json.Marshal(txnDecision{ID: req.ID, Outcome: txnCommitted, Revisions: revisions})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle internal post request to abort a prepared transaction. Returns 404 if it is not prepared
+func internalTxnAbortHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := txnDecision{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := kvs.Abort(req.ID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+//Handle internal post request to hold prepares on this node while a view change moves keys, waiting
+//for prepared transactions to be decided. Returns 409 if some are still prepared. Handle internal
+//delete request to release prepares once the view change has finished
+func internalTxnHoldHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		kvs.ReleasePrepares()
+		w.WriteHeader(http.StatusOK)
+	} else if err := kvs.HoldPrepares(time.Now().Add(txnHoldLease()), MyConfig.txnTimeout); err != nil {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+//Handle internal get request for the outcome of a transaction coordinated by this node. Answered
+//even when this node is not in a view since the outcome only depends on the transaction log
+func internalTxnOutcomeHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, err := json.Marshal(txnDecision{ID: id, Outcome: localTxnOutcome(id)})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
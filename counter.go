@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/kailask/sharded-kvs/kvs"
+	"github.com/kailask/sharded-kvs/rpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//Body of increment requests between nodes and of their responses
+type increment struct {
+	Delta    int64  `json:"delta,omitempty"`
+	Value    int64  `json:"value"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+//Execute an internal increment request to another node and return the new value and revision
+func executeIncr(ctx context.Context, token kvs.Token, key string, delta int64) (int64, uint64, error) {
+	var value int64
+	var revision uint64
+	//Increments are not retried since each attempt which reached the node would be applied again
+	policy := quickPolicy(false)
+	handled, err := callGRPC(ctx, token.Endpoint, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		res, err := client.Incr(ctx, &rpc.IncrRequest{Token: token.Value, Key: key, Delta: delta})
+		value, revision = res.GetValue(), res.GetRevision()
+		return err
+	})
+	if handled {
+		switch status.Code(err) {
+		case codes.FailedPrecondition:
+			return value, revision, kvs.ErrNotInteger
+		case codes.OutOfRange:
+			return value, revision, kvs.ErrOverflow
+		case codes.Aborted:
+			return value, revision, kvs.ErrLocked
+		}
+		return value, revision, err
+	}
+
+	tokenValue := strconv.FormatUint(token.Value, 10)
+	uri := fmt.Sprintf("http://%s/kvs/int/%s/%s/incr", token.Endpoint, tokenValue, url.PathEscape(key))
+	res, err := internalRequest(ctx, http.MethodPost, uri, increment{Delta: delta}, policy)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		v := increment{}
+		err = json.Unmarshal(res.Body, &v)
+		return v.Value, v.Revision, err
+	case http.StatusConflict:
+		return 0, 0, kvs.ErrNotInteger
+	case http.StatusUnprocessableEntity:
+		return 0, 0, kvs.ErrOverflow
+	case http.StatusLocked:
+		return 0, 0, kvs.ErrLocked
+	}
+	return 0, 0, errors.New("Node returned bad status")
+}
+
+//Add delta to the integer value of a key on the node owning it and return the new value and revision.
+//Returns kvs.ErrNotInteger if the key does not hold an integer
+func routeIncr(ctx context.Context, key string, delta int64) (value int64, revision uint64, address string, err error) {
+	token := MyView.FindToken(key)
+	if token.Endpoint == MyAddress {
+		//Key should be stored locally
+		value, meta, err := kvs.Increment(token.Value, key, delta)
+		return value, meta.Revision, "", err
+	}
+
+	//Key should exist on other node
+	value, revision, err = executeIncr(ctx, token, key, delta)
+	return value, revision, token.Endpoint, err
+}
+
+//Handle internal post request to increment a key with token in url. Keys which do not hold an integer
+//return 409, increments which would overflow return 422 and locked keys return 423
+func internalIncrHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	key := pathVar(r, "key")
+	token, _ := strconv.ParseUint(mux.Vars(r)["token"], 10, 64)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := increment{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	value, meta, err := kvs.Increment(token, key, req.Delta)
+	switch err {
+	case nil:
+	case kvs.ErrNotInteger:
+		w.WriteHeader(http.StatusConflict)
+		return
+	case kvs.ErrOverflow:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	case kvs.ErrLocked:
+		w.WriteHeader(http.StatusLocked)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	b, err = json.Marshal(increment{Value: value, Revision: meta.Revision})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle external post requests to increment a key
+func incrHandler(w http.ResponseWriter, r *http.Request) {
+	handleIncrement(w, r, false)
+}
+
+//Handle external post requests to decrement a key
+func decrHandler(w http.ResponseWriter, r *http.Request) {
+	handleIncrement(w, r, true)
+}
+
+//Add the optional amount in the body, 1 by default, to the integer value of a key or subtract it
+//if decrementing. Missing keys are treated as 0
+func handleIncrement(w http.ResponseWriter, r *http.Request, decrement bool) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	res := struct {
+		Error    string `json:"error,omitempty"`
+		Message  string `json:"message"`
+		Value    string `json:"value,omitempty"`
+		Revision uint64 `json:"revision,omitempty"`
+		Address  string `json:"address,omitempty"`
+	}{}
+	key, _, keyError := requestKey(r)
+	op := "INCR"
+	if decrement {
+		op = "DECR"
+	}
+
+	req := struct {
+		By *int64 `json:"by"`
+	}{}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &req)
+	}
+
+	delta := int64(1)
+	if req.By != nil {
+		delta = *req.By
+	}
+	if decrement {
+		delta = -delta
+	}
+
+	if err != nil {
+		res.Error = "By must be an integer"
+		res.Message = "Error in " + op
+		w.WriteHeader(http.StatusBadRequest)
+	} else if decrement && req.By != nil && *req.By == math.MinInt64 {
+		//Negating the smallest integer overflows
+		res.Error = kvs.ErrOverflow.Error()
+		res.Message = "Error in " + op
+		w.WriteHeader(http.StatusBadRequest)
+	} else if len(pathVar(r, "key")) > MyConfig.MaxKeyLength {
+		res.Error = "Key is too long"
+		res.Message = "Error in " + op
+		w.WriteHeader(http.StatusBadRequest)
+	} else if keyError != "" {
+		res.Error = keyError
+		res.Message = "Error in " + op
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		value, revision, address, err := routeIncr(r.Context(), key, delta)
+		res.Address = address
+
+		if err == kvs.ErrNotInteger || err == kvs.ErrOverflow {
+			res.Error = err.Error()
+			res.Message = "Error in " + op
+			w.WriteHeader(http.StatusConflict)
+		} else if err == kvs.ErrLocked {
+			res.Error = err.Error()
+			res.Message = "Error in " + op
+			w.WriteHeader(http.StatusLocked)
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		} else {
+			res.Value = strconv.FormatInt(value, 10)
+			res.Revision = revision
+			w.Header().Set("ETag", etag(revision))
+			if decrement {
+				res.Message = "Decremented successfully"
+			} else {
+				res.Message = "Incremented successfully"
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	b, err = json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
@@ -2,4 +2,11 @@ module github.com/kailask/sharded-kvs
 
 go 1.13
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/gorilla/mux v1.8.0
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
+)
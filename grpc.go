@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+	"github.com/kailask/sharded-kvs/rpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+//Pairs sent in each message when streaming keys during a reshard
+const pushChunkSize = 1000
+
+//How long a node which does not implement a gRPC method is sent requests over HTTP before gRPC is
+//tried again
+const protocolRecheck = time.Minute
+
+//Connections to other nodes over gRPC
+var (
+	grpcConns     = make(map[string]*grpc.ClientConn)
+	httpOnlyUntil = make(map[string]time.Time) //Nodes to send requests over HTTP, such as nodes not yet upgraded
+	grpcMutex     = &sync.Mutex{}
+)
+
+//Implements the internal gRPC service with the same behaviour as the /kvs/int HTTP endpoints
+type internalServer struct {
+	rpc.UnimplementedInternalServer
+}
+
+//Error returned by every internal method while the node is not in a view
+var errInactive = status.Error(codes.PermissionDenied, "Node is not active")
+
+//Serve gRPC requests and other requests from the same listener. gRPC uses HTTP/2 without TLS
+func grpcHandler(grpcServer *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+//Get client connection to a node, dialing it if there is none
+func grpcConn(node string) (*grpc.ClientConn, error) {
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+
+	conn, exists := grpcConns[node]
+	if !exists {
+		var err error
+		conn, err = grpc.Dial(node, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		grpcConns[node] = conn
+	}
+	return conn, nil
+}
+
+//Close the connection to a node if it is still the one in use, so the next request dials the node
+//again rather than waiting out the reconnect backoff of the failed connection
+func dropGRPCConn(node string, conn *grpc.ClientConn) {
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+
+	if grpcConns[node] == conn {
+		delete(grpcConns, node)
+	}
+	conn.Close()
+}
+
+//Close the connections to nodes which are not in the view and forget which of them use HTTP
+func closeGRPCConns(nodes []string) {
+	inView := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		inView[node] = true
+	}
+
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+
+	for node, conn := range grpcConns {
+		if !inView[node] {
+			conn.Close()
+			delete(grpcConns, node)
+		}
+	}
+	for node := range httpOnlyUntil {
+		if !inView[node] {
+			delete(httpOnlyUntil, node)
+		}
+	}
+}
+
+//Wait for the connection to a node to be ready. Returns false if no HTTP/2 connection could be made,
+//in which case requests fail without being sent
+func grpcReady(ctx context.Context, conn *grpc.ClientConn, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		switch state := conn.GetState(); state {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return false
+		default:
+			if !conn.WaitForStateChange(ctx, state) {
+				return false
+			}
+		}
+	}
+}
+
+//Send requests to a node over HTTP for a while
+func fallBackToHTTP(node string) {
+	grpcMutex.Lock()
+	httpOnlyUntil[node] = time.Now().Add(protocolRecheck)
+	grpcMutex.Unlock()
+}
+
+//Check if requests to a node should be made over HTTP
+func useHTTP(node string) bool {
+	if MyConfig.InternalProtocol != "grpc" {
+		return true
+	}
+
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+	return time.Now().Before(httpOnlyUntil[node])
+}
+
+//Make a request to another node over gRPC, retrying idempotent requests which fail like requests
+//over HTTP. Returns false if the request must be made over HTTP instead, which happens only when the
+//node does not implement the method such as during a rolling upgrade, so the request cannot have been
+//executed. Requests which could not be sent because no HTTP/2 connection could be opened, such as to
+//a node which is down or restarting, are retried even if they are not idempotent
+func callGRPC(ctx context.Context, node string, policy requestPolicy, call func(ctx context.Context, client rpc.InternalClient) error) (bool, error) {
+	if useHTTP(node) {
+		return false, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := grpcConn(node)
+		if err != nil {
+			return true, status.Error(codes.Unavailable, err.Error())
+		}
+
+		sent := grpcReady(ctx, conn, policy.timeout)
+		if sent {
+			callCtx, cancel := context.WithTimeout(ctx, policy.timeout)
+			err = call(callCtx, rpc.NewInternalClient(conn))
+			cancel()
+		} else if ctx.Err() != nil {
+			return true, ctx.Err()
+		} else {
+			dropGRPCConn(node, conn)
+			err = status.Errorf(codes.Unavailable, "No connection to %s", node)
+		}
+
+		code := status.Code(err)
+		if code == codes.Unimplemented {
+			fallBackToHTTP(node)
+			return false, nil
+		}
+
+		retry := !sent || (policy.idempotent && (code == codes.Unavailable || code == codes.DeadlineExceeded))
+		if err == nil || !retry || attempt >= MyConfig.Retries || ctx.Err() != nil {
+			return true, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+//Make a post request to another node over gRPC, or to the HTTP endpoint at path with data if the
+//node does not accept gRPC. Returns true on success
+func postInternal(ctx context.Context, node string, path string, data interface{}, policy requestPolicy, call func(ctx context.Context, client rpc.InternalClient) error) bool {
+	if handled, err := callGRPC(ctx, node, policy, call); handled {
+		return err == nil
+	}
+	return makePost(ctx, fmt.Sprintf("http://%s%s", node, path), data, policy)
+}
+
+//Convert view to its protobuf message
+func toProtoView(v *kvs.View) *rpc.View {
+	tokens := make([]*rpc.Token, len(v.Tokens))
+	for i, t := range v.Tokens {
+		tokens[i] = &rpc.Token{Endpoint: t.Endpoint, Value: t.Value}
+	}
+	return &rpc.View{Nodes: v.Nodes, Tokens: tokens, Epoch: v.Epoch}
+}
+
+//Convert protobuf message to view
+func fromProtoView(v *rpc.View) kvs.View {
+	tokens := make([]kvs.Token, len(v.GetTokens()))
+	for i, t := range v.GetTokens() {
+		tokens[i] = kvs.Token{Endpoint: t.Endpoint, Value: t.Value}
+	}
+	return kvs.View{Nodes: v.GetNodes(), Tokens: tokens, Epoch: v.GetEpoch()}
+}
+
+//Convert precondition to protobuf message
+func toProtoPrecondition(p *kvs.Precondition) *rpc.Precondition {
+	if p == nil {
+		return nil
+	}
+	return &rpc.Precondition{Match: p.Match, MatchAny: p.MatchAny, NoneMatch: p.NoneMatch, NoneMatchAny: p.NoneMatchAny}
+}
+
+//Convert protobuf message to precondition
+func fromProtoPrecondition(p *rpc.Precondition) *kvs.Precondition {
+	if p == nil {
+		return nil
+	}
+	return &kvs.Precondition{Match: p.Match, MatchAny: p.MatchAny, NoneMatch: p.NoneMatch, NoneMatchAny: p.NoneMatchAny}
+}
+
+//Stream keys moved to another node during a reshard, each partition split into chunks
+func streamPush(ctx context.Context, client rpc.InternalClient, shard map[string]*kvs.Shard) error {
+	stream, err := client.Push(ctx)
+	if err != nil {
+		return err
+	}
+
+	for partition, keys := range shard {
+		token, err := strconv.ParseUint(partition, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		//Empty partitions are still sent so the node checks that it owns them
+		req := &rpc.PushRequest{Token: token}
+		keys.Each(func(key string, value string, meta kvs.Meta) {
+			if err != nil {
+				return
+			}
+
+			pair := &rpc.KeyValue{Key: key, Value: []byte(value), Revision: meta.Revision, Flags: meta.Flags}
+			if !meta.Expires.IsZero() {
+				pair.Expires = meta.Expires.UnixNano()
+			}
+			req.Pairs = append(req.Pairs, pair)
+			if len(req.Pairs) == pushChunkSize {
+				err = stream.Send(req)
+				req = &rpc.PushRequest{Token: token}
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(req.Pairs) > 0 || keys.Len() == 0 {
+			if err := stream.Send(req); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+//Get the value of a key stored under a token
+func (s *internalServer) Get(ctx context.Context, req *rpc.KeyRequest) (*rpc.GetResponse, error) {
+	if !AmActive {
+		return nil, errInactive
+	}
+
+	if v, meta, exists := kvs.GetItem(req.Token, req.Key); exists {
+		return &rpc.GetResponse{Value: []byte(v), Expires: expiryNanos(meta.Expires), Revision: meta.Revision}, nil
+	}
+	return nil, status.Error(codes.NotFound, "Key does not exist")
+}
+
+//Set the value of a key stored under a token
+func (s *internalServer) Set(ctx context.Context, req *rpc.SetRequest) (*rpc.SetResponse, error) {
+	if !AmActive {
+		return nil, errInactive
+	}
+
+	updated, revision, err := kvs.Set(req.Token, req.Key, string(req.Value), expiryTime(req.Expires), fromProtoPrecondition(req.Precondition).Check)
+	if err == kvs.ErrConditionNotMet {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err == kvs.ErrLocked {
+		return nil, status.Error(codes.Aborted, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &rpc.SetResponse{Updated: updated, Revision: revision}, nil
+}
+
+//Delete a key stored under a token
+func (s *internalServer) Delete(ctx context.Context, req *rpc.KeyRequest) (*rpc.Empty, error) {
+	if !AmActive {
+		return nil, errInactive
+	}
+
+	if _, err := kvs.DeleteItem(req.Token, req.Key, fromProtoPrecondition(req.Precondition).Check); err == kvs.ErrConditionNotMet {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err == kvs.ErrLocked {
+		return nil, status.Error(codes.Aborted, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &rpc.Empty{}, nil
+}
+
+//Add to the integer value of a key stored under a token
+func (s *internalServer) Incr(ctx context.Context, req *rpc.IncrRequest) (*rpc.IncrResponse, error) {
+	if !AmActive {
+		return nil, errInactive
+	}
+
+	value, meta, err := kvs.Increment(req.Token, req.Key, req.Delta)
+	switch err {
+	case nil:
+		return &rpc.IncrResponse{Value: value, Revision: meta.Revision}, nil
+	case kvs.ErrNotInteger:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case kvs.ErrOverflow:
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	case kvs.ErrLocked:
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	return nil, status.Error(codes.Internal, err.Error())
+}
+
+//Replace the view of an existing node or initialize a newly added node
+func (s *internalServer) ViewChange(ctx context.Context, req *rpc.ViewChangeRequest) (*rpc.Empty, error) {
+	var changes *kvs.Change
+	if req.Changes != nil {
+		changes = &kvs.Change{Removed: req.Changes.Removed, Tokens: req.Changes.Tokens}
+	}
+
+	if err := applyViewChange(fromProtoView(req.View), changes); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &rpc.Empty{}, nil
+}
+
+//Apply the changes of a view change and push moved keys to their new nodes
+func (s *internalServer) Reshard(ctx context.Context, req *rpc.Change) (*rpc.Empty, error) {
+	if !AmActive {
+		return nil, errInactive
+	}
+
+	if err := reshard(kvs.Change{Removed: req.Removed, Tokens: req.Tokens}); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &rpc.Empty{}, nil
+}
+
+//Receive keys moved to this node during a reshard
+func (s *internalServer) Push(stream rpc.Internal_PushServer) error {
+	if !AmActive {
+		return errInactive
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&rpc.Empty{})
+		} else if err != nil {
+			return err
+		}
+
+		shard := kvs.NewShard()
+		for _, pair := range req.Pairs {
+			meta := kvs.Meta{Flags: pair.Flags, Expires: expiryTime(pair.Expires), Revision: pair.Revision}
+			shard.Add(pair.Key, string(pair.Value), meta)
+		}
+
+		err = kvs.PushKeys(map[string]*kvs.Shard{strconv.FormatUint(req.Token, 10): shard})
+		if err != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kailask/sharded-kvs/rpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCallGRPC(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+	MyConfig.retryBackoff, MyConfig.requestTimeout = time.Millisecond, time.Second
+
+	server := startTestNode()
+	defer server.Close()
+	up := server.Listener.Addr().String()
+
+	//Nothing listens on the address of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	var tests = []struct {
+		name        string
+		node        string
+		idempotent  bool
+		code        codes.Code
+		wantHandled bool
+		wantCode    codes.Code
+		wantCalls   int
+		wantHTTP    bool
+	}{
+		{"Success", up, false, codes.OK, true, codes.OK, 1, false},
+		{"Unimplemented", up, false, codes.Unimplemented, false, codes.OK, 1, true},
+		{"Unavailable idempotent", up, true, codes.Unavailable, true, codes.Unavailable, 3, false},
+		{"Unavailable not idempotent", up, false, codes.Unavailable, true, codes.Unavailable, 1, false},
+		{"Deadline exceeded idempotent", up, true, codes.DeadlineExceeded, true, codes.DeadlineExceeded, 3, false},
+		{"Not found idempotent", up, true, codes.NotFound, true, codes.NotFound, 1, false},
+		{"Node down idempotent", down, true, codes.OK, true, codes.Unavailable, 0, false},
+		{"Node down not idempotent", down, false, codes.OK, true, codes.Unavailable, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer closeGRPCConns(nil)
+
+			calls := 0
+			handled, err := callGRPC(context.Background(), tt.node, quickPolicy(tt.idempotent), func(ctx context.Context, client rpc.InternalClient) error {
+				calls++
+				return status.Error(tt.code, "")
+			})
+			if handled != tt.wantHandled || status.Code(err) != tt.wantCode {
+				t.Errorf("Want: handled %v with %v Got: %v with %v", tt.wantHandled, tt.wantCode, handled, err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Want: %v calls Got: %v", tt.wantCalls, calls)
+			}
+			if useHTTP(tt.node) != tt.wantHTTP {
+				t.Errorf("Want: HTTP %v Got: %v", tt.wantHTTP, useHTTP(tt.node))
+			}
+		})
+	}
+}
+
+func TestCloseGRPCConns(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+
+	for _, node := range []string{"10.10.0.2:8080", "10.10.0.3:8080"} {
+		if _, err := grpcConn(node); err != nil {
+			t.Fatal(err)
+		}
+		fallBackToHTTP(node)
+	}
+
+	closeGRPCConns([]string{"10.10.0.2:8080"})
+	defer closeGRPCConns(nil)
+
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+	if _, exists := grpcConns["10.10.0.3:8080"]; exists || len(grpcConns) != 1 {
+		t.Errorf("Want: only 10.10.0.2:8080 connected Got: %v", grpcConns)
+	}
+	if _, exists := httpOnlyUntil["10.10.0.3:8080"]; exists || len(httpOnlyUntil) != 1 {
+		t.Errorf("Want: only 10.10.0.2:8080 using HTTP Got: %v", httpOnlyUntil)
+	}
+}
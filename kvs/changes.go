@@ -0,0 +1,58 @@
+package kvs
+
+import "time"
+
+//ChangeLogSize is the number of events kept in the change log. The oldest are dropped once it is full
+var ChangeLogSize = 100000
+
+//Events recorded on this node in order, and a channel closed when the next one is recorded
+var (
+	changeLog    []Event
+	lastSeq      uint64
+	changeSignal = make(chan struct{})
+)
+
+//Changes returns up to limit events recorded after the given sequence number along with the
+//sequence numbers of the oldest event kept and the last event recorded. Events after since were
+//dropped if it is below oldest - 1. The channel is closed once another event is recorded, so
+//callers can wait for changes
+func Changes(since uint64, limit int) ([]Event, uint64, uint64, <-chan struct{}) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	oldest := lastSeq + 1
+	if len(changeLog) > 0 {
+		oldest = changeLog[0].Seq
+	}
+
+	start := 0
+	if since >= oldest {
+		start = int(since - oldest + 1)
+	}
+	if start > len(changeLog) {
+		start = len(changeLog)
+	}
+
+	end := len(changeLog)
+	if end-start > limit {
+		end = start + limit
+	}
+	return append([]Event{}, changeLog[start:end]...), oldest, lastSeq, changeSignal
+}
+
+//Add an event to the change log and send it to subscribers. Caller must hold storeMutex
+func record(e Event) {
+	lastSeq++
+	e.Seq, e.Time = lastSeq, time.Now()
+
+	changeLog = append(changeLog, e)
+	if len(changeLog) > ChangeLogSize {
+		changeLog = changeLog[len(changeLog)-ChangeLogSize:]
+	}
+	close(changeSignal)
+	changeSignal = make(chan struct{})
+
+	if e.Type != EventMoveIn && e.Type != EventMoveOut {
+		notify(e)
+	}
+}
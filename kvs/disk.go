@@ -0,0 +1,757 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Disk engine settings. They must be set before the node joins a view
+var (
+	DataDir      = "data"      //Directory holding a subdirectory for each partition
+	MemtableSize = 1024 * 1024 //Bytes of keys and values a partition holds in memory before writing them to a segment
+)
+
+const (
+	maxSegments          = 4    //Segments of a partition before they are compacted into one
+	segmentIndexInterval = 4096 //Bytes of records between the keys of a segment kept in memory
+	maxRecordField       = 1 << 30
+	maxRecordHeader      = 3 * binary.MaxVarintLen64 //Bytes of the metadata of a record at most
+)
+
+//Kinds of records in a memtable or segment
+const (
+	recordValue   byte = 0
+	recordDeleted byte = 1
+)
+
+//Prefix of partition directories so other files in the data directory are left alone
+const partitionDirPrefix = "partition-"
+
+var errCorruptSegment = errors.New("Segment is corrupt")
+
+//DiskStore is a Store which writes keys to sorted immutable segment files once its memtable is full
+//so a partition can hold more data than fits in memory. Only the memtable and every few kilobytes
+//of keys of each segment are kept in memory. Segments are merged into one once there are too many.
+//I/O errors are logged, a failed write leaves keys in the memtable so it is tried again later
+type DiskStore struct {
+	dir          string
+	memtable     *SkipList //Values are prefixed with their record kind so deletes shadow older segments
+	memtableSize int
+	segments     []*segment //Newest first
+	length       int
+	nextSegment  int
+}
+
+//Sorted immutable file of records
+type segment struct {
+	path  string
+	index []indexEntry
+	live  int //Records which are not deletes
+}
+
+//Record of a key in a memtable or segment. The metadata of a key is written as a header before its value
+type diskRecord struct {
+	key   string
+	kind  byte
+	meta  Meta
+	value string
+}
+
+//Key of a record in a segment and its offset in the file
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+//SegmentTransfer is a segment file holding every key of a removed partition. It is sent whole to
+//the node owning the keys instead of pushing them one by one
+type SegmentTransfer struct {
+	Token Token
+	Path  string
+	store *DiskStore
+	moved []Event //Events of the keys moving out with the segment
+}
+
+//NewDiskStore returns an empty store keeping its segments in the given directory
+func NewDiskStore(dir string) *DiskStore {
+	return &DiskStore{dir: dir, memtable: NewSkipList()}
+}
+
+//InitDataDir creates the data directory and removes partitions left by a previous run. Nodes always
+//join a view with empty partitions so old segments are never read again
+func InitDataDir() error {
+	if err := os.MkdirAll(DataDir, 0755); err != nil {
+		return err
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(DataDir, partitionDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Get returns the value and metadata of a key
+func (s *DiskStore) Get(key string) (string, Meta, bool) {
+	if v, meta, exists := s.memtable.Get(key); exists {
+		return v[1:], meta, v[0] == recordValue
+	}
+
+	for _, seg := range s.segments {
+		r, found, err := seg.get(key)
+		if err != nil {
+			log.Println(err)
+			return "", Meta{}, false
+		} else if found {
+			return r.value, r.meta, r.kind == recordValue
+		}
+	}
+	return "", Meta{}, false
+}
+
+//Set sets the value and metadata of a key
+func (s *DiskStore) Set(key string, value string, meta Meta) {
+	if _, _, exists := s.Get(key); !exists {
+		s.length++
+	}
+	s.write(diskRecord{key: key, kind: recordValue, meta: meta, value: value})
+}
+
+//Delete deletes a key
+func (s *DiskStore) Delete(key string) {
+	if _, _, exists := s.Get(key); exists {
+		s.length--
+		s.write(diskRecord{key: key, kind: recordDeleted})
+	}
+}
+
+//Len returns the number of keys
+func (s *DiskStore) Len() int {
+	return s.length
+}
+
+//Ascend calls fn for each key from the first key not less than start in sorted order until fn returns false
+func (s *DiskStore) Ascend(start string, fn func(key string, value string, meta Meta) bool) {
+	sources := []records{&memtableRecords{next: s.memtable.seek(start, nil)}}
+	for _, seg := range s.segments {
+		r, err := seg.records(start)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sources = append(sources, r)
+	}
+
+	mergeRecords(sources, start, func(r diskRecord) bool {
+		return r.kind == recordDeleted || fn(r.key, r.value, r.meta)
+	})
+}
+
+//Drop removes the segments of the store
+func (s *DiskStore) Drop() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Println(err)
+	}
+}
+
+//Add a record to the memtable, writing it to a segment once it is full
+func (s *DiskStore) write(r diskRecord) {
+	s.memtable.Set(r.key, string(r.kind)+r.value, r.meta)
+	s.memtableSize += len(r.key) + len(r.value) + 1 + maxRecordHeader
+
+	if s.memtableSize >= MemtableSize {
+		if err := s.flush(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//Write the memtable to a new segment, compacting the segments if there are too many
+func (s *DiskStore) flush() error {
+	if s.memtable.Len() == 0 {
+		return nil
+	}
+
+	seg, err := s.writeSegment(func(write func(r diskRecord) error) error {
+		for n := s.memtable.head.next[0]; n != nil; n = n.next[0] {
+			if err := write(memtableRecord(n)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.segments = append([]*segment{seg}, s.segments...)
+	s.memtable, s.memtableSize = NewSkipList(), 0
+
+	if len(s.segments) > maxSegments {
+		return s.compact()
+	}
+	return nil
+}
+
+//Merge every segment into one, dropping deleted keys and shadowed values
+func (s *DiskStore) compact() error {
+	sources := make([]records, 0, len(s.segments))
+	for _, seg := range s.segments {
+		r, err := seg.records("")
+		if err != nil {
+			closeRecords(sources)
+			return err
+		}
+		sources = append(sources, r)
+	}
+
+	merged, err := s.writeSegment(func(write func(r diskRecord) error) error {
+		var err error
+		mergeRecords(sources, "", func(r diskRecord) bool {
+			if r.kind == recordValue {
+				err = write(r)
+			}
+			return err == nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range s.segments {
+		if err := os.Remove(seg.path); err != nil {
+			log.Println(err)
+		}
+	}
+	s.segments = []*segment{merged}
+	return nil
+}
+
+//Write records given in key order to a new segment in the store's directory
+func (s *DiskStore) writeSegment(records func(write func(r diskRecord) error) error) (*segment, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%06d.seg", s.nextSegment))
+	s.nextSegment++
+
+	seg, err := writeSegmentFile(path, records)
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return seg, err
+}
+
+//Write records given in key order to a segment file, building its index as it is written
+func writeSegmentFile(path string, records func(write func(r diskRecord) error) error) (*segment, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	seg := &segment{path: path}
+	var offset, indexed int64
+	buf := make([]byte, maxRecordHeader)
+
+	err = records(func(r diskRecord) error {
+		if len(seg.index) == 0 || offset-indexed >= segmentIndexInterval {
+			seg.index = append(seg.index, indexEntry{key: r.key, offset: offset})
+			indexed = offset
+		}
+		if r.kind == recordValue {
+			seg.live++
+		}
+
+		n := binary.PutUvarint(buf, uint64(len(r.key)))
+		w.Write(buf[:n])
+		w.WriteString(r.key)
+		w.WriteByte(r.kind)
+		h := putRecordHeader(buf, r.meta)
+		w.Write(buf[:h])
+		m := binary.PutUvarint(buf, uint64(len(r.value)))
+		w.Write(buf[:m])
+		_, err := w.WriteString(r.value)
+
+		offset += int64(n + len(r.key) + 1 + h + m + len(r.value))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if err := w.Flush(); err != nil {
+		return nil, err
+	} else if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return seg, os.Rename(path+".tmp", path)
+}
+
+//Write the flags, expiry and revision of a record to buf. Returns the number of bytes written
+func putRecordHeader(buf []byte, meta Meta) int {
+	var expires int64
+	if !meta.Expires.IsZero() {
+		expires = meta.Expires.UnixNano()
+	}
+
+	n := binary.PutUvarint(buf, uint64(meta.Flags))
+	n += binary.PutUvarint(buf[n:], uint64(expires))
+	return n + binary.PutUvarint(buf[n:], meta.Revision)
+}
+
+//Read the index of an existing segment file, checking that it can be decoded
+func openSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &segment{path: path}
+	r := &segmentRecords{f: f, reader: bufio.NewReader(f)}
+	var indexed int64
+	last := ""
+	for {
+		offset := r.offset
+		rec, err := r.read()
+		if err == io.EOF {
+			return seg, nil
+		} else if err != nil {
+			return nil, err
+		} else if (offset > 0 && rec.key <= last) || rec.kind > recordDeleted {
+			return nil, errCorruptSegment
+		}
+
+		if len(seg.index) == 0 || offset-indexed >= segmentIndexInterval {
+			seg.index = append(seg.index, indexEntry{key: rec.key, offset: offset})
+			indexed = offset
+		}
+		if rec.kind == recordValue {
+			seg.live++
+		}
+		last = rec.key
+	}
+}
+
+//Find a key in the segment by reading from the last indexed key before it
+func (seg *segment) get(key string) (diskRecord, bool, error) {
+	r, err := seg.records(key)
+	if err != nil {
+		return diskRecord{}, false, err
+	}
+	defer r.close()
+
+	for {
+		rec, err := r.read()
+		if err == io.EOF || (err == nil && rec.key > key) {
+			return diskRecord{}, false, nil
+		} else if err != nil {
+			return diskRecord{}, false, fmt.Errorf("Reading %s: %v", seg.path, err)
+		} else if rec.key == key {
+			return rec, true, nil
+		}
+	}
+}
+
+//Open the segment for reading from the last indexed key not greater than start
+func (seg *segment) records(start string) (*segmentRecords, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].key > start })
+	if i > 0 {
+		if _, err := f.Seek(seg.index[i-1].offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &segmentRecords{f: f, reader: bufio.NewReader(f)}, nil
+}
+
+//Records of a memtable or segment in key order
+type records interface {
+	//Returns io.EOF after the last record
+	read() (diskRecord, error)
+	close()
+}
+
+type memtableRecords struct {
+	next *skipNode
+}
+
+func (r *memtableRecords) read() (diskRecord, error) {
+	n := r.next
+	if n == nil {
+		return diskRecord{}, io.EOF
+	}
+	r.next = n.next[0]
+	return memtableRecord(n), nil
+}
+
+//Record held by a node of a memtable
+func memtableRecord(n *skipNode) diskRecord {
+	return diskRecord{key: n.key, kind: n.value[0], meta: n.meta, value: n.value[1:]}
+}
+
+func (r *memtableRecords) close() {}
+
+type segmentRecords struct {
+	f      *os.File
+	reader *bufio.Reader
+	offset int64 //Offset of the next record relative to where reading started
+}
+
+func (r *segmentRecords) read() (diskRecord, error) {
+	key, err := r.readField()
+	if err != nil {
+		//The file may only end before the start of a record
+		return diskRecord{}, err
+	}
+
+	kind, err := r.reader.ReadByte()
+	if err != nil {
+		return diskRecord{}, io.ErrUnexpectedEOF
+	}
+	r.offset++
+
+	meta, err := r.readHeader()
+	if err != nil {
+		return diskRecord{}, err
+	}
+
+	value, err := r.readField()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return diskRecord{key: key, kind: kind, meta: meta, value: value}, err
+}
+
+//Read the flags, expiry and revision of a record
+func (r *segmentRecords) readHeader() (Meta, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, err := binary.ReadUvarint(r.reader)
+		if err == io.EOF {
+			return Meta{}, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return Meta{}, err
+		}
+		fields[i] = v
+		r.offset += int64(uvarintSize(v))
+	}
+
+	meta := Meta{Flags: uint32(fields[0]), Revision: fields[2]}
+	if fields[0] > math.MaxUint32 {
+		return Meta{}, errCorruptSegment
+	} else if fields[1] != 0 {
+		meta.Expires = time.Unix(0, int64(fields[1]))
+	}
+	return meta, nil
+}
+
+//Read a length prefixed string. Returns io.EOF if the reader is at the end of the file
+func (r *segmentRecords) readField() (string, error) {
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return "", err
+	} else if size > maxRecordField {
+		return "", errCorruptSegment
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	r.offset += int64(uvarintSize(size)) + int64(size)
+	return string(b), nil
+}
+
+func (r *segmentRecords) close() {
+	r.f.Close()
+}
+
+func uvarintSize(v uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, v)
+}
+
+func closeRecords(sources []records) {
+	for _, r := range sources {
+		r.close()
+	}
+}
+
+//Merge records from sources ordered newest first, calling fn with the newest record of each key
+//not less than start until fn returns false. Sources are closed once merged
+func mergeRecords(sources []records, start string, fn func(r diskRecord) bool) {
+	defer closeRecords(sources)
+
+	type head struct {
+		diskRecord
+		ok bool
+	}
+	heads := make([]head, len(sources))
+
+	advance := func(i int) {
+		for {
+			r, err := sources[i].read()
+			if err != nil {
+				if err != io.EOF {
+					log.Println(err)
+				}
+				heads[i] = head{}
+				return
+			} else if r.key >= start {
+				heads[i] = head{diskRecord: r, ok: true}
+				return
+			}
+		}
+	}
+	for i := range sources {
+		advance(i)
+	}
+
+	for {
+		//Ties go to the newest source since it comes first
+		min := -1
+		for i, h := range heads {
+			if h.ok && (min == -1 || h.key < heads[min].key) {
+				min = i
+			}
+		}
+		if min == -1 {
+			return
+		}
+
+		h := heads[min]
+		for i := range heads {
+			if heads[i].ok && heads[i].key == h.key {
+				advance(i)
+			}
+		}
+		if !fn(h.diskRecord) {
+			return
+		}
+	}
+}
+
+//Write every key to a single segment and return its path, or an empty path if there are no keys
+func (s *DiskStore) detach() (string, error) {
+	if err := s.flush(); err != nil {
+		return "", err
+	} else if len(s.segments) == 0 {
+		return "", nil
+	}
+
+	if err := s.compact(); err != nil {
+		return "", err
+	}
+	return s.segments[0].path, nil
+}
+
+//Add a segment file received from another node as the newest segment so its keys replace existing
+//ones. Returns the records of the keys added without their values
+func (s *DiskStore) addSegment(path string) ([]diskRecord, error) {
+	if err := s.flush(); err != nil {
+		return nil, err
+	} else if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	dest := filepath.Join(s.dir, fmt.Sprintf("%06d.seg", s.nextSegment))
+	s.nextSegment++
+	if err := moveFile(path, dest); err != nil {
+		return nil, err
+	}
+
+	seg, err := openSegment(dest)
+	if err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+
+	added := []diskRecord{}
+	r, err := seg.records("")
+	if err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+	mergeRecords([]records{r}, "", func(rec diskRecord) bool {
+		if rec.kind == recordValue {
+			if _, _, exists := s.Get(rec.key); !exists {
+				s.length++
+			}
+			rec.value = ""
+			added = append(added, rec)
+		}
+		return true
+	})
+
+	s.segments = append([]*segment{seg}, s.segments...)
+	if len(s.segments) > maxSegments {
+		return added, s.compact()
+	}
+	return added, nil
+}
+
+//Rename a file, copying it if it is on another file system
+func moveFile(src string, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	} else if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+//ReadSegment reads every key of a segment file and its metadata into memory, used when the receiving
+//node does not accept segment files
+func ReadSegment(path string) (*Shard, error) {
+	seg, err := openSegment(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := seg.records("")
+	if err != nil {
+		return nil, err
+	}
+
+	shard := NewShard()
+	mergeRecords([]records{r}, "", func(rec diskRecord) bool {
+		if rec.kind == recordValue {
+			shard.Add(rec.key, rec.value, rec.meta)
+		}
+		return true
+	})
+	return shard, nil
+}
+
+//IngestSegment adds the keys of a segment file received from another node to a local partition. Keys
+//keep the revisions and other metadata held by the segment like keys pushed by a reshard. The file
+//is moved into the partition or removed
+func IngestSegment(token uint64, path string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	partition, exists := MyKVS[token]
+	if !exists {
+		os.Remove(path)
+		return ErrPartitionNotFound
+	}
+
+	if disk, ok := partition.(*DiskStore); ok {
+		added, err := disk.addSegment(path)
+		for _, r := range added {
+			movedRevision(r.meta.Revision)
+			trackExpiry(token, r.key, r.meta)
+			record(Event{Type: EventMoveIn, Key: r.key, Revision: r.meta.Revision, Expires: r.meta.Expires})
+		}
+		return err
+	}
+
+	shard, err := ReadSegment(path)
+	os.Remove(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	shard.Each(func(k string, v string, meta Meta) {
+		moveIn(token, partition, k, v, meta, now)
+	})
+	return nil
+}
+
+//Remove deletes the segment once it has been sent
+func (t SegmentTransfer) Remove() {
+	t.store.Drop()
+}
+
+//Check if every key of a removed partition moves to the same token so the partition can be sent as
+//a single segment, deleting expired keys first. Caller must hold storeMutex
+func (s *DiskStore) transfer(v *View, now time.Time) (SegmentTransfer, bool) {
+	var token Token
+	whole := true
+	expired := []string{}
+	moved := []Event{}
+	first := true
+
+	s.Ascend("", func(key string, value string, meta Meta) bool {
+		if meta.expired(now) {
+			expired = append(expired, key)
+			return true
+		}
+
+		moved = append(moved, Event{Type: EventMoveOut, Key: key, Revision: meta.Revision})
+		t := v.FindToken(key)
+		if first {
+			token, first = t, false
+		} else if t != token {
+			whole = false
+		}
+		return whole
+	})
+	if !whole || first {
+		return SegmentTransfer{}, false
+	}
+
+	for _, key := range expired {
+		s.Delete(key)
+		record(Event{Type: EventExpire, Key: key, Revision: nextRevision()})
+	}
+
+	path, err := s.detach()
+	if err != nil || path == "" {
+		if err != nil {
+			log.Println(err)
+		}
+		return SegmentTransfer{}, false
+	}
+	return SegmentTransfer{Token: token, Path: path, store: s, moved: moved}, true
+}
+
+//Remove the files of a partition store if it has any
+func dropStore(s Store) {
+	if d, ok := s.(interface{ Drop() }); ok {
+		d.Drop()
+	}
+}
+
+//Directory of a partition of the disk engine
+func partitionDir(token uint64) string {
+	return filepath.Join(DataDir, partitionDirPrefix+strconv.FormatUint(token, 10))
+}
@@ -2,30 +2,100 @@ package kvs
 
 import (
 	"crypto/md5"
-	"errors"
+	"math"
 	"math/big"
 	"math/rand"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 //KVS is a string:string key value store
 type KVS map[string]string
 
-//PartitionedKVS is a string:string kvs divided into a map of partitions
-type PartitionedKVS map[uint64]KVS
+//PartitionedKVS is a string:string kvs divided into a map of partition stores
+type PartitionedKVS map[uint64]Store
+
+//Shard is the keys of a partition pushed to another node during a reshard
+type Shard struct {
+	Keys      KVS               `json:"keys"`
+	Binary    map[string][]byte `json:"binary,omitempty"`  //Values which are not valid UTF-8, sent as base64
+	Expires   map[string]int64  `json:"expires,omitempty"` //Unix nanoseconds of keys which expire
+	Revisions map[string]uint64 `json:"revisions,omitempty"`
+	Flags     map[string]uint32 `json:"flags,omitempty"` //Keys with flags set by memcached clients
+}
+
+//NewShard returns an empty shard
+func NewShard() *Shard {
+	return &Shard{Keys: make(KVS), Revisions: make(map[string]uint64)}
+}
+
+//Add a key to the shard with its metadata. Values which are not valid UTF-8 are kept apart from the
+//other keys since json would replace their invalid bytes
+func (s *Shard) Add(key string, value string, meta Meta) {
+	if utf8.ValidString(value) {
+		s.Keys[key] = value
+	} else {
+		if s.Binary == nil {
+			s.Binary = make(map[string][]byte)
+		}
+		s.Binary[key] = []byte(value)
+	}
+
+	s.Revisions[key] = meta.Revision
+	if !meta.Expires.IsZero() {
+		if s.Expires == nil {
+			s.Expires = make(map[string]int64)
+		}
+		s.Expires[key] = meta.Expires.UnixNano()
+	}
+	if meta.Flags != 0 {
+		if s.Flags == nil {
+			s.Flags = make(map[string]uint32)
+		}
+		s.Flags[key] = meta.Flags
+	}
+}
+
+//Len returns the number of keys in the shard
+func (s *Shard) Len() int {
+	return len(s.Keys) + len(s.Binary)
+}
+
+//Each calls f with every key of the shard and its value and metadata
+func (s *Shard) Each(f func(key string, value string, meta Meta)) {
+	meta := func(key string) Meta {
+		m := Meta{Flags: s.Flags[key], Revision: s.Revisions[key]}
+		if expires, ok := s.Expires[key]; ok {
+			m.Expires = time.Unix(0, expires)
+		}
+		return m
+	}
+
+	for k, v := range s.Keys {
+		f(k, v, meta(k))
+	}
+	for k, v := range s.Binary {
+		f(k, string(v), meta(k))
+	}
+}
 
 //RemappedKVS is a PartitionedKVS mapped to different nodes and with the tokens converted to strings
-type RemappedKVS map[string]map[string]KVS
+type RemappedKVS map[string]map[string]*Shard
 
-//MyKVS maps token values to k:v maps
+//MyKVS maps token values to the stores of their partitions
 var MyKVS = PartitionedKVS{}
 
-//Global constants for kvs
-const (
-	NumTokens = 200
-	MaxHash   = 1000000
+//Guards MyKVS since keys are accessed by concurrent requests
+var storeMutex = &sync.Mutex{}
+
+//Ring settings for kvs. They must be the same on every node in the system
+var (
+	NumTokens        = 200     //Tokens generated for each added node
+	MaxHash   uint64 = 1000000 //Size of the hash space
 )
 
 //Token contains an ip address and value in has space
@@ -38,6 +108,7 @@ type Token struct {
 type View struct {
 	Nodes  []string `json:"nodes"`
 	Tokens []Token  `json:"tokens"`
+	Epoch  uint64   `json:"epoch"` //Increased by every view change
 }
 
 //Change is the changes to a single node during a view change
@@ -48,57 +119,105 @@ type Change struct {
 
 //Get returns the value given the key and token
 func Get(token uint64, key string) (string, bool) {
-	value, exists := MyKVS[token][key]
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	value, _, exists := getItem(token, key, time.Now())
 	return value, exists
 }
 
-//Set sets the key and value at the given token. Returns if updated or error
-func Set(token uint64, key string, value string) (bool, error) {
-	if partition, exists := MyKVS[token]; exists {
-		_, updated := partition[key]
-		partition[key] = value
-		return updated, nil
+//Set sets the key and value at the given token if the condition holds. The key expires at the given
+//time unless it is zero. Returns if updated and the new revision or error
+func Set(token uint64, key string, value string, expires time.Time, cond Condition) (bool, uint64, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if _, exists := MyKVS[token]; !exists {
+		return false, 0, ErrPartitionNotFound
+	} else if err := checkLock(key); err != nil {
+		return false, 0, err
+	}
+
+	_, meta, updated := getItem(token, key, time.Now())
+	if cond != nil {
+		if err := cond(updated, meta); err != nil {
+			return updated, meta.Revision, err
+		}
 	}
-	return false, errors.New("Partition does not exist")
+
+	meta, err := setItem(token, key, value, Meta{Expires: expires})
+	return updated, meta.Revision, err
 }
 
 //Delete deletes the key in the given token
 func Delete(token uint64, key string) error {
-	_, exists := MyKVS[token][key]
-	if exists {
-		delete(MyKVS[token], key)
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if err := checkLock(key); err != nil {
+		return err
+	} else if _, _, exists := getItem(token, key, time.Now()); exists {
+		removeItem(MyKVS[token], key, EventDelete)
 		return nil
 	}
-	return errors.New("Key does not exist")
+	return ErrNotFound
 }
 
 //KeyCount returns the current key count of the KVS
 func KeyCount() int {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
 	keyCount := 0
-	for _, token := range MyKVS {
-		keyCount += len(token)
+	for _, partition := range MyKVS {
+		keyCount += partition.Len()
 	}
 	return keyCount
 }
 
-//PushKeys tries to update the KVS with the new keys. Returns error if issue
-func PushKeys(newKeys map[string]KVS) error {
+//PushKeys tries to update the KVS with the new keys. Keys which expired while being moved are dropped.
+//Returns error if issue
+func PushKeys(newKeys map[string]*Shard) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	now := time.Now()
 	for name, shard := range newKeys {
 		key, _ := strconv.ParseUint(name, 10, 64)
 		if partition, exists := MyKVS[key]; exists {
-			for k, v := range shard {
-				partition[k] = v
+			if shard == nil {
+				continue
 			}
+
+			shard.Each(func(k string, v string, meta Meta) {
+				moveIn(key, partition, k, v, meta, now)
+			})
 		} else {
-			return errors.New("Partition does not exist")
+			return ErrPartitionNotFound
 		}
 	}
 	return nil
 }
 
+//Add a key moved from another node to a partition keeping its revision, unless it expired while
+//being moved. Caller must hold storeMutex
+func moveIn(token uint64, partition Store, key string, value string, meta Meta, now time.Time) {
+	meta.Revision = movedRevision(meta.Revision)
+	if meta.expired(now) {
+		return
+	}
+	partition.Set(key, value, meta)
+	trackExpiry(token, key, meta)
+	record(Event{Type: EventMoveIn, Key: key, Revision: meta.Revision, Expires: meta.Expires})
+}
+
 //FindToken returns the token corresponding to a given key
 func (v *View) FindToken(key string) Token {
-	hash := generateHash(key)
+	return v.TokenForHash(generateHash(key))
+}
+
+//TokenForHash returns the token owning a position in the hash space
+func (v *View) TokenForHash(hash uint64) Token {
 	index := sort.Search(len(v.Tokens), func(i int) bool { return v.Tokens[i].Value >= hash })
 	tokenIndex := index - 1
 
@@ -111,6 +230,228 @@ func (v *View) FindToken(key string) Token {
 	return v.Tokens[tokenIndex]
 }
 
+//Keys returns the sorted keys stored in the local partition of a token
+func Keys(token uint64) []string {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	partition, exists := MyKVS[token]
+	if !exists {
+		return []string{}
+	}
+
+	now := time.Now()
+	keys := make([]string, 0, partition.Len())
+	partition.Ascend("", func(key string, value string, meta Meta) bool {
+		if !meta.expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+//Scan returns up to limit sorted keys from every local partition which have the prefix and sort
+//after the given key
+func Scan(prefix string, after string, limit int) []string {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	//Start from the prefix or the first key after the given key, whichever is later
+	start := prefix
+	if after != "" && after+"\x00" > start {
+		start = after + "\x00"
+	}
+
+	//Each partition contributes at most limit keys, which ordered stores find without visiting other keys
+	now := time.Now()
+	keys := []string{}
+	for _, partition := range MyKVS {
+		found := 0
+		partition.Ascend(start, func(key string, value string, meta Meta) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			} else if !meta.expired(now) {
+				keys = append(keys, key)
+				found++
+			}
+			return found < limit
+		})
+	}
+
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+//CountPrefix returns the number of keys starting with prefix stored on this node
+func CountPrefix(prefix string) int {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, partition := range MyKVS {
+		partition.Ascend(prefix, func(key string, value string, meta Meta) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			} else if !meta.expired(now) {
+				count++
+			}
+			return true
+		})
+	}
+	return count
+}
+
+//DeletePrefix deletes every key starting with prefix stored on this node. Keys locked by a prepared
+//transaction are left in place. Returns the number of keys deleted and the number left locked
+func DeletePrefix(prefix string) (deleted int, locked int) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	now := time.Now()
+	for _, partition := range MyKVS {
+		//Stores cannot be changed while they are being iterated
+		var keys []string
+		expired := make(map[string]bool)
+		partition.Ascend(prefix, func(key string, value string, meta Meta) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			keys = append(keys, key)
+			if meta.expired(now) {
+				expired[key] = true
+			}
+			return true
+		})
+
+		for _, key := range keys {
+			if checkLock(key) != nil {
+				locked++
+			} else if expired[key] {
+				removeItem(partition, key, EventExpire)
+			} else {
+				removeItem(partition, key, EventDelete)
+				deleted++
+			}
+		}
+	}
+	return deleted, locked
+}
+
+//TokenKeyCounts returns the number of keys stored in each local partition
+func TokenKeyCounts() map[uint64]int {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	counts := make(map[uint64]int, len(MyKVS))
+	for token, partition := range MyKVS {
+		counts[token] = partition.Len()
+	}
+	return counts
+}
+
+//Copy returns a deep copy of the view which can be changed without affecting the original
+func (v *View) Copy() View {
+	c := View{Nodes: make([]string, len(v.Nodes)), Tokens: make([]Token, len(v.Tokens)), Epoch: v.Epoch}
+	copy(c.Nodes, v.Nodes)
+	copy(c.Tokens, v.Tokens)
+	return c
+}
+
+//TokenOwnership returns the fraction of the hash space owned by each token in the same order as v.Tokens
+func (v *View) TokenOwnership() []float64 {
+	ownership := make([]float64, len(v.Tokens))
+	for i := range v.Tokens {
+		ownership[i] = float64(v.tokenSpan(i)) / float64(MaxHash)
+	}
+	return ownership
+}
+
+//NodeOwnership returns the fraction of the hash space owned by each node in the view
+func (v *View) NodeOwnership() map[string]float64 {
+	ownership := make(map[string]float64, len(v.Nodes))
+	for _, node := range v.Nodes {
+		ownership[node] = 0
+	}
+
+	for i, fraction := range v.TokenOwnership() {
+		ownership[v.Tokens[i].Endpoint] += fraction
+	}
+	return ownership
+}
+
+//OwnershipStdDev returns the standard deviation of the fraction of the hash space owned by each node
+func (v *View) OwnershipStdDev() float64 {
+	ownership := v.NodeOwnership()
+	if len(ownership) == 0 {
+		return 0
+	}
+
+	mean := 0.0
+	for _, fraction := range ownership {
+		mean += fraction
+	}
+	mean /= float64(len(ownership))
+
+	variance := 0.0
+	for _, fraction := range ownership {
+		variance += (fraction - mean) * (fraction - mean)
+	}
+	return math.Sqrt(variance / float64(len(ownership)))
+}
+
+//EstimateKeysMoved estimates how many keys would be resharded when changing from v to next given key counts per token.
+//Keys are assumed to be evenly distributed within each token's range
+func (v *View) EstimateKeysMoved(next *View, counts map[uint64]int) int {
+	nodes := make(map[string]bool, len(next.Nodes))
+	for _, node := range next.Nodes {
+		nodes[node] = true
+	}
+
+	moved := 0.0
+	for i, t := range v.Tokens {
+		count := counts[t.Value]
+		if count == 0 {
+			continue
+		}
+
+		if !nodes[t.Endpoint] {
+			//All keys of a removed token move
+			moved += float64(count)
+			continue
+		}
+
+		//Keys past the first new token after t move to that token
+		span := v.tokenSpan(i)
+		index := sort.Search(len(next.Tokens), func(j int) bool { return next.Tokens[j].Value > t.Value })
+		if index == len(next.Tokens) {
+			index = 0
+		}
+
+		retained := span
+		if len(next.Tokens) > 1 {
+			if d := distance(t.Value, next.Tokens[index].Value); d < retained {
+				retained = d
+			}
+		}
+		moved += float64(count) * float64(span-retained) / float64(span)
+	}
+
+	return int(math.Round(moved))
+}
+
+//Size of the range of the hash space owned by the token at index i
+func (v *View) tokenSpan(i int) uint64 {
+	if len(v.Tokens) == 1 {
+		return MaxHash
+	}
+	return distance(v.Tokens[i].Value, v.Tokens[(i+1)%len(v.Tokens)].Value)
+}
+
 //ChangeView changes view struct given new state of active nodes. Returns map of changes and map of new nodes
 func (v *View) ChangeView(nodes []string) (map[string]*Change, map[string]bool) {
 	addedNodes, removedNodes := v.calcNodeDiff(nodes)
@@ -125,39 +466,86 @@ func (v *View) ChangeView(nodes []string) (map[string]*Change, map[string]bool)
 
 	v.Nodes = nodes
 	v.Tokens = tokens
+	v.Epoch++
 	return changes, addedNodes
 }
 
-//Reshard key value pairs
-func (v *View) Reshard(change Change) RemappedKVS {
+//Reshard key value pairs. Removed partitions of the disk engine whose keys all move to one token
+//are returned as segment transfers instead of being read into memory
+func (v *View) Reshard(change Change) (RemappedKVS, []SegmentTransfer) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	//Expiry, flags and revisions move with keys. Expired keys are dropped
+	now := time.Now()
 	res := make(RemappedKVS)
+	transfers := []SegmentTransfer{}
 
 	if change.Removed { //case 1: node is removed
 		for vNode, storage := range MyKVS {
-			for key, value := range storage {
-				newToken := v.FindToken(key)
-				res.addKeyValue(key, value, newToken)
+			if disk, ok := storage.(*DiskStore); ok {
+				if t, ok := disk.transfer(v, now); ok {
+					for _, e := range t.moved {
+						record(e)
+					}
+					transfers = append(transfers, t)
+					delete(MyKVS, vNode)
+					continue
+				}
 			}
+
+			storage.Ascend("", func(key string, value string, meta Meta) bool {
+				if !meta.expired(now) {
+					res.addKeyValue(key, value, meta, v.FindToken(key))
+					record(Event{Type: EventMoveOut, Key: key, Revision: meta.Revision})
+				} else {
+					record(Event{Type: EventExpire, Key: key, Revision: nextRevision()})
+				}
+				return true
+			})
+			dropStore(storage)
 			delete(MyKVS, vNode)
 		}
+		expiring = make(map[string]uint64)
 	} else if len(MyKVS) == 0 { //case 2: node was just added
 		for _, token := range change.Tokens {
-			MyKVS[token] = make(KVS)
+			MyKVS[token] = NewStore(token)
 		}
 	} else { //case 3: existing node needs to repartition
 		for _, changedToken := range change.Tokens {
-			for key, value := range MyKVS[changedToken] {
+			partition, exists := MyKVS[changedToken]
+			if !exists {
+				continue
+			}
+
+			moved := []string{}
+			metas := make(map[string]Meta)
+			partition.Ascend("", func(key string, value string, meta Meta) bool {
 				newToken := v.FindToken(key)
 				//Reshard key only if partition has changed
 				if newToken.Value != changedToken {
-					res.addKeyValue(key, value, newToken)
-					delete(MyKVS[changedToken], key)
+					if !meta.expired(now) {
+						res.addKeyValue(key, value, meta, newToken)
+					}
+					moved = append(moved, key)
+					metas[key] = meta
+				}
+				return true
+			})
+
+			//Stores cannot be changed while iterating over them
+			for _, key := range moved {
+				if meta := metas[key]; !meta.expired(now) {
+					deleteItem(partition, key)
+					record(Event{Type: EventMoveOut, Key: key, Revision: meta.Revision})
+				} else {
+					removeItem(partition, key, EventExpire)
 				}
 			}
 		}
 	}
 
-	return res
+	return res, transfers
 }
 
 //Calculate the added and removed nodes as differences between the view and a given node list
@@ -185,7 +573,14 @@ func (v *View) calcNodeDiff(nodes []string) (map[string]bool, map[string]bool) {
 }
 
 func (v *View) mergeTokens(addedTokens []Token, addedNodes map[string]bool, removedNodes map[string]bool) ([]Token, map[string]*Change, bool) {
-	newLength := len(v.Tokens) + len(addedTokens) - (len(removedNodes) * NumTokens)
+	removedTokens := 0
+	for _, t := range v.Tokens {
+		if removedNodes[t.Endpoint] {
+			removedTokens++
+		}
+	}
+
+	newLength := len(v.Tokens) + len(addedTokens) - removedTokens
 	changes := make(map[string]*Change)
 	tokens := make([]Token, newLength)
 
@@ -294,24 +689,58 @@ func generateTokens(addedNodes map[string]bool) []Token {
 
 //genereate the position of a key in the hash space
 func generateHash(key string) uint64 {
-	hash := md5.Sum([]byte(key))
+	return Hash(key, MaxHash)
+}
+
+//Hash returns the position of a key in a hash space of the given size. Only the hash tag of a key
+//is hashed
+func Hash(key string, maxHash uint64) uint64 {
+	hash := md5.Sum([]byte(HashTag(key)))
 	bigInt := new(big.Int).SetBytes(hash[8:])
-	return bigInt.Uint64() % MaxHash
+	return bigInt.Uint64() % maxHash
+}
+
+//HashTag returns the part of a key which decides its position in the hash space. Like Redis Cluster,
+//if a key has a { followed later by a } with at least one character between them only those
+//characters are hashed, so keys with the same tag such as {user42}:profile and {user42}:cart are
+//always stored under the same token. Otherwise the whole key is hashed. Keys starting with a
+//namespace between two 0 bytes hash the namespace along with their tag, so keys with the same tag
+//are only kept together within a namespace
+func HashTag(key string) string {
+	ns, rest := "", key
+	if strings.HasPrefix(key, "\x00") {
+		if end := strings.IndexByte(key[1:], 0); end >= 0 {
+			ns, rest = key[:end+2], key[end+2:]
+		}
+	}
+
+	if start := strings.IndexByte(rest, '{'); start >= 0 {
+		if end := strings.IndexByte(rest[start+1:], '}'); end > 0 {
+			return ns + rest[start+1:start+1+end]
+		}
+	}
+	return key
+}
+
+//Distance travelling forwards around the hash space from a to b
+func distance(a uint64, b uint64) uint64 {
+	return (b + MaxHash - a) % MaxHash
 }
 
-func (res RemappedKVS) addKeyValue(key string, value string, goalNode Token) {
+func (res RemappedKVS) addKeyValue(key string, value string, meta Meta, goalNode Token) {
 	node := goalNode.Endpoint
 	partition := strconv.FormatUint(goalNode.Value, 10)
 
 	//first check if goalNode's endpoint in res
 	if _, exists := res[node]; !exists {
-		res[node] = make(map[string]KVS)
+		res[node] = make(map[string]*Shard)
 	}
 
 	//then check if partition in node remapping
-	if _, exists := res[node][partition]; !exists {
-		res[node][partition] = make(KVS)
+	shard, exists := res[node][partition]
+	if !exists {
+		shard = NewShard()
+		res[node][partition] = shard
 	}
-
-	res[node][partition][key] = value
+	shard.Add(key, value, meta)
 }
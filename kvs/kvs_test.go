@@ -1,10 +1,30 @@
 package kvs
 
 import (
+	"encoding/json"
+	"math"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+//Partitions of map stores holding the given values and the metadata of any of their keys
+func partitions(values map[uint64]KVS, meta map[string]Meta) PartitionedKVS {
+	p := make(PartitionedKVS, len(values))
+	for token, keys := range values {
+		store := make(mapStore, len(keys))
+		for key, value := range keys {
+			store.Set(key, value, meta[key])
+		}
+		p[token] = store
+	}
+	return p
+}
+
 func TestCalcNodeDiff(t *testing.T) {
 	var tests = []struct {
 		name    string
@@ -206,10 +226,9 @@ func TestMergeTokens(t *testing.T) {
 
 func TestFindToken(t *testing.T) {
 	// this test uses the following config
-	// const (
-	// 	NumTokens = 2
-	// 	MaxHash   = 10000
-	// )
+	defer func(numTokens int, maxHash uint64) { NumTokens, MaxHash = numTokens, maxHash }(NumTokens, MaxHash)
+	NumTokens, MaxHash = 2, 10000
+
 	var tests = []struct {
 		name           string
 		view           View
@@ -283,3 +302,802 @@ func TestFindToken(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeOwnership(t *testing.T) {
+	var tests = []struct {
+		name      string
+		v         View
+		ownership map[string]float64
+		stdDev    float64
+	}{
+		{"Empty", View{}, map[string]float64{}, 0},
+		{"Single token", View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: 500}}}, map[string]float64{"1": 1}, 0},
+		{"Balanced",
+			View{Nodes: []string{"1", "2"}, Tokens: []Token{
+				{Endpoint: "1", Value: 0},
+				{Endpoint: "2", Value: MaxHash / 4},
+				{Endpoint: "1", Value: MaxHash / 2},
+				{Endpoint: "2", Value: MaxHash / 4 * 3},
+			}},
+			map[string]float64{"1": 0.5, "2": 0.5},
+			0,
+		},
+		{"Unbalanced with wraparound",
+			View{Nodes: []string{"1", "2", "3"}, Tokens: []Token{
+				{Endpoint: "1", Value: MaxHash / 4},
+				{Endpoint: "2", Value: MaxHash / 2},
+			}},
+			map[string]float64{"1": 0.25, "2": 0.75, "3": 0},
+			math.Sqrt((1.0/144 + 25.0/144 + 16.0/144) / 3),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ownership := tt.v.NodeOwnership()
+			if !reflect.DeepEqual(tt.ownership, ownership) {
+				t.Errorf("Want: %v Got: %v", tt.ownership, ownership)
+			}
+
+			if stdDev := tt.v.OwnershipStdDev(); stdDev != tt.stdDev {
+				t.Errorf("Want: %v Got: %v", tt.stdDev, stdDev)
+			}
+		})
+	}
+}
+
+func TestEstimateKeysMoved(t *testing.T) {
+	var tests = []struct {
+		name   string
+		v      View
+		next   View
+		counts map[uint64]int
+		moved  int
+	}{
+		{"No change",
+			View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: 0}, {Endpoint: "1", Value: MaxHash / 2}}},
+			View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: 0}, {Endpoint: "1", Value: MaxHash / 2}}},
+			map[uint64]int{0: 10, MaxHash / 2: 10},
+			0,
+		},
+		{"Node removed",
+			View{Nodes: []string{"1", "2"}, Tokens: []Token{{Endpoint: "1", Value: 0}, {Endpoint: "2", Value: MaxHash / 2}}},
+			View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: 0}}},
+			map[uint64]int{0: 10, MaxHash / 2: 30},
+			30,
+		},
+		{"Node added splitting token",
+			View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: 0}, {Endpoint: "1", Value: MaxHash / 2}}},
+			View{Nodes: []string{"1", "2"}, Tokens: []Token{
+				{Endpoint: "1", Value: 0},
+				{Endpoint: "2", Value: MaxHash / 4},
+				{Endpoint: "1", Value: MaxHash / 2},
+			}},
+			map[uint64]int{0: 10, MaxHash / 2: 10},
+			5,
+		},
+		{"Node added before first token",
+			View{Nodes: []string{"1"}, Tokens: []Token{{Endpoint: "1", Value: MaxHash / 2}}},
+			View{Nodes: []string{"1", "2"}, Tokens: []Token{
+				{Endpoint: "2", Value: 0},
+				{Endpoint: "1", Value: MaxHash / 2},
+			}},
+			map[uint64]int{MaxHash / 2: 20},
+			10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if moved := tt.v.EstimateKeysMoved(&tt.next, tt.counts); moved != tt.moved {
+				t.Errorf("Want: %v Got: %v", tt.moved, moved)
+			}
+		})
+	}
+}
+
+func TestSetItem(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {}}, map[string]Meta{})
+	defer func() { MyKVS = PartitionedKVS{} }()
+
+	notExists := func(exists bool, meta Meta) error {
+		if exists {
+			return ErrConditionNotMet
+		}
+		return nil
+	}
+
+	var tests = []struct {
+		name    string
+		token   uint64
+		key     string
+		value   string
+		expires time.Time
+		cond    Condition
+		err     error
+		want    string
+		exists  bool
+	}{
+		{"Add new key", 1, "a", "1", time.Time{}, notExists, nil, "1", true},
+		{"Add existing key", 1, "a", "2", time.Time{}, notExists, ErrConditionNotMet, "1", true},
+		{"Unconditional set", 1, "a", "3", time.Time{}, nil, nil, "3", true},
+		{"Expired key is hidden", 1, "b", "1", time.Now().Add(-time.Second), nil, nil, "", false},
+		{"Add over expired key", 1, "b", "2", time.Time{}, notExists, nil, "2", true},
+		{"Missing partition", 2, "c", "1", time.Time{}, nil, ErrPartitionNotFound, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, before, _ := GetItem(tt.token, tt.key)
+			meta, err := SetItem(tt.token, tt.key, tt.value, 0, tt.expires, tt.cond)
+			if err != tt.err {
+				t.Errorf("Want: %v Got: %v", tt.err, err)
+			} else if err == nil && meta.Revision <= before.Revision {
+				t.Errorf("Revision %d was not increased from %d", meta.Revision, before.Revision)
+			}
+
+			value, exists := Get(tt.token, tt.key)
+			if value != tt.want || exists != tt.exists {
+				t.Errorf("Want: %v %v Got: %v %v", tt.want, tt.exists, value, exists)
+			}
+		})
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}}, map[string]Meta{"a": {Revision: 5}})
+	defer func() { MyKVS = PartitionedKVS{} }()
+
+	var tests = []struct {
+		name string
+		key  string
+		cond Precondition
+		err  error
+	}{
+		{"Match", "a", Precondition{Match: []uint64{4, 5}}, nil},
+		{"Match other revision", "a", Precondition{Match: []uint64{4}}, ErrConditionNotMet},
+		{"Match missing key", "b", Precondition{Match: []uint64{5}}, ErrConditionNotMet},
+		{"Match any", "a", Precondition{MatchAny: true}, nil},
+		{"Match any missing key", "b", Precondition{MatchAny: true}, ErrConditionNotMet},
+		{"None match", "a", Precondition{NoneMatch: []uint64{4}}, nil},
+		{"None match revision", "a", Precondition{NoneMatch: []uint64{5}}, ErrConditionNotMet},
+		{"None match missing key", "b", Precondition{NoneMatch: []uint64{5}}, nil},
+		{"None match any", "a", Precondition{NoneMatchAny: true}, ErrConditionNotMet},
+		{"None match any missing key", "b", Precondition{NoneMatchAny: true}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, meta, exists := GetItem(1, tt.key)
+			if err := tt.cond.Check(exists, meta); err != tt.err {
+				t.Errorf("Want: %v Got: %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := DeleteItem(1, "a", (&Precondition{Match: []uint64{4}}).Check); err != ErrConditionNotMet {
+		t.Errorf("Want: %v Got: %v", ErrConditionNotMet, err)
+	}
+	if _, err := DeleteItem(1, "b", nil); err != ErrNotFound {
+		t.Errorf("Want: %v Got: %v", ErrNotFound, err)
+	}
+	if _, err := DeleteItem(1, "a", (&Precondition{Match: []uint64{5}}).Check); err != nil {
+		t.Errorf("Want: <nil> Got: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}}, map[string]Meta{"a": {Flags: 5}})
+	defer func() { MyKVS = PartitionedKVS{} }()
+
+	appendOne := func(value string) (string, error) { return value + "1", nil }
+	if _, _, err := Update(1, "missing", appendOne); err != ErrNotFound {
+		t.Errorf("Want: %v Got: %v", ErrNotFound, err)
+	}
+
+	value, meta, err := Update(1, "a", appendOne)
+	if err != nil || value != "11" || meta.Flags != 5 || meta.Revision == 0 {
+		t.Errorf("Want: 11 with flags 5 Got: %v %+v %v", value, meta, err)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "5", "b": "x", "max": strconv.FormatInt(math.MaxInt64, 10)}}, map[string]Meta{"a": {Flags: 2, Expires: expires}})
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+
+	var tests = []struct {
+		name  string
+		key   string
+		delta int64
+		value int64
+		err   error
+	}{
+		{"Increment", "a", 3, 8, nil},
+		{"Decrement", "a", -10, -2, nil},
+		{"Missing key", "c", 4, 4, nil},
+		{"Not an integer", "b", 1, 0, ErrNotInteger},
+		{"Overflow", "max", 1, math.MaxInt64, ErrOverflow},
+		{"Decrement max", "max", -1, math.MaxInt64 - 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := Increment(1, tt.key, tt.delta)
+			if err != tt.err || (err == nil && value != tt.value) {
+				t.Errorf("Want: %d %v Got: %d %v", tt.value, tt.err, value, err)
+			}
+		})
+	}
+
+	if value, meta, _ := GetItem(1, "a"); value != "-2" || meta.Flags != 2 || !meta.Expires.Equal(expires) {
+		t.Errorf("Want: -2 keeping flags and expiry Got: %s %+v", value, meta)
+	}
+	if value, _, _ := GetItem(1, "b"); value != "x" {
+		t.Errorf("Want: x unchanged Got: %s", value)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	MyKVS, expiring = partitions(map[uint64]KVS{1: {}, 2: {}}, nil), map[string]uint64{}
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+
+	now := time.Now()
+	Set(1, "never", "1", time.Time{}, nil)
+	Set(1, "later", "1", now.Add(time.Hour), nil)
+	for i := 0; i < 100; i++ {
+		Set(2, "past"+strconv.Itoa(i), "1", now.Add(time.Millisecond), nil)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if _, exists := Get(2, "past0"); exists {
+		t.Error("Expired key was returned")
+	}
+	if removed := SweepExpired(20); removed != 99 {
+		t.Errorf("Want: 99 keys swept Got: %v", removed)
+	}
+	if count := KeyCount(); count != 2 || len(expiring) != 1 {
+		t.Errorf("Want: 2 keys with 1 expiring Got: %v keys with %v expiring", count, len(expiring))
+	}
+
+	//Expiry and revisions move with keys and keys which never expire are not given an expiry
+	_, never, _ := GetItem(1, "never")
+	_, later, _ := GetItem(1, "later")
+	revisions := map[string]uint64{"never": never.Revision, "later": later.Revision}
+	v := View{Nodes: []string{"b"}, Tokens: []Token{{Endpoint: "b", Value: 5}}}
+	shards, _ := v.Reshard(Change{Removed: true})
+	shard := shards["b"]["5"]
+	want := &Shard{Keys: KVS{"never": "1", "later": "1"}, Expires: map[string]int64{"later": now.Add(time.Hour).UnixNano()}, Revisions: revisions}
+	if !reflect.DeepEqual(shard, want) {
+		t.Fatalf("Want: %+v Got: %+v", want, shard)
+	}
+
+	MyKVS = partitions(map[uint64]KVS{5: {}}, nil)
+	if err := PushKeys(map[string]*Shard{"5": shard}); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := GetItem(5, "later"); !meta.Expires.Equal(now.Add(time.Hour)) || meta.Revision != revisions["later"] {
+		t.Errorf("Want: expiry %v revision %v Got: %v %v", now.Add(time.Hour), revisions["later"], meta.Expires, meta.Revision)
+	}
+	if _, meta, exists := GetItem(5, "never"); !exists || !meta.Expires.IsZero() {
+		t.Errorf("Want: key without expiry Got: %v %v", exists, meta.Expires)
+	}
+}
+
+func TestScan(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "", "ab": "", "b": ""}, 2: {"aa": "", "ac": "", "c": ""}}, map[string]Meta{"ac": {Expires: time.Now().Add(-time.Second)}})
+	defer func() { MyKVS = PartitionedKVS{} }()
+
+	var tests = []struct {
+		name   string
+		prefix string
+		after  string
+		limit  int
+		want   []string
+	}{
+		{"All keys", "", "", 10, []string{"a", "aa", "ab", "b", "c"}},
+		{"Prefix", "a", "", 10, []string{"a", "aa", "ab"}},
+		{"Limit", "", "", 2, []string{"a", "aa"}},
+		{"After key", "a", "aa", 10, []string{"ab"}},
+		{"No matches", "d", "", 10, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if keys := Scan(tt.prefix, tt.after, tt.limit); !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("Want: %v Got: %v", tt.want, keys)
+			}
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "", "ab": "", "b": ""}, 2: {"aa": "", "ac": "", "c": ""}}, map[string]Meta{"ac": {Expires: time.Now().Add(-time.Second)}})
+	locks = map[string]string{"ab": "t1"}
+	defer func() { MyKVS, locks = PartitionedKVS{}, map[string]string{} }()
+
+	if count := CountPrefix("a"); count != 3 {
+		t.Errorf("Want: 3 keys Got: %d", count)
+	}
+
+	//Expired keys are removed but not counted and locked keys are left in place
+	if deleted, locked := DeletePrefix("a"); deleted != 2 || locked != 1 {
+		t.Errorf("Want: 2 deleted 1 locked Got: %d deleted %d locked", deleted, locked)
+	}
+	if keys := Scan("", "", 10); !reflect.DeepEqual(keys, []string{"ab", "b", "c"}) {
+		t.Errorf("Want: [ab b c] Got: %v", keys)
+	}
+}
+
+func TestStores(t *testing.T) {
+	//Small memtables make the disk engine write and compact segments
+	DataDir, MemtableSize = t.TempDir(), 512
+	defer func() { DataDir, MemtableSize = "data", 1024*1024 }()
+
+	for name, engine := range Engines {
+		t.Run(name, func(t *testing.T) {
+			store := engine(1)
+			want, wantMeta := map[string]string{}, map[string]Meta{}
+			r := rand.New(rand.NewSource(1))
+
+			//Compare random writes and deletes against a map
+			for i := 0; i < 5000; i++ {
+				key := strconv.Itoa(r.Intn(500))
+				if r.Intn(3) == 0 {
+					store.Delete(key)
+					delete(want, key)
+				} else {
+					meta := Meta{Flags: uint32(i), Revision: uint64(i)}
+					if i%2 == 0 {
+						meta.Expires = time.Unix(0, int64(i)*int64(time.Millisecond))
+					}
+					store.Set(key, strconv.Itoa(i), meta)
+					want[key], wantMeta[key] = strconv.Itoa(i), meta
+				}
+			}
+
+			if store.Len() != len(want) {
+				t.Errorf("Want: %v keys Got: %v", len(want), store.Len())
+			}
+			for key, value := range want {
+				got, meta, exists := store.Get(key)
+				if !exists || got != value {
+					t.Errorf("Want: %v=%v Got: %v %v", key, value, got, exists)
+				}
+				if m := wantMeta[key]; meta.Flags != m.Flags || meta.Revision != m.Revision || !meta.Expires.Equal(m.Expires) {
+					t.Errorf("Want: %v meta %+v Got: %+v", key, m, meta)
+				}
+			}
+			if _, _, exists := store.Get("missing"); exists {
+				t.Errorf("Missing key exists")
+			}
+
+			sorted := []string{}
+			for key := range want {
+				if key >= "25" {
+					sorted = append(sorted, key)
+				}
+			}
+			sort.Strings(sorted)
+
+			keys := []string{}
+			store.Ascend("25", func(key string, value string, meta Meta) bool {
+				if value != want[key] || meta.Revision != wantMeta[key].Revision {
+					t.Errorf("Want: %v=%v Got: %v", key, want[key], value)
+				}
+				keys = append(keys, key)
+				return len(keys) < 10
+			})
+			if !reflect.DeepEqual(keys, sorted[:10]) {
+				t.Errorf("Want: %v Got: %v", sorted[:10], keys)
+			}
+		})
+	}
+}
+
+func TestSegmentTransfer(t *testing.T) {
+	DataDir, MemtableSize = t.TempDir(), 256
+	defer func(last uint64) { DataDir, MemtableSize, lastRevision = "data", 1024*1024, last }(lastRevision)
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+
+	for name, engine := range Engines {
+		t.Run(name, func(t *testing.T) {
+			removed := NewDiskStore(partitionDir(1))
+			want, wantMeta := KVS{}, map[string]Meta{}
+			for i := 1; i <= 200; i++ {
+				key, value := "key"+strconv.Itoa(i), strconv.Itoa(i)
+				meta := Meta{Revision: uint64(i)}
+				if i == 1 {
+					meta.Flags, meta.Expires = 3, expires
+				}
+				removed.Set(key, value, meta)
+				want[key], wantMeta[key] = value, meta
+			}
+			removed.Delete("key2")
+			delete(want, "key2")
+
+			MyKVS, lastRevision = PartitionedKVS{1: removed}, 0
+
+			//Every key moves to the only token of the new view
+			v := View{Nodes: []string{"b"}, Tokens: []Token{{Endpoint: "b", Value: 5}}}
+			shards, transfers := v.Reshard(Change{Removed: true})
+			if len(shards) != 0 || len(transfers) != 1 || transfers[0].Token != v.Tokens[0] {
+				t.Fatalf("Want: 1 transfer to %v Got: %v shards and %v", v.Tokens[0], len(shards), transfers)
+			}
+
+			received := engine(5)
+			received.Set("other", "1", Meta{Revision: 300})
+			want["other"], wantMeta["other"] = "1", Meta{Revision: 300}
+			MyKVS = PartitionedKVS{5: received}
+			if err := IngestSegment(5, transfers[0].Path); err != nil {
+				t.Fatal(err)
+			}
+			transfers[0].Remove()
+
+			//Keys keep their metadata and later writes are given greater revisions
+			if lastRevision != 200 {
+				t.Errorf("Want: last revision 200 Got: %v", lastRevision)
+			}
+			if expiring["key1"] != 5 {
+				t.Errorf("Want: key1 expiring in partition 5 Got: %v", expiring)
+			}
+			if received.Len() != len(want) {
+				t.Errorf("Want: %v keys Got: %v", len(want), received.Len())
+			}
+			got := KVS{}
+			received.Ascend("", func(key string, value string, meta Meta) bool {
+				got[key] = value
+				if m := wantMeta[key]; meta.Flags != m.Flags || meta.Revision != m.Revision || !meta.Expires.Equal(m.Expires) {
+					t.Errorf("Want: %v meta %+v Got: %+v", key, m, meta)
+				}
+				return true
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Want: %v Got: %v", want, got)
+			}
+			dropStore(received)
+		})
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	var tests = []struct {
+		key string
+		tag string
+	}{
+		{"{user42}:profile", "user42"},
+		{"cart:{user42}", "user42"},
+		{"{a}{b}", "a"},
+		{"{}:x", "{}:x"},
+		{"x{:y", "x{:y"},
+		{"}{a}", "a"},
+		{"plain", "plain"},
+		{"\x00app\x00{user42}:profile", "\x00app\x00user42"},
+		{"\x00app\x00{}:x", "\x00app\x00{}:x"},
+		{"\x00app\x00plain", "\x00app\x00plain"},
+		{"\x00{a}", "a"},
+	}
+
+	for _, tt := range tests {
+		if tag := HashTag(tt.key); tag != tt.tag {
+			t.Errorf("%s: Want: %s Got: %s", tt.key, tt.tag, tag)
+		}
+	}
+
+	if Hash("{user42}:profile", MaxHash) != Hash("{user42}:cart", MaxHash) {
+		t.Errorf("Want: keys with the same tag at the same position")
+	}
+}
+
+func TestTransact(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1", "b": "2"}}, map[string]Meta{"a": {Revision: 3}, "b": {Revision: 4}})
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+
+	value := "5"
+	writes := []Write{{Key: "a", Value: &value}, {Key: "b"}, {Key: "c", Value: &value, Expires: time.Now().Add(time.Hour)}}
+	failing := Txn{
+		Reads:      []string{"a", "c"},
+		Conditions: []KeyCondition{{"a", (&Precondition{Match: []uint64{3}}).Check}, {"b", (&Precondition{Match: []uint64{3}}).Check}},
+		Writes:     writes,
+	}
+
+	res, err := Transact(1, failing)
+	if err != ErrConditionNotMet || !reflect.DeepEqual(res.Failed, []string{"b"}) {
+		t.Errorf("Want: %v for b Got: %v %v", ErrConditionNotMet, err, res.Failed)
+	}
+	if v, _, _ := GetItem(1, "a"); v != "1" {
+		t.Errorf("Want: a unchanged after failed condition Got: %s", v)
+	}
+
+	failing.Conditions[1].Cond = (&Precondition{Match: []uint64{4}}).Check
+	res, err = Transact(1, failing)
+	if err != nil || res.Reads["a"].Value != "1" || res.Reads["c"].Exists {
+		t.Errorf("Want: reads from before the writes Got: %+v %v", res.Reads, err)
+	}
+	if len(res.Revisions) != 2 || res.Revisions["a"] == 0 || res.Revisions["c"] == 0 {
+		t.Errorf("Want: new revisions of a and c Got: %v", res.Revisions)
+	}
+
+	if v, _, _ := GetItem(1, "a"); v != "5" {
+		t.Errorf("Want: a set to 5 Got: %s", v)
+	}
+	if _, _, exists := GetItem(1, "b"); exists {
+		t.Errorf("Want: b deleted")
+	}
+	if _, meta, _ := GetItem(1, "c"); meta.Expires.IsZero() {
+		t.Errorf("Want: c expiring")
+	}
+
+	if _, err := Transact(2, Txn{Reads: []string{"a"}}); err != ErrPartitionNotFound {
+		t.Errorf("Want: %v Got: %v", ErrPartitionNotFound, err)
+	}
+}
+
+func TestReshardFlags(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {}}, nil)
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	SetItem(1, "flagged", "x", 42, time.Time{}, nil)
+	SetItem(1, "binary", binary, 0, time.Time{}, nil)
+
+	v := View{Nodes: []string{"b"}, Tokens: []Token{{Endpoint: "b", Value: 5}}}
+	shards, _ := v.Reshard(Change{Removed: true})
+
+	//Shards are sent between nodes as json
+	b, err := json.Marshal(shards["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := map[string]*Shard{}
+	if err := json.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+
+	MyKVS = partitions(map[uint64]KVS{5: {}}, nil)
+	if err := PushKeys(received); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := GetItem(5, "flagged"); meta.Flags != 42 {
+		t.Errorf("Want: flags 42 Got: %v", meta.Flags)
+	}
+	if value, _, _ := GetItem(5, "binary"); value != binary {
+		t.Errorf("Want: %q Got: %q", binary, value)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}, 2: {"b": "2"}}, map[string]Meta{"a": {Revision: 3}})
+	defer func() {
+		MyKVS, locks, prepared = PartitionedKVS{}, map[string]string{}, map[string]*preparedTxn{}
+	}()
+
+	value := "5"
+	txns := map[uint64]Txn{
+		1: {Reads: []string{"a"}, Conditions: []KeyCondition{{"a", (&Precondition{Match: []uint64{3}}).Check}}},
+		2: {Writes: []Write{{Key: "b", Value: &value}}},
+	}
+
+	res, err := Prepare("t1", "n1", txns)
+	if err != nil || res.Reads["a"].Value != "1" {
+		t.Errorf("Want: a read as 1 Got: %+v %v", res.Reads, err)
+	}
+	if _, err := Prepare("t1", "n1", txns); err != ErrTxnPrepared {
+		t.Errorf("Want: %v Got: %v", ErrTxnPrepared, err)
+	}
+
+	//Keys read, checked or written are locked until the transaction is decided
+	if _, _, err := Set(1, "a", "2", time.Time{}, nil); err != ErrLocked {
+		t.Errorf("Want: %v for a Got: %v", ErrLocked, err)
+	}
+	if err := Delete(2, "b"); err != ErrLocked {
+		t.Errorf("Want: %v for b Got: %v", ErrLocked, err)
+	}
+	if _, err := Prepare("t2", "n1", map[uint64]Txn{2: {Reads: []string{"b"}}}); err != ErrLocked {
+		t.Errorf("Want: %v Got: %v", ErrLocked, err)
+	}
+	if v, _, _ := GetItem(2, "b"); v != "2" {
+		t.Errorf("Want: b unchanged before commit Got: %s", v)
+	}
+
+	if ids := InDoubt(time.Now().Add(time.Hour)); !reflect.DeepEqual(ids, map[string]string{"t1": "n1"}) {
+		t.Errorf("Want: t1 in doubt Got: %v", ids)
+	}
+	if ids := InDoubt(time.Now().Add(-time.Hour)); len(ids) != 0 {
+		t.Errorf("Want: no transactions prepared an hour ago Got: %v", ids)
+	}
+
+	revisions, err := Commit("t1")
+	if err != nil || revisions["b"] == 0 {
+		t.Errorf("Want: new revision of b Got: %v %v", revisions, err)
+	}
+	if v, _, _ := GetItem(2, "b"); v != "5" {
+		t.Errorf("Want: b set to 5 Got: %s", v)
+	}
+	if _, err := Commit("t1"); err != ErrTxnNotFound {
+		t.Errorf("Want: %v Got: %v", ErrTxnNotFound, err)
+	}
+	if _, _, err := Set(1, "a", "2", time.Time{}, nil); err != nil {
+		t.Errorf("Want: a unlocked after commit Got: %v", err)
+	}
+}
+
+func TestPrepareAbort(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}}, map[string]Meta{"a": {Revision: 3}})
+	defer func() {
+		MyKVS, locks, prepared = PartitionedKVS{}, map[string]string{}, map[string]*preparedTxn{}
+	}()
+
+	value := "5"
+	failing := map[uint64]Txn{1: {Conditions: []KeyCondition{{"a", (&Precondition{Match: []uint64{4}}).Check}}}}
+	if res, err := Prepare("t1", "n1", failing); err != ErrConditionNotMet || !reflect.DeepEqual(res.Failed, []string{"a"}) {
+		t.Errorf("Want: %v for a Got: %v %v", ErrConditionNotMet, err, res.Failed)
+	}
+	if len(locks) != 0 {
+		t.Errorf("Want: no locks after failed condition Got: %v", locks)
+	}
+
+	if _, err := Prepare("t2", "n1", map[uint64]Txn{1: {Writes: []Write{{Key: "a", Value: &value}}}}); err != nil {
+		t.Errorf("Want: prepared Got: %v", err)
+	}
+	if _, _, err := Increment(1, "a", 1); err != ErrLocked {
+		t.Errorf("Want: %v Got: %v", ErrLocked, err)
+	}
+	if err := Abort("t2"); err != nil {
+		t.Errorf("Want: aborted Got: %v", err)
+	}
+	if v, _, _ := GetItem(1, "a"); v != "1" {
+		t.Errorf("Want: a unchanged after abort Got: %s", v)
+	}
+	if err := Abort("t2"); err != ErrTxnNotFound {
+		t.Errorf("Want: %v Got: %v", ErrTxnNotFound, err)
+	}
+	if _, _, err := Increment(1, "a", 1); err != nil {
+		t.Errorf("Want: a unlocked after abort Got: %v", err)
+	}
+
+	if _, err := Prepare("t3", "n1", map[uint64]Txn{2: {Reads: []string{"b"}}}); err != ErrPartitionNotFound {
+		t.Errorf("Want: %v Got: %v", ErrPartitionNotFound, err)
+	}
+}
+
+func TestPrepareReshard(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}, 2: {"b": "2"}}, map[string]Meta{})
+	defer func() {
+		MyKVS, locks, prepared = PartitionedKVS{}, map[string]string{}, map[string]*preparedTxn{}
+		ReleasePrepares()
+	}()
+
+	value := "5"
+	txns := map[uint64]Txn{1: {Writes: []Write{{Key: "a", Value: &value}}}, 2: {Writes: []Write{{Key: "b", Value: &value}}}}
+	if _, err := Prepare("t1", "n1", txns); err != nil {
+		t.Fatal(err)
+	}
+
+	//A view change waits for prepared transactions and refuses new prepares until released
+	if err := HoldPrepares(time.Now().Add(time.Hour), time.Millisecond); err != ErrTxnsPrepared {
+		t.Errorf("Want: %v Got: %v", ErrTxnsPrepared, err)
+	}
+	if _, err := Prepare("t2", "n1", map[uint64]Txn{1: {Reads: []string{"c"}}}); err != ErrLocked {
+		t.Errorf("Want: %v while held Got: %v", ErrLocked, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		Commit("t1")
+	}()
+	if err := HoldPrepares(time.Now().Add(time.Hour), time.Second); err != nil {
+		t.Errorf("Want: held once t1 committed Got: %v", err)
+	}
+
+	v := View{Nodes: []string{"b"}, Tokens: []Token{{Endpoint: "b", Value: 5}}}
+	shards, _ := v.Reshard(Change{Removed: true})
+	if keys := shards["b"]["5"].Keys; !reflect.DeepEqual(keys, KVS{"a": "5", "b": "5"}) {
+		t.Errorf("Want: committed writes moved Got: %v", keys)
+	}
+
+	ReleasePrepares()
+	MyKVS = partitions(map[uint64]KVS{1: {"a": "1"}, 2: {"b": "2"}}, nil)
+	if _, err := Prepare("t3", "n1", txns); err != nil {
+		t.Fatalf("Want: prepared once released Got: %v", err)
+	}
+
+	//A commit missing a partition writes nothing and stays prepared so it can be sent again
+	delete(MyKVS, 2)
+	if _, err := Commit("t3"); err != ErrPartitionNotFound {
+		t.Errorf("Want: %v Got: %v", ErrPartitionNotFound, err)
+	}
+	if v, _, _ := GetItem(1, "a"); v != "1" {
+		t.Errorf("Want: a unchanged Got: %s", v)
+	}
+	if ids := InDoubt(time.Now().Add(time.Hour)); ids["t3"] != "n1" {
+		t.Errorf("Want: t3 still prepared Got: %v", ids)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {}}, nil)
+	defer func() { MyKVS, expiring = PartitionedKVS{}, map[string]uint64{} }()
+
+	sub := Subscribe(func(key string) bool { return strings.HasPrefix(key, "a") }, 4)
+	defer sub.Cancel()
+
+	Set(1, "a1", "x", time.Time{}, nil)
+	Set(1, "b1", "y", time.Time{}, nil)
+	Delete(1, "a1")
+	SetItem(1, "a2", "z", 0, time.Now().Add(-time.Second), nil)
+	GetItem(1, "a2")
+
+	var got []string
+	var last uint64
+	for i := 0; i < 3; i++ {
+		e := <-sub.Events
+		got = append(got, e.Type+" "+e.Key+" "+e.Value)
+		if e.Revision <= last {
+			t.Errorf("Want: increasing revisions Got: %d after %d", e.Revision, last)
+		}
+		last = e.Revision
+	}
+
+	want := []string{"set a1 x", "delete a1 ", "set a2 z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Want: %v Got: %v", want, got)
+	}
+	if e := <-sub.Events; e.Type != EventExpire || e.Key != "a2" {
+		t.Errorf("Want: a2 expired Got: %+v", e)
+	}
+
+	//Subscribers which fall behind are cancelled
+	for i := 0; i < 5; i++ {
+		Set(1, "a3", "x", time.Time{}, nil)
+	}
+	for range sub.Events {
+	}
+	sub.Cancel()
+}
+
+func TestChanges(t *testing.T) {
+	MyKVS = partitions(map[uint64]KVS{1: {}}, nil)
+	defer func() {
+		MyKVS, expiring = PartitionedKVS{}, map[string]uint64{}
+		changeLog, lastSeq, ChangeLogSize = nil, 0, 100000
+	}()
+	changeLog, lastSeq, ChangeLogSize = nil, 0, 4
+
+	Set(1, "a", "x", time.Time{}, nil)
+	Delete(1, "a")
+	PushKeys(map[string]*Shard{"1": {Keys: KVS{"b": "y"}, Revisions: map[string]uint64{"b": 7}}})
+
+	events, oldest, last, _ := Changes(0, 10)
+	var got []string
+	for _, e := range events {
+		got = append(got, strconv.FormatUint(e.Seq, 10)+" "+e.Type+" "+e.Key)
+	}
+	want := []string{"1 set a", "2 delete a", "3 move-in b"}
+	if !reflect.DeepEqual(got, want) || oldest != 1 || last != 3 {
+		t.Errorf("Want: %v from 1 to 3 Got: %v from %d to %d", want, got, oldest, last)
+	}
+	if events[2].Revision != 7 {
+		t.Errorf("Want: moved revision 7 Got: %d", events[2].Revision)
+	}
+
+	if events, _, _, _ := Changes(1, 1); len(events) != 1 || events[0].Seq != 2 {
+		t.Errorf("Want: change 2 after 1 Got: %+v", events)
+	}
+
+	_, _, _, next := Changes(3, 10)
+	Set(1, "c", "z", time.Time{}, nil)
+	Set(1, "c", "w", time.Time{}, nil)
+	select {
+	case <-next:
+	default:
+		t.Errorf("Want: waiters woken by a new change")
+	}
+
+	//Only the last ChangeLogSize changes are kept
+	events, oldest, last, _ = Changes(0, 10)
+	if len(events) != 4 || oldest != 2 || last != 5 || events[0].Seq != 2 {
+		t.Errorf("Want: changes 2 to 5 Got: %d changes from %d to %d", len(events), oldest, last)
+	}
+}
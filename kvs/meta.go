@@ -0,0 +1,290 @@
+package kvs
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+//Meta is stored alongside the value of a key in the record of the key in its partition's store
+type Meta struct {
+	Flags    uint32    //Opaque flags set by memcached clients
+	Expires  time.Time //Zero if the key never expires
+	Revision uint64    //Changes every time the key is written
+}
+
+//Keys with an expiry mapped to the token of their partition so expired keys can be found without
+//reading every partition
+var expiring = map[string]uint64{}
+
+//Last revision given to a written key
+var lastRevision uint64
+
+//Errors returned by conditional writes
+var (
+	ErrNotFound           = errors.New("Key does not exist")
+	ErrPartitionNotFound  = errors.New("Partition does not exist")
+	ErrConditionNotMet    = errors.New("Condition not met")
+	ErrRevisionMismatched = errors.New("Revision does not match")
+)
+
+//Errors returned by increments
+var (
+	ErrNotInteger = errors.New("Value is not an integer")
+	ErrOverflow   = errors.New("Increment or decrement would overflow")
+)
+
+//Condition is checked against the current state of a key before a conditional write
+type Condition func(exists bool, meta Meta) error
+
+//Precondition of a conditional write on the revision of a key with the semantics of the HTTP If-Match
+//and If-None-Match headers
+type Precondition struct {
+	Match        []uint64 `json:"match,omitempty"`          //Revisions of which the key must have one
+	MatchAny     bool     `json:"match-any,omitempty"`      //Key must exist
+	NoneMatch    []uint64 `json:"none-match,omitempty"`     //Revisions the key must not have
+	NoneMatchAny bool     `json:"none-match-any,omitempty"` //Key must not exist
+}
+
+//Check if the key has expired at the given time
+func (m Meta) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+//Check is a Condition returning ErrConditionNotMet if the key does not meet the precondition. A nil
+//precondition always holds
+func (p *Precondition) Check(exists bool, meta Meta) error {
+	if p == nil {
+		return nil
+	} else if (p.MatchAny || len(p.Match) > 0) && !exists {
+		return ErrConditionNotMet
+	} else if len(p.Match) > 0 && !hasRevision(p.Match, meta.Revision) {
+		return ErrConditionNotMet
+	} else if p.NoneMatchAny && exists {
+		return ErrConditionNotMet
+	} else if exists && hasRevision(p.NoneMatch, meta.Revision) {
+		return ErrConditionNotMet
+	}
+	return nil
+}
+
+//Check if a revision is in a list
+func hasRevision(revisions []uint64, revision uint64) bool {
+	for _, r := range revisions {
+		if r == revision {
+			return true
+		}
+	}
+	return false
+}
+
+//GetItem returns the value and metadata of a key
+func GetItem(token uint64, key string) (string, Meta, bool) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	return getItem(token, key, time.Now())
+}
+
+//SetItem sets the value and metadata of a key if the condition holds. Returns the metadata with the new revision
+func SetItem(token uint64, key string, value string, flags uint32, expires time.Time, cond Condition) (Meta, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if _, exists := MyKVS[token]; !exists {
+		return Meta{}, ErrPartitionNotFound
+	} else if err := checkLock(key); err != nil {
+		return Meta{}, err
+	}
+
+	_, meta, exists := getItem(token, key, time.Now())
+	if cond != nil {
+		if err := cond(exists, meta); err != nil {
+			return meta, err
+		}
+	}
+	return setItem(token, key, value, Meta{Flags: flags, Expires: expires})
+}
+
+//DeleteItem deletes a key if the condition holds. Returns the metadata of the key before it was deleted
+func DeleteItem(token uint64, key string, cond Condition) (Meta, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if err := checkLock(key); err != nil {
+		return Meta{}, err
+	}
+
+	_, meta, exists := getItem(token, key, time.Now())
+	if cond != nil {
+		if err := cond(exists, meta); err != nil {
+			return meta, err
+		}
+	}
+
+	if !exists {
+		return meta, ErrNotFound
+	}
+	removeItem(MyKVS[token], key, EventDelete)
+	return meta, nil
+}
+
+//Update replaces the value of an existing key with the result of fn, keeping its flags and expiry
+func Update(token uint64, key string, fn func(value string) (string, error)) (string, Meta, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if err := checkLock(key); err != nil {
+		return "", Meta{}, err
+	}
+
+	value, meta, exists := getItem(token, key, time.Now())
+	if !exists {
+		return "", meta, ErrNotFound
+	}
+
+	value, err := fn(value)
+	if err != nil {
+		return "", meta, err
+	}
+
+	meta, err = setItem(token, key, value, meta)
+	return value, meta, err
+}
+
+//Increment adds delta to the value of a key holding a 64 bit signed integer, keeping its flags and
+//expiry. Like Redis a missing key is set to delta and never expires. Returns the new value and metadata
+func Increment(token uint64, key string, delta int64) (int64, Meta, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if err := checkLock(key); err != nil {
+		return 0, Meta{}, err
+	}
+
+	value, meta, exists := getItem(token, key, time.Now())
+	var n int64
+	if exists {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, meta, ErrNotInteger
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return n, meta, ErrOverflow
+	}
+	n += delta
+
+	meta, err := setItem(token, key, strconv.FormatInt(n, 10), meta)
+	return n, meta, err
+}
+
+//Get value and metadata of a key, removing it if it has expired. Caller must hold storeMutex
+func getItem(token uint64, key string, now time.Time) (string, Meta, bool) {
+	partition, exists := MyKVS[token]
+	if !exists {
+		return "", Meta{}, false
+	}
+
+	value, meta, exists := partition.Get(key)
+	if !exists {
+		return "", Meta{}, false
+	}
+
+	if meta.expired(now) {
+		removeItem(partition, key, EventExpire)
+		return "", Meta{}, false
+	}
+	return value, meta, true
+}
+
+//Store value and metadata of a key with a new revision. Caller must hold storeMutex
+func setItem(token uint64, key string, value string, meta Meta) (Meta, error) {
+	partition, exists := MyKVS[token]
+	if !exists {
+		return Meta{}, ErrPartitionNotFound
+	}
+
+	meta.Revision = nextRevision()
+	partition.Set(key, value, meta)
+	trackExpiry(token, key, meta)
+	record(Event{Type: EventSet, Key: key, Value: value, Revision: meta.Revision, Expires: meta.Expires})
+	return meta, nil
+}
+
+//Track a key stored in a partition if it expires. Caller must hold storeMutex
+func trackExpiry(token uint64, key string, meta Meta) {
+	if meta.Expires.IsZero() {
+		delete(expiring, key)
+	} else {
+		expiring[key] = token
+	}
+}
+
+//Remove a key from a partition. Caller must hold storeMutex
+func deleteItem(partition Store, key string) {
+	partition.Delete(key)
+	delete(expiring, key)
+}
+
+//SweepExpired removes expired keys. Like Redis it checks random samples of the keys which expire
+//so the store is never locked for long, and takes another sample while more than a quarter of the
+//last one had expired. Returns the number of keys removed
+func SweepExpired(sampleSize int) int {
+	removed := 0
+	for {
+		sampled, expired := sweepSample(sampleSize, time.Now())
+		removed += expired
+		if sampled == 0 || expired*4 <= sampled {
+			return removed
+		}
+	}
+}
+
+//Check up to sampleSize keys which expire and remove those which have expired. Returns the number of
+//keys checked and removed
+func sweepSample(sampleSize int, now time.Time) (int, int) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	//Iteration over a map starts at a random key
+	sampled, expired := 0, 0
+	for key, token := range expiring {
+		if sampled == sampleSize {
+			break
+		}
+		sampled++
+
+		partition, exists := MyKVS[token]
+		if !exists {
+			delete(expiring, key)
+			continue
+		}
+
+		if _, meta, _ := partition.Get(key); meta.expired(now) {
+			removeItem(partition, key, EventExpire)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+//Get the next revision. Caller must hold storeMutex
+func nextRevision() uint64 {
+	lastRevision++
+	return lastRevision
+}
+
+//Keep the revision of a key moved from another node so conditional writes with it still succeed,
+//making sure later revisions given by this node are greater. Keys without a revision get the next
+//one. Caller must hold storeMutex
+func movedRevision(revision uint64) uint64 {
+	if revision == 0 {
+		return nextRevision()
+	} else if revision > lastRevision {
+		lastRevision = revision
+	}
+	return revision
+}
@@ -0,0 +1,129 @@
+package kvs
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+//Levels of a skip list, enough for billions of keys with a quarter of nodes promoted to each level
+const skipListMaxLevel = 16
+
+//SkipList is a Store keeping keys sorted so range scans only visit the keys they return
+type SkipList struct {
+	head   *skipNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+type skipNode struct {
+	key   string
+	value string
+	meta  Meta
+	next  []*skipNode
+}
+
+//NewSkipList returns an empty skip list
+func NewSkipList() *SkipList {
+	return &SkipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+//Get returns the value and metadata of a key
+func (s *SkipList) Get(key string) (string, Meta, bool) {
+	n := s.seek(key, nil)
+	if n != nil && n.key == key {
+		return n.value, n.meta, true
+	}
+	return "", Meta{}, false
+}
+
+//Set sets the value and metadata of a key
+func (s *SkipList) Set(key string, value string, meta Meta) {
+	update := make([]*skipNode, skipListMaxLevel)
+	n := s.seek(key, update)
+	if n != nil && n.key == key {
+		n.value, n.meta = value, meta
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	n = &skipNode{key: key, value: value, meta: meta, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	s.length++
+}
+
+//Delete deletes a key
+func (s *SkipList) Delete(key string) {
+	update := make([]*skipNode, skipListMaxLevel)
+	n := s.seek(key, update)
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := range n.next {
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+}
+
+//Len returns the number of keys
+func (s *SkipList) Len() int {
+	return s.length
+}
+
+//Ascend calls fn for each key from the first key not less than start in sorted order until fn returns false
+func (s *SkipList) Ascend(start string, fn func(key string, value string, meta Meta) bool) {
+	for n := s.seek(start, nil); n != nil && fn(n.key, n.value, n.meta); n = n.next[0] {
+	}
+}
+
+//String formats the keys and values the same way as a map
+func (s *SkipList) String() string {
+	m := make(KVS, s.length)
+	for n := s.head.next[0]; n != nil; n = n.next[0] {
+		m[n.key] = n.value
+	}
+	return fmt.Sprint(map[string]string(m))
+}
+
+//Find the first node with a key not less than the given key. If update is given it is filled with
+//the last node before that key on each level
+func (s *SkipList) seek(key string, update []*skipNode) *skipNode {
+	n := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		if update != nil {
+			update[i] = n
+		}
+	}
+	return n.next[0]
+}
+
+//Choose the number of levels of a new node, each level a quarter as likely as the one below
+func (s *SkipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
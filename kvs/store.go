@@ -0,0 +1,71 @@
+package kvs
+
+import "sort"
+
+//Store holds the keys of a single partition with their values and metadata. Stores are not safe for
+//concurrent use, the package functions hold storeMutex while using them
+type Store interface {
+	Get(key string) (string, Meta, bool)
+	Set(key string, value string, meta Meta)
+	Delete(key string)
+	Len() int
+	//Ascend calls fn for each key from the first key not less than start in sorted order until fn returns false
+	Ascend(start string, fn func(key string, value string, meta Meta) bool)
+}
+
+//Value of a key with its metadata
+type entry struct {
+	value string
+	meta  Meta
+}
+
+//Store keeping keys in a map
+type mapStore map[string]entry
+
+//Engines creates an empty store for a partition with each of the available engines
+var Engines = map[string]func(token uint64) Store{
+	"map":     func(token uint64) Store { return make(mapStore) },
+	"ordered": func(token uint64) Store { return NewSkipList() },
+	"disk":    func(token uint64) Store { return NewDiskStore(partitionDir(token)) },
+}
+
+//NewStore creates the store of a new partition. It must be set before the node joins a view
+var NewStore = Engines["map"]
+
+//Get returns the value and metadata of a key
+func (s mapStore) Get(key string) (string, Meta, bool) {
+	r, exists := s[key]
+	return r.value, r.meta, exists
+}
+
+//Set sets the value and metadata of a key
+func (s mapStore) Set(key string, value string, meta Meta) {
+	s[key] = entry{value: value, meta: meta}
+}
+
+//Delete deletes a key
+func (s mapStore) Delete(key string) {
+	delete(s, key)
+}
+
+//Len returns the number of keys
+func (s mapStore) Len() int {
+	return len(s)
+}
+
+//Ascend sorts the keys on every call so scans over maps take time proportional to the size of the partition
+func (s mapStore) Ascend(start string, fn func(key string, value string, meta Meta) bool) {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if r := s[key]; !fn(key, r.value, r.meta) {
+			return
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package kvs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//Errors returned by distributed transactions
+var (
+	ErrLocked      = errors.New("Key is locked by a transaction")
+	ErrTxnNotFound = errors.New("Transaction is not prepared")
+	ErrTxnPrepared = errors.New("Transaction is already prepared")
+
+	ErrTxnsPrepared = errors.New("Transactions are still prepared")
+)
+
+//Keys locked by prepared transactions mapped to the id of the transaction. Other writes to a locked
+//key fail with ErrLocked
+var locks = map[string]string{}
+
+//Prepared transactions waiting for the decision of their coordinator
+var prepared = map[string]*preparedTxn{}
+
+//Prepares are refused until holdUntil so a view change can move keys without prepared transactions
+//locking them. txnDecided is signalled whenever a prepared transaction is committed or aborted
+var (
+	holdUntil  time.Time
+	txnDecided = sync.NewCond(storeMutex)
+)
+
+//Transaction prepared on this node holding locks on its keys
+type preparedTxn struct {
+	txns        map[uint64]Txn
+	keys        []string
+	coordinator string
+	prepared    time.Time
+}
+
+//Txn is a set of reads, conditions and writes on keys of a single partition executed atomically
+type Txn struct {
+	Reads      []string
+	Conditions []KeyCondition
+	Writes     []Write
+}
+
+//KeyCondition must hold for a key before the writes of a transaction are made
+type KeyCondition struct {
+	Key  string
+	Cond Condition
+}
+
+//Write sets a key in a transaction, or deletes it if the value is nil
+type Write struct {
+	Key     string
+	Value   *string
+	Expires time.Time
+}
+
+//Item is the value and metadata of a key read by a transaction
+type Item struct {
+	Value  string
+	Meta   Meta
+	Exists bool
+}
+
+//TxnResult holds the reads and new revisions of a transaction
+type TxnResult struct {
+	Reads     map[string]Item   //Keys read before the writes were made
+	Revisions map[string]uint64 //New revisions of the keys set
+	Failed    []string          //Keys whose condition did not hold
+}
+
+//Transact executes a transaction on a partition atomically. Reads see the values from before the
+//writes. If any condition does not hold nothing is written and ErrConditionNotMet is returned with
+//the keys which failed. Returns ErrLocked if a prepared transaction has locked a key it checks or writes
+func Transact(token uint64, txn Txn) (TxnResult, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	res := newTxnResult()
+	if _, exists := MyKVS[token]; !exists {
+		return res, ErrPartitionNotFound
+	}
+
+	for _, c := range txn.Conditions {
+		if err := checkLock(c.Key); err != nil {
+			return res, err
+		}
+	}
+	for _, w := range txn.Writes {
+		if err := checkLock(w.Key); err != nil {
+			return res, err
+		}
+	}
+
+	txn.evaluate(token, time.Now(), &res)
+	if len(res.Failed) > 0 {
+		return res, ErrConditionNotMet
+	}
+	return res, txn.apply(token, &res)
+}
+
+//Result with no reads or writes
+func newTxnResult() TxnResult {
+	return TxnResult{Reads: make(map[string]Item), Revisions: make(map[string]uint64)}
+}
+
+//Every key of a transaction
+func (txn Txn) keys() []string {
+	keys := append([]string{}, txn.Reads...)
+	for _, c := range txn.Conditions {
+		keys = append(keys, c.Key)
+	}
+	for _, w := range txn.Writes {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+//Read keys and check conditions, adding the values read and keys which failed their condition to
+//the result. Caller must hold storeMutex
+func (txn Txn) evaluate(token uint64, now time.Time, res *TxnResult) {
+	for _, key := range txn.Reads {
+		value, meta, exists := getItem(token, key, now)
+		res.Reads[key] = Item{Value: value, Meta: meta, Exists: exists}
+	}
+
+	for _, c := range txn.Conditions {
+		_, meta, exists := getItem(token, c.Key, now)
+		if c.Cond != nil && c.Cond(exists, meta) != nil {
+			res.Failed = append(res.Failed, c.Key)
+		}
+	}
+}
+
+//Make the writes of a transaction, adding the new revisions to the result. Caller must hold storeMutex
+func (txn Txn) apply(token uint64, res *TxnResult) error {
+	partition, exists := MyKVS[token]
+	if !exists {
+		return ErrPartitionNotFound
+	}
+
+	for _, w := range txn.Writes {
+		if w.Value == nil {
+			if _, _, exists := getItem(token, w.Key, time.Now()); exists {
+				removeItem(partition, w.Key, EventDelete)
+			}
+			delete(res.Revisions, w.Key)
+			continue
+		}
+
+		meta, err := setItem(token, w.Key, *w.Value, Meta{Expires: w.Expires})
+		if err != nil {
+			return err
+		}
+		res.Revisions[w.Key] = meta.Revision
+	}
+	return nil
+}
+
+//Prepare is the first phase of two phase commit on a participant of a distributed transaction with
+//keys in several partitions. Like Transact it reads keys and checks conditions, but instead of
+//writing it locks every key of the transaction until the coordinator decides to commit or abort.
+//Locks are never waited for so transactions cannot deadlock, and a transaction with a key already
+//locked fails with ErrLocked
+func Prepare(id string, coordinator string, txns map[uint64]Txn) (TxnResult, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	res := newTxnResult()
+	if _, exists := prepared[id]; exists {
+		return res, ErrTxnPrepared
+	} else if time.Now().Before(holdUntil) {
+		//Keys may be moved by a view change before the transaction is decided
+		return res, ErrLocked
+	}
+
+	var keys []string
+	for token, txn := range txns {
+		if _, exists := MyKVS[token]; !exists {
+			return res, ErrPartitionNotFound
+		}
+		keys = append(keys, txn.keys()...)
+	}
+	for _, key := range keys {
+		if err := checkLock(key); err != nil {
+			return res, err
+		}
+	}
+
+	now := time.Now()
+	for token, txn := range txns {
+		txn.evaluate(token, now, &res)
+	}
+	if len(res.Failed) > 0 {
+		return res, ErrConditionNotMet
+	}
+
+	for _, key := range keys {
+		locks[key] = id
+	}
+	prepared[id] = &preparedTxn{txns: txns, keys: keys, coordinator: coordinator, prepared: now}
+	return res, nil
+}
+
+//Commit makes the writes of a prepared transaction and releases its locks. Returns the new revisions
+//of the keys set or ErrTxnNotFound if the transaction is not prepared. If a partition of the
+//transaction is missing nothing is written and it stays prepared, returning ErrPartitionNotFound
+func Commit(id string) (map[string]uint64, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	p, exists := prepared[id]
+	if !exists {
+		return nil, ErrTxnNotFound
+	}
+
+	//View changes hold prepares until transactions are decided, so partitions should not move away
+	//from prepared transactions. Writing only some partitions would break atomicity
+	for token := range p.txns {
+		if _, exists := MyKVS[token]; !exists {
+			return nil, ErrPartitionNotFound
+		}
+	}
+	p.release(id)
+
+	res := newTxnResult()
+	var firstErr error
+	for token, txn := range p.txns {
+		if err := txn.apply(token, &res); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return res.Revisions, firstErr
+}
+
+//Abort releases the locks of a prepared transaction without writing. Returns ErrTxnNotFound if the
+//transaction is not prepared
+func Abort(id string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	p, exists := prepared[id]
+	if !exists {
+		return ErrTxnNotFound
+	}
+	p.release(id)
+	return nil
+}
+
+//HoldPrepares refuses new prepares with ErrLocked until the given time, so a view change can move
+//keys without prepared transactions locking them, and waits up to timeout for the transactions
+//already prepared to be decided. Returns ErrTxnsPrepared if some are still prepared, in which case
+//prepares stay held until ReleasePrepares is called or the time passes
+func HoldPrepares(until time.Time, timeout time.Duration) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if until.After(holdUntil) {
+		holdUntil = until
+	}
+
+	deadline := time.Now().Add(timeout)
+	wake := time.AfterFunc(timeout, func() {
+		storeMutex.Lock()
+		txnDecided.Broadcast()
+		storeMutex.Unlock()
+	})
+	defer wake.Stop()
+
+	for len(prepared) > 0 && time.Now().Before(deadline) {
+		txnDecided.Wait()
+	}
+	if len(prepared) > 0 {
+		return ErrTxnsPrepared
+	}
+	return nil
+}
+
+//ReleasePrepares lets transactions be prepared again once a view change has finished
+func ReleasePrepares() {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	holdUntil = time.Time{}
+}
+
+//InDoubt returns the transactions prepared before the given time which are still waiting for a
+//decision, mapped to their coordinator
+func InDoubt(before time.Time) map[string]string {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	txns := make(map[string]string)
+	for id, p := range prepared {
+		if p.prepared.Before(before) {
+			txns[id] = p.coordinator
+		}
+	}
+	return txns
+}
+
+//Release the locks of a prepared transaction and forget it. Caller must hold storeMutex
+func (p *preparedTxn) release(id string) {
+	for _, key := range p.keys {
+		if locks[key] == id {
+			delete(locks, key)
+		}
+	}
+	delete(prepared, id)
+	txnDecided.Broadcast()
+}
+
+//Check that a key is not locked by a prepared transaction. Caller must hold storeMutex
+func checkLock(key string) error {
+	if _, locked := locks[key]; locked {
+		return ErrLocked
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package kvs
+
+import "time"
+
+//Types of events
+const (
+	EventSet    = "set"
+	EventDelete = "delete"
+	EventExpire = "expire"
+
+	//Keys moved to or from this node by a view change. Moves are only recorded in the change log
+	EventMoveIn  = "move-in"
+	EventMoveOut = "move-out"
+)
+
+//Event is a change to a key made on this node
+type Event struct {
+	Seq      uint64 //Position in the change log of this node
+	Type     string
+	Key      string
+	Value    string    //Empty unless the key was set
+	Revision uint64    //New revision of the key, deletes are given a revision too
+	Expires  time.Time //Zero unless the key was set or moved in with an expiry
+	Time     time.Time
+}
+
+//Subscription receives the events of the keys it matches. Events is closed once the subscription
+//is cancelled or if it fell too far behind, in which case events were lost
+type Subscription struct {
+	Events <-chan Event
+
+	events chan Event
+	match  func(key string) bool
+}
+
+//Subscriptions notified of every event
+var subscriptions = map[*Subscription]bool{}
+
+//Subscribe to the events of keys for which match returns true. Up to buffer events are kept for a
+//subscriber which is not keeping up before it is cancelled
+func Subscribe(match func(key string) bool, buffer int) *Subscription {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	events := make(chan Event, buffer)
+	s := &Subscription{Events: events, events: events, match: match}
+	subscriptions[s] = true
+	return s
+}
+
+//Cancel stops the subscription and closes its channel. It is safe to cancel a subscription twice
+func (s *Subscription) Cancel() {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	s.cancel()
+}
+
+//Caller must hold storeMutex
+func (s *Subscription) cancel() {
+	if subscriptions[s] {
+		delete(subscriptions, s)
+		close(s.events)
+	}
+}
+
+//Send an event to every subscription matching its key without waiting. Caller must hold storeMutex
+func notify(e Event) {
+	for s := range subscriptions {
+		if !s.match(e.Key) {
+			continue
+		}
+
+		select {
+		case s.events <- e:
+		default:
+			s.cancel()
+		}
+	}
+}
+
+//Remove a key deleted by a client or which expired and record the event. Caller must hold storeMutex
+func removeItem(partition Store, key string, eventType string) {
+	deleteItem(partition, key)
+	record(Event{Type: eventType, Key: key, Revision: nextRevision()})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//Body of join and leave requests
+type membershipRequest struct {
+	Address string `json:"address"`
+}
+
+//Returned when a node cannot join or leave the view
+var (
+	errAlreadyInView = errors.New("Node is already in view")
+	errNotInView     = errors.New("Node is not in view")
+	errLastNode      = errors.New("Cannot remove last node in view")
+)
+
+//Get the nodes of a view with a node added to the end
+func addNode(nodes []string, address string) ([]string, error) {
+	joined := make([]string, 0, len(nodes)+1)
+	for _, node := range nodes {
+		if node == address {
+			return nil, errAlreadyInView
+		}
+		joined = append(joined, node)
+	}
+	return append(joined, address), nil
+}
+
+//Get the nodes of a view with a node removed
+func removeNode(nodes []string, address string) ([]string, error) {
+	isInView := false
+	left := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node == address {
+			isInView = true
+		} else {
+			left = append(left, node)
+		}
+	}
+
+	if !isInView {
+		return nil, errNotInView
+	} else if len(left) == 0 {
+		return nil, errLastNode
+	}
+	return left, nil
+}
+
+//Check that a membership request carries the cluster secret
+func authenticate(r *http.Request) bool {
+	if MyConfig.Secret == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(MyConfig.Secret)) == 1
+}
+
+//Makes authenticated post request to a membership endpoint of another node. Returns the response status
+func postMembership(node string, path string, address string) (int, error) {
+	b, err := json.Marshal(membershipRequest{Address: address})
+	if err != nil {
+		return 0, err
+	}
+
+	uri := fmt.Sprintf("http://%s%s", node, path)
+	header := http.Header{"Authorization": {"Bearer " + MyConfig.Secret}}
+	res, err := sendInternal(context.Background(), http.MethodPost, uri, b, header, bulkPolicy(false))
+	if err != nil {
+		return 0, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+//Ask a seed node to add this node to its view, retrying with backoff while the seed is unavailable
+func joinCluster(seed string) {
+	log.Println("Joining view through", seed)
+	for attempt := 0; ; attempt++ {
+		status, err := postMembership(seed, "/kvs/join", MyAddress)
+		if err == nil {
+			return
+		}
+
+		switch status {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusConflict:
+			log.Println("Unable to join view:", err)
+			return
+		}
+		time.Sleep(backoff(attempt))
+	}
+}
+
+//Ask another node in the view to remove this node from the view
+func leaveCluster() error {
+	for _, node := range MyView.Nodes {
+		if node == MyAddress {
+			continue
+		}
+
+		_, err := postMembership(node, "/kvs/leave", MyAddress)
+		if err == nil {
+			return nil
+		}
+		log.Println(err)
+	}
+	return errors.New("No node was able to remove this node from the view")
+}
+
+//Leave the view gracefully when the process is stopped
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if AmActive && MyConfig.LeaveOnExit {
+		log.Println("Leaving view")
+		if err := leaveCluster(); err != nil {
+			log.Println("Unable to leave view:", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+//Read and authenticate a membership request. Writes the error status and returns false if invalid
+func readMembershipRequest(w http.ResponseWriter, r *http.Request, setupNodes bool) (string, bool) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return "", false
+	}
+
+	req := membershipRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+
+	address, err := normalizeEndpoint(req.Address, MyConfig.Port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		return "", false
+	}
+
+	//Nodes of the configured view were allowed in at setup, so they need no secret to ask for themselves
+	if !authenticate(r) && !(setupNodes && inSetupView(address) && fromEndpoint(r, address)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	return address, true
+}
+
+//Check if a node is in the view this node was configured to set up with
+func inSetupView(address string) bool {
+	if MyConfig.View == "" {
+		return false
+	}
+
+	for _, node := range strings.Split(MyConfig.View, ",") {
+		if node == address {
+			return true
+		}
+	}
+	return false
+}
+
+//Write the response to a membership request
+func writeMembershipResponse(w http.ResponseWriter, status int, message string, errorMessage string, shards []shardCount) {
+	b, err := json.Marshal(struct {
+		Message string       `json:"message"`
+		Error   string       `json:"error,omitempty"`
+		Shards  []shardCount `json:"shards,omitempty"`
+	}{Message: message, Error: errorMessage, Shards: shards})
+
+	if err == nil {
+		w.WriteHeader(status)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle external post request from a node asking to be added to the view, node acts as coordinator
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	address, ok := readMembershipRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	//The nodes are found once the view change holds the view so concurrent joins are not lost
+	shardCounts, err := coordinateViewChange(func(nodes []string) ([]string, error) {
+		return addNode(nodes, address)
+	})
+	if err == errAlreadyInView {
+		writeMembershipResponse(w, http.StatusConflict, "Error in join", err.Error(), nil)
+		return
+	} else if err == errTxnsPrepared {
+		writeMembershipResponse(w, http.StatusServiceUnavailable, "Error in join", err.Error(), nil)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Node joined", address)
+	writeMembershipResponse(w, http.StatusOK, "Node joined successfully", "", shardCounts)
+}
+
+//Handle external post request from a node asking to be removed from the view, node acts as coordinator
+func leaveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	address, ok := readMembershipRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	shardCounts, err := coordinateViewChange(func(nodes []string) ([]string, error) {
+		return removeNode(nodes, address)
+	})
+	if err == errNotInView {
+		writeMembershipResponse(w, http.StatusNotFound, "Error in leave", err.Error(), nil)
+		return
+	} else if err == errLastNode {
+		writeMembershipResponse(w, http.StatusConflict, "Error in leave", err.Error(), nil)
+		return
+	} else if err == errTxnsPrepared {
+		writeMembershipResponse(w, http.StatusServiceUnavailable, "Error in leave", err.Error(), nil)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Node left", address)
+	writeMembershipResponse(w, http.StatusOK, "Node left successfully", "", shardCounts)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddNode(t *testing.T) {
+	var tests = []struct {
+		name    string
+		nodes   []string
+		address string
+		want    []string
+		err     error
+	}{
+		{"Added to end", []string{"1", "2"}, "3", []string{"1", "2", "3"}, nil},
+		{"Added to empty view", []string{}, "1", []string{"1"}, nil},
+		{"Already in view", []string{"1", "2"}, "2", nil, errAlreadyInView},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := addNode(tt.nodes, tt.address)
+			if !reflect.DeepEqual(nodes, tt.want) || err != tt.err {
+				t.Errorf("Want: %v %v Got: %v %v", tt.want, tt.err, nodes, err)
+			}
+		})
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	var tests = []struct {
+		name    string
+		nodes   []string
+		address string
+		want    []string
+		err     error
+	}{
+		{"Removed from middle", []string{"1", "2", "3"}, "2", []string{"1", "3"}, nil},
+		{"Removed from end", []string{"1", "2"}, "2", []string{"1"}, nil},
+		{"Not in view", []string{"1", "2"}, "3", nil, errNotInView},
+		{"Last node", []string{"1"}, "1", nil, errLastNode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := removeNode(tt.nodes, tt.address)
+			if !reflect.DeepEqual(nodes, tt.want) || err != tt.err {
+				t.Errorf("Want: %v %v Got: %v %v", tt.want, tt.err, nodes, err)
+			}
+		})
+	}
+}
+
+func TestRemoveNodeKeepsView(t *testing.T) {
+	nodes := []string{"1", "2", "3"}
+	if _, err := removeNode(nodes, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodes, []string{"1", "2", "3"}) {
+		t.Errorf("Want: view unchanged Got: %v", nodes)
+	}
+}
+
+func TestInSetupView(t *testing.T) {
+	defer func(view string) { MyConfig.View = view }(MyConfig.View)
+
+	var tests = []struct {
+		name    string
+		view    string
+		address string
+		want    bool
+	}{
+		{"In view", "10.0.0.1:8080,10.0.0.2:8080", "10.0.0.2:8080", true},
+		{"Not in view", "10.0.0.1:8080,10.0.0.2:8080", "10.0.0.3:8080", false},
+		{"Other port", "10.0.0.1:8080", "10.0.0.1:8081", false},
+		{"Started with join", "", "10.0.0.1:8080", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MyConfig.View = tt.view
+			if got := inSetupView(tt.address); got != tt.want {
+				t.Errorf("Want: %v Got: %v", tt.want, got)
+			}
+		})
+	}
+}
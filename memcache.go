@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Largest value accepted from memcached clients, the default item size of memcached
+const maxMemcacheValueSize = 1024 * 1024
+
+//Exptimes up to 30 days are relative to now, larger exptimes are unix timestamps
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+//Command from a memcached client executed on the node owning the key. Values are bytes, sent as
+//base64, since memcached clients may store values which are not valid UTF-8
+type memcacheOp struct {
+	Command string `json:"command"`
+	Token   uint64 `json:"token"`
+	Key     string `json:"key"`
+	Value   []byte `json:"value,omitempty"`
+	Flags   uint32 `json:"flags,omitempty"`
+	Expires int64  `json:"expires,omitempty"` //Unix nanoseconds, 0 if the key never expires
+	CAS     uint64 `json:"cas,omitempty"`
+	Delta   uint64 `json:"delta,omitempty"`
+}
+
+//Result of a memcached command. Reply is the line sent to the client except for retrievals
+type memcacheResult struct {
+	Reply string `json:"reply"`
+	Found bool   `json:"found,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Flags uint32 `json:"flags,omitempty"`
+	CAS   uint64 `json:"cas,omitempty"`
+}
+
+//Returned by incr and decr when the value is not a number
+var errNotNumeric = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+//Accept memcached clients and serve their commands
+func serveMemcache(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleMemcacheConn(conn)
+	}
+}
+
+//Serve commands from a single client until it disconnects
+func handleMemcacheConn(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			writer.WriteString("ERROR\r\n")
+		} else if strings.ToLower(fields[0]) == "quit" {
+			writer.Flush()
+			return
+		} else if reply, err := runMemcacheCommand(ctx, reader, fields); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			fmt.Fprintf(writer, "%s\r\n", err.Error())
+		} else {
+			writer.WriteString(reply)
+		}
+
+		//Flush once all pipelined commands have been answered
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//Run a single command and return the reply. Errors are replied as their message
+func runMemcacheCommand(ctx context.Context, reader *bufio.Reader, fields []string) (string, error) {
+	command := strings.ToLower(fields[0])
+	args := fields[1:]
+
+	switch command {
+	case "version":
+		return "VERSION sharded-kvs\r\n", nil
+	case "get", "gets":
+		if len(args) == 0 {
+			return "", errors.New("ERROR")
+		}
+		return memcacheGet(ctx, args, command == "gets")
+	case "set", "add", "replace", "cas":
+		return memcacheStore(ctx, reader, command, args)
+	case "delete":
+		//A time of 0 is still accepted for compatibility with old clients
+		noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "0") {
+			return "", errors.New("CLIENT_ERROR bad command line format")
+		}
+		return replyUnless(noreply)(executeMemcacheOp(ctx, memcacheOp{Command: command, Key: args[0]}))
+	case "incr", "decr":
+		noreply := len(args) == 3 && args[2] == "noreply"
+		if len(args) != 2 && !noreply {
+			return "", errors.New("ERROR")
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "", errors.New("CLIENT_ERROR invalid numeric delta argument")
+		}
+		return replyUnless(noreply)(executeMemcacheOp(ctx, memcacheOp{Command: command, Key: args[0], Delta: delta}))
+	}
+	return "", errors.New("ERROR")
+}
+
+//Read the data block of a storage command and execute it
+func memcacheStore(ctx context.Context, reader *bufio.Reader, command string, args []string) (string, error) {
+	want := 4
+	if command == "cas" {
+		want = 5
+	}
+	noreply := len(args) == want+1 && args[want] == "noreply"
+	if len(args) != want && !noreply {
+		return "", errors.New("ERROR")
+	}
+
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return "", errors.New("CLIENT_ERROR bad command line format")
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "", errors.New("CLIENT_ERROR bad command line format")
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		return "", errors.New("CLIENT_ERROR bad command line format")
+	}
+
+	op := memcacheOp{Command: command, Key: args[0], Flags: uint32(flags), Expires: memcacheExpiry(exptime)}
+	if command == "cas" {
+		op.CAS, err = strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			return "", errors.New("CLIENT_ERROR bad command line format")
+		}
+	}
+
+	//Data block is always read so the connection stays in sync
+	if size > maxMemcacheValueSize {
+		if _, err := io.CopyN(ioutil.Discard, reader, int64(size)+2); err != nil {
+			return "", err
+		}
+		return "", errors.New("SERVER_ERROR object too large for cache")
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	} else if string(data[size:]) != "\r\n" {
+		return "", errors.New("CLIENT_ERROR bad data chunk")
+	}
+
+	op.Value = data[:size]
+	return replyUnless(noreply)(executeMemcacheOp(ctx, op))
+}
+
+//Get every key and reply with the values found
+func memcacheGet(ctx context.Context, keys []string, withCAS bool) (string, error) {
+	var b strings.Builder
+	for _, key := range keys {
+		res, err := executeMemcacheOp(ctx, memcacheOp{Command: "get", Key: key})
+		if err != nil {
+			return "", err
+		} else if !res.Found {
+			continue
+		}
+
+		if withCAS {
+			fmt.Fprintf(&b, "VALUE %s %d %d %d\r\n%s\r\n", key, res.Flags, len(res.Value), res.CAS, res.Value)
+		} else {
+			fmt.Fprintf(&b, "VALUE %s %d %d\r\n%s\r\n", key, res.Flags, len(res.Value), res.Value)
+		}
+	}
+	b.WriteString("END\r\n")
+	return b.String(), nil
+}
+
+//Convert the result of a command to its reply, which is empty if the client asked for no reply
+func replyUnless(noreply bool) func(memcacheResult, error) (string, error) {
+	return func(res memcacheResult, err error) (string, error) {
+		if err != nil {
+			return "", err
+		} else if noreply {
+			return "", nil
+		}
+		return res.Reply + "\r\n", nil
+	}
+}
+
+//Convert exptime of a command to unix nanoseconds. Negative exptimes expire immediately
+func memcacheExpiry(exptime int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return time.Now().UnixNano()
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second).UnixNano()
+	}
+	return time.Unix(exptime, 0).UnixNano()
+}
+
+//Execute command on the node owning the key
+func executeMemcacheOp(ctx context.Context, op memcacheOp) (memcacheResult, error) {
+	if !AmActive {
+		return memcacheResult{}, errors.New("SERVER_ERROR node is not in a view")
+	} else if len(op.Key) > MyConfig.MaxKeyLength {
+		return memcacheResult{}, errors.New("CLIENT_ERROR key is too long")
+	} else if strings.HasPrefix(op.Key, nsMarker) {
+		return memcacheResult{}, errors.New("CLIENT_ERROR key is reserved for namespaces")
+	}
+
+	token := MyView.FindToken(op.Key)
+	op.Token = token.Value
+	if token.Endpoint == MyAddress {
+		return applyMemcacheOp(op)
+	}
+
+	//Only commands with the same result when repeated are retried
+	idempotent := op.Command == "get" || op.Command == "set"
+	uri := fmt.Sprintf("http://%s/kvs/int/memcache", token.Endpoint)
+	res, err := internalRequest(ctx, http.MethodPost, uri, op, quickPolicy(idempotent))
+	if err != nil {
+		log.Println(err)
+		return memcacheResult{}, errors.New("SERVER_ERROR " + err.Error())
+	} else if res.StatusCode != http.StatusOK {
+		return memcacheResult{}, fmt.Errorf("SERVER_ERROR node %s returned status %d", token.Endpoint, res.StatusCode)
+	}
+
+	result := memcacheResult{}
+	err = json.Unmarshal(res.Body, &result)
+	if err != nil {
+		return result, errors.New("SERVER_ERROR " + err.Error())
+	}
+	return result, nil
+}
+
+//Execute command on the local partitions
+func applyMemcacheOp(op memcacheOp) (memcacheResult, error) {
+	var expires time.Time
+	if op.Expires != 0 {
+		expires = time.Unix(0, op.Expires)
+	}
+
+	var cond kvs.Condition
+	switch op.Command {
+	case "get":
+		value, meta, exists := kvs.GetItem(op.Token, op.Key)
+		return memcacheResult{Found: exists, Value: []byte(value), Flags: meta.Flags, CAS: meta.Revision}, nil
+	case "delete":
+		if err := kvs.Delete(op.Token, op.Key); err == kvs.ErrLocked {
+			return memcacheResult{}, errors.New("SERVER_ERROR " + err.Error())
+		} else if err != nil {
+			return memcacheResult{Reply: "NOT_FOUND"}, nil
+		}
+		return memcacheResult{Reply: "DELETED"}, nil
+	case "incr", "decr":
+		value, _, err := kvs.Update(op.Token, op.Key, func(value string) (string, error) {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return "", errNotNumeric
+			}
+
+			//Increments wrap around while decrements stop at 0
+			if op.Command == "incr" {
+				n += op.Delta
+			} else if op.Delta > n {
+				n = 0
+			} else {
+				n -= op.Delta
+			}
+			return strconv.FormatUint(n, 10), nil
+		})
+		if err == kvs.ErrNotFound {
+			return memcacheResult{Reply: "NOT_FOUND"}, nil
+		} else if err == errNotNumeric {
+			return memcacheResult{Reply: err.Error()}, nil
+		} else if err != nil {
+			return memcacheResult{}, errors.New("SERVER_ERROR " + err.Error())
+		}
+		return memcacheResult{Reply: value}, nil
+	case "add":
+		cond = func(exists bool, meta kvs.Meta) error {
+			if exists {
+				return kvs.ErrConditionNotMet
+			}
+			return nil
+		}
+	case "replace":
+		cond = func(exists bool, meta kvs.Meta) error {
+			if !exists {
+				return kvs.ErrConditionNotMet
+			}
+			return nil
+		}
+	case "cas":
+		cond = func(exists bool, meta kvs.Meta) error {
+			if !exists {
+				return kvs.ErrNotFound
+			} else if meta.Revision != op.CAS {
+				return kvs.ErrRevisionMismatched
+			}
+			return nil
+		}
+	case "set":
+	default:
+		return memcacheResult{}, errors.New("ERROR")
+	}
+
+	_, err := kvs.SetItem(op.Token, op.Key, string(op.Value), op.Flags, expires, cond)
+	switch err {
+	case nil:
+		return memcacheResult{Reply: "STORED"}, nil
+	case kvs.ErrConditionNotMet:
+		return memcacheResult{Reply: "NOT_STORED"}, nil
+	case kvs.ErrNotFound:
+		return memcacheResult{Reply: "NOT_FOUND"}, nil
+	case kvs.ErrRevisionMismatched:
+		return memcacheResult{Reply: "EXISTS"}, nil
+	}
+	return memcacheResult{}, errors.New("SERVER_ERROR " + err.Error())
+}
+
+//Handle internal post request with a memcached command for a key stored on this node
+func internalMemcacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	op := memcacheOp{}
+	err = json.Unmarshal(b, &op)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := applyMemcacheOp(op)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	b, err = json.Marshal(res)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kailask/sharded-kvs/kvs"
+
+	"github.com/gorilla/mux"
+)
+
+//Keys of a namespace are stored with the namespace between two nsMarker bytes in front of them, so
+//they are hashed with the namespace. Keys of the flat keyspace cannot start with nsMarker, which
+//keeps namespaces isolated from it and from each other
+const nsMarker = "\x00"
+
+//Namespace names only contain characters below 0x7f, so stored keys of namespaces sort before
+//nsScanStart and scans of the flat keyspace start from it
+const nsScanStart = nsMarker + "\x7f"
+
+//NamespaceConfig holds the settings of a namespace. Keys set without a TTL expire after the default
+//TTL in seconds and values longer than the max value size in bytes are rejected, unless they are 0
+type NamespaceConfig struct {
+	Name         string `json:"name" yaml:"name" toml:"name"`
+	DefaultTTL   int64  `json:"default-ttl,omitempty" yaml:"default-ttl" toml:"default-ttl"`
+	MaxValueSize int    `json:"max-value-size,omitempty" yaml:"max-value-size" toml:"max-value-size"`
+}
+
+//Key count of a namespace on a node, or the keys deleted and left locked when deleting it
+type namespaceShard struct {
+	KeyCount int `json:"key-count"`
+	Locked   int `json:"locked"`
+}
+
+//Check a namespace name, returning a message for the client if it is invalid
+func namespaceError(ns string, maxLength int) string {
+	if ns == "" {
+		return "Namespace is missing"
+	} else if len(ns) > maxLength {
+		return "Namespace is too long"
+	}
+
+	for _, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "Namespace can only contain letters, digits, '-', '_' and '.'"
+		}
+	}
+	return ""
+}
+
+//Check a key of the flat keyspace, returning a message for the client if it is invalid
+func keyError(key string) string {
+	if len(key) > MyConfig.MaxKeyLength {
+		return "Key is too long"
+	} else if strings.HasPrefix(key, nsMarker) {
+		return "Key is reserved for namespaces"
+	}
+	return ""
+}
+
+//Check that configured namespaces are valid and not configured twice
+func validateNamespaces(namespaces []NamespaceConfig, maxLength int) error {
+	names := make(map[string]bool)
+	for _, ns := range namespaces {
+		if msg := namespaceError(ns.Name, maxLength); msg != "" {
+			return fmt.Errorf("Invalid namespace %q: %s", ns.Name, msg)
+		} else if names[ns.Name] {
+			return fmt.Errorf("Namespace %q is configured twice", ns.Name)
+		} else if ns.DefaultTTL < 0 || ns.DefaultTTL > maxTTL {
+			return fmt.Errorf("Default TTL %d of namespace %q must be between 0 and %d seconds", ns.DefaultTTL, ns.Name, maxTTL)
+		} else if ns.MaxValueSize < 0 {
+			return fmt.Errorf("Max value size %d of namespace %q must not be negative", ns.MaxValueSize, ns.Name)
+		}
+		names[ns.Name] = true
+	}
+	return nil
+}
+
+//Settings of a namespace. Namespaces which are not configured have none
+func namespaceSettings(ns string) NamespaceConfig {
+	for _, settings := range MyConfig.Namespaces {
+		if settings.Name == ns {
+			return settings
+		}
+	}
+	return NamespaceConfig{Name: ns}
+}
+
+//Prefix of the stored keys of a namespace
+func namespacePrefix(ns string) string {
+	return nsMarker + ns + nsMarker
+}
+
+//Split a stored key into its namespace and key. The namespace is empty for keys of the flat keyspace
+func splitNamespace(stored string) (string, string) {
+	if !strings.HasPrefix(stored, nsMarker) {
+		return "", stored
+	}
+
+	rest := stored[len(nsMarker):]
+	end := strings.Index(rest, nsMarker)
+	if end < 0 {
+		return "", stored
+	}
+	return rest[:end], rest[end+len(nsMarker):]
+}
+
+//Get the stored key of a request for a key in the flat keyspace or in a namespace, along with the
+//settings of its namespace. Returns a message for the client if the key or namespace is invalid
+func requestKey(r *http.Request) (string, NamespaceConfig, string) {
+	key := pathVar(r, "key")
+	if _, inNamespace := mux.Vars(r)["ns"]; !inNamespace {
+		if strings.HasPrefix(key, nsMarker) {
+			return "", NamespaceConfig{}, "Key is reserved for namespaces"
+		}
+		return key, NamespaceConfig{}, ""
+	}
+
+	ns := pathVar(r, "ns")
+	if msg := namespaceError(ns, MyConfig.MaxKeyLength); msg != "" {
+		return "", NamespaceConfig{}, msg
+	}
+	return namespacePrefix(ns) + key, namespaceSettings(ns), ""
+}
+
+//Count or delete the keys of a namespace on every node in the view. Returns the result of each node
+func scatterNamespace(ctx context.Context, method string, ns string) (map[string]namespaceShard, error) {
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	var firstErr error
+	shards := make(map[string]namespaceShard, len(MyView.Nodes))
+
+	wg.Add(len(MyView.Nodes))
+	for _, node := range MyView.Nodes {
+		go func(node string) {
+			defer wg.Done()
+
+			shard, err := namespaceOnNode(ctx, method, node, ns)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			shards[node] = shard
+		}(node)
+	}
+	wg.Wait()
+
+	return shards, firstErr
+}
+
+//Count or delete the keys of a namespace on a single node
+func namespaceOnNode(ctx context.Context, method string, node string, ns string) (namespaceShard, error) {
+	if node == MyAddress {
+		return localNamespace(method, ns), nil
+	}
+
+	shard := namespaceShard{}
+	uri := fmt.Sprintf("http://%s/kvs/int/ns/%s", node, url.PathEscape(ns))
+	res, err := internalRequest(ctx, method, uri, nil, bulkPolicy(true))
+	if err != nil {
+		return shard, err
+	} else if res.StatusCode != http.StatusOK {
+		return shard, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+
+	err = json.Unmarshal(res.Body, &shard)
+	return shard, err
+}
+
+//Count or delete the keys of a namespace stored on this node
+func localNamespace(method string, ns string) namespaceShard {
+	if method == http.MethodDelete {
+		deleted, locked := kvs.DeletePrefix(namespacePrefix(ns))
+		return namespaceShard{KeyCount: deleted, Locked: locked}
+	}
+	return namespaceShard{KeyCount: kvs.CountPrefix(namespacePrefix(ns))}
+}
+
+//Handle external get request for the key count and settings of a namespace, or delete request for
+//every key of a namespace. Keys being moved by a view change while a namespace is deleted may be missed
+func namespaceHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ns := pathVar(r, "ns")
+	op := "NAMESPACE"
+	if r.Method == http.MethodDelete {
+		op = "DELETE"
+	}
+
+	res := struct {
+		Message      string       `json:"message"`
+		Error        string       `json:"error,omitempty"`
+		Namespace    string       `json:"namespace"`
+		KeyCount     int          `json:"key-count"`
+		Locked       int          `json:"locked,omitempty"`
+		Shards       []shardCount `json:"shards,omitempty"`
+		DefaultTTL   int64        `json:"default-ttl,omitempty"`
+		MaxValueSize int          `json:"max-value-size,omitempty"`
+	}{Namespace: ns}
+
+	if msg := namespaceError(ns, MyConfig.MaxKeyLength); msg != "" {
+		res.Error = msg
+		res.Message = "Error in " + op
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		shards, err := scatterNamespace(r.Context(), r.Method, ns)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for node, shard := range shards {
+			res.KeyCount += shard.KeyCount
+			res.Locked += shard.Locked
+			res.Shards = append(res.Shards, shardCount{Address: node, KeyCount: shard.KeyCount})
+		}
+
+		if r.Method == http.MethodGet {
+			settings := namespaceSettings(ns)
+			res.DefaultTTL, res.MaxValueSize = settings.DefaultTTL, settings.MaxValueSize
+			res.Message = "Namespace retrieved successfully"
+			w.WriteHeader(http.StatusOK)
+		} else if res.Locked > 0 {
+			res.Error = "Keys are locked by a transaction, delete the namespace again once it is decided"
+			res.Message = "Error in DELETE"
+			w.WriteHeader(http.StatusLocked)
+		} else {
+			res.Message = "Namespace deleted successfully"
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	b, err := json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
+
+//Handle internal get request for the number of keys of a namespace stored on this node, or delete
+//request for the keys of a namespace stored on this node
+func internalNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := json.Marshal(localNamespace(r.Method, pathVar(r, "ns")))
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
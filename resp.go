@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Limits on commands sent by Redis clients
+const (
+	maxRESPArgs     = 1024 * 1024
+	maxRESPBulkSize = 512 * 1024 * 1024
+)
+
+//Error replies to commands
+var (
+	errRESPSyntax    = errors.New("ERR syntax error")
+	errRESPInactive  = errors.New("ERR node is not in a view")
+	errRESPProtocol  = errors.New("ERR Protocol error")
+	errRESPKeyLength = errors.New("ERR key is too long")
+	errRESPReserved  = errors.New("ERR key is reserved for namespaces")
+	errRESPNotInt    = errors.New("ERR value is not an integer or out of range")
+	errRESPOverflow  = errors.New("ERR increment or decrement would overflow")
+	errRESPQuit      = errors.New("Client quit") //Closes the connection after replying
+)
+
+//Connection from a Redis client
+type respConn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	ctx    context.Context
+}
+
+//Command handler taking the arguments after the command name
+type respCommand struct {
+	arity   int //Minimum number of arguments
+	handler func(c *respConn, args []string) error
+}
+
+var respCommands = map[string]respCommand{
+	"PING":   {0, respPing},
+	"ECHO":   {1, respEcho},
+	"QUIT":   {0, respQuit},
+	"GET":    {1, respGet},
+	"SET":    {2, respSet},
+	"TTL":    {1, respTTL},
+	"DEL":    {1, respDel},
+	"INCR":   {1, respIncr},
+	"DECR":   {1, respDecr},
+	"INCRBY": {2, respIncrBy},
+	"DECRBY": {2, respDecrBy},
+	"EXISTS": {1, respExists},
+	"MGET":   {1, respMGet},
+	"MSET":   {2, respMSet},
+	"DBSIZE": {0, respDBSize},
+	"SCAN":   {1, respScan},
+}
+
+//Log an error from the cluster and convert it to an error reply
+func respInternalError(err error) error {
+	log.Println(err)
+	return errors.New("ERR " + err.Error())
+}
+
+//Accept Redis clients and serve their commands
+func serveRESP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRESPConn(conn)
+	}
+}
+
+//Serve commands from a single client until it disconnects
+func handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &respConn{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn), ctx: ctx}
+
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				c.writeError(errRESPProtocol)
+				c.writer.Flush()
+			}
+			return
+		} else if len(args) == 0 {
+			continue
+		}
+
+		err = c.execute(args)
+		if err == errRESPQuit {
+			c.writer.Flush()
+			return
+		} else if err != nil {
+			c.writeError(err)
+		}
+
+		//Flush once all pipelined commands have been answered
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//Run a single command, returning an error to reply with
+func (c *respConn) execute(args []string) error {
+	name := strings.ToUpper(args[0])
+	cmd, exists := respCommands[name]
+	if !exists {
+		return fmt.Errorf("ERR unknown command '%s'", args[0])
+	} else if len(args)-1 < cmd.arity {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	}
+
+	if !AmActive && name != "PING" && name != "ECHO" && name != "QUIT" {
+		return errRESPInactive
+	}
+
+	for _, key := range respKeys(name, args[1:]) {
+		if strings.HasPrefix(key, nsMarker) {
+			return errRESPReserved
+		}
+	}
+	return cmd.handler(c, args[1:])
+}
+
+//Keys given as arguments to a command
+func respKeys(name string, args []string) []string {
+	switch name {
+	case "PING", "ECHO", "QUIT", "DBSIZE", "SCAN":
+		return nil
+	case "DEL", "EXISTS", "MGET":
+		return args
+	case "MSET":
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return args[:1]
+}
+
+//Read a command sent as an array of bulk strings, or inline as used by telnet
+func (c *respConn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRESPArgs {
+		return nil, errRESPProtocol
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		} else if !strings.HasPrefix(line, "$") {
+			return nil, errRESPProtocol
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulkSize {
+			return nil, errRESPProtocol
+		}
+
+		//Bulk string is followed by CRLF
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+//Read a line without its line ending
+func (c *respConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *respConn) writeSimple(s string) {
+	fmt.Fprintf(c.writer, "+%s\r\n", s)
+}
+
+func (c *respConn) writeError(err error) {
+	fmt.Fprintf(c.writer, "-%s\r\n", err.Error())
+}
+
+func (c *respConn) writeInt(n int64) {
+	fmt.Fprintf(c.writer, ":%d\r\n", n)
+}
+
+func (c *respConn) writeBulk(s string) {
+	fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (c *respConn) writeNull() {
+	c.writer.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArrayHeader(n int) {
+	fmt.Fprintf(c.writer, "*%d\r\n", n)
+}
+
+func respPing(c *respConn, args []string) error {
+	if len(args) > 0 {
+		c.writeBulk(args[0])
+	} else {
+		c.writeSimple("PONG")
+	}
+	return nil
+}
+
+func respEcho(c *respConn, args []string) error {
+	c.writeBulk(args[0])
+	return nil
+}
+
+func respQuit(c *respConn, args []string) error {
+	c.writeSimple("OK")
+	return errRESPQuit
+}
+
+func respGet(c *respConn, args []string) error {
+	if value, _, exists, _ := routeGet(c.ctx, args[0]); exists {
+		c.writeBulk(value)
+	} else {
+		c.writeNull()
+	}
+	return nil
+}
+
+//Set a key, optionally expiring after EX seconds or PX milliseconds. Other options are not supported
+func respSet(c *respConn, args []string) error {
+	var expires time.Time
+	if len(args) == 4 && (strings.EqualFold(args[2], "EX") || strings.EqualFold(args[2], "PX")) {
+		unit := time.Second
+		if strings.EqualFold(args[2], "PX") {
+			unit = time.Millisecond
+		}
+
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || n < 1 || n > maxTTL*int64(time.Second/unit) {
+			return errors.New("ERR invalid expire time in 'set' command")
+		}
+		expires = time.Now().Add(time.Duration(n) * unit)
+	} else if len(args) != 2 {
+		return errRESPSyntax
+	}
+
+	if len(args[0]) > MyConfig.MaxKeyLength {
+		return errRESPKeyLength
+	}
+
+	if _, _, _, err := routeSet(c.ctx, args[0], args[1], expires, nil); err != nil {
+		return respInternalError(err)
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+//Reply with the seconds until a key expires, -1 if it never expires or -2 if it does not exist
+func respTTL(c *respConn, args []string) error {
+	if len(args) != 1 {
+		return errRESPSyntax
+	}
+
+	_, meta, exists, _ := routeGet(c.ctx, args[0])
+	switch {
+	case !exists:
+		c.writeInt(-2)
+	case meta.Expires.IsZero():
+		c.writeInt(-1)
+	default:
+		c.writeInt(ttlRemaining(meta.Expires))
+	}
+	return nil
+}
+
+func respDel(c *respConn, args []string) error {
+	deleted := 0
+	for _, key := range args {
+		if _, err := routeDelete(c.ctx, key, nil); err == nil {
+			deleted++
+		}
+	}
+	c.writeInt(int64(deleted))
+	return nil
+}
+
+func respIncr(c *respConn, args []string) error {
+	return respIncrement(c, args, 1)
+}
+
+func respDecr(c *respConn, args []string) error {
+	return respIncrement(c, args, -1)
+}
+
+func respIncrBy(c *respConn, args []string) error {
+	if len(args) != 2 {
+		return errRESPSyntax
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errRESPNotInt
+	}
+	return respIncrement(c, args[:1], delta)
+}
+
+func respDecrBy(c *respConn, args []string) error {
+	if len(args) != 2 {
+		return errRESPSyntax
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || delta == math.MinInt64 {
+		return errRESPNotInt
+	}
+	return respIncrement(c, args[:1], -delta)
+}
+
+//Add delta to the integer value of a key on the node owning it, treating missing keys as 0
+func respIncrement(c *respConn, args []string, delta int64) error {
+	if len(args) != 1 {
+		return errRESPSyntax
+	} else if len(args[0]) > MyConfig.MaxKeyLength {
+		return errRESPKeyLength
+	}
+
+	value, _, _, err := routeIncr(c.ctx, args[0], delta)
+	switch err {
+	case nil:
+		c.writeInt(value)
+		return nil
+	case kvs.ErrNotInteger:
+		return errRESPNotInt
+	case kvs.ErrOverflow:
+		return errRESPOverflow
+	}
+	return respInternalError(err)
+}
+
+func respExists(c *respConn, args []string) error {
+	found := 0
+	for _, key := range args {
+		if _, _, exists, _ := routeGet(c.ctx, key); exists {
+			found++
+		}
+	}
+	c.writeInt(int64(found))
+	return nil
+}
+
+func respMGet(c *respConn, args []string) error {
+	c.writeArrayHeader(len(args))
+	for _, key := range args {
+		if value, _, exists, _ := routeGet(c.ctx, key); exists {
+			c.writeBulk(value)
+		} else {
+			c.writeNull()
+		}
+	}
+	return nil
+}
+
+//Set several keys. Keys may be on different nodes so the command is not atomic
+func respMSet(c *respConn, args []string) error {
+	if len(args)%2 != 0 {
+		return errors.New("ERR wrong number of arguments for 'mset' command")
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if len(args[i]) > MyConfig.MaxKeyLength {
+			return errRESPKeyLength
+		}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if _, _, _, err := routeSet(c.ctx, args[i], args[i+1], time.Time{}, nil); err != nil {
+			return respInternalError(err)
+		}
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+func respDBSize(c *respConn, args []string) error {
+	shards, err := getKeyCounts(c.ctx)
+	if err != nil {
+		return respInternalError(err)
+	}
+
+	total := 0
+	for _, shard := range shards {
+		total += shard.KeyCount
+	}
+	c.writeInt(int64(total))
+	return nil
+}
+
+//Check if a key matches a glob pattern like Redis does. * matches any characters including '/', ?
+//matches one character, [abc], [^abc] and [a-z] match one character of a set and \ escapes the
+//next character. Patterns are matched byte by byte and a class left open is closed at the end
+func globMatch(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+
+			i := 1
+			negate := i < len(pattern) && pattern[i] == '^'
+			if negate {
+				i++
+			}
+
+			matched := false
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' && i+1 < len(pattern) {
+					i++
+					matched = matched || pattern[i] == key[0]
+				} else if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+					low, high := pattern[i], pattern[i+2]
+					if low > high {
+						low, high = high, low
+					}
+					matched = matched || (key[0] >= low && key[0] <= high)
+					i += 2
+				} else {
+					matched = matched || pattern[i] == key[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+
+			key = key[1:]
+			if i == len(pattern) {
+				i--
+			}
+			pattern = pattern[i:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
+
+//Iterate over keys one token of the ring at a time. The cursor is the value of the next token plus
+//one so cursor 0 starts and ends the iteration. Like Redis a key may be returned more than once,
+//and keys of a removed token may be missed if the view changes during the iteration
+func respScan(c *respConn, args []string) error {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errors.New("ERR invalid cursor")
+	}
+
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errRESPSyntax
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return errRESPSyntax
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	tokens := MyView.Tokens
+	i := 0
+	if cursor > 0 {
+		i = sort.Search(len(tokens), func(i int) bool { return tokens[i].Value >= cursor-1 })
+	}
+
+	keys := []string{}
+	examined := 0
+	for ; i < len(tokens) && examined < count; i++ {
+		tokenKeys, err := getTokenKeys(c.ctx, tokens[i])
+		if err != nil {
+			return respInternalError(err)
+		}
+
+		examined += len(tokenKeys)
+		for _, key := range tokenKeys {
+			if globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	next := "0"
+	if i < len(tokens) {
+		next = strconv.FormatUint(tokens[i].Value+1, 10)
+	}
+
+	c.writeArrayHeader(2)
+	c.writeBulk(next)
+	c.writeArrayHeader(len(keys))
+	for _, key := range keys {
+		c.writeBulk(key)
+	}
+	return nil
+}
+
+//Get the keys of the flat keyspace stored under a token on this node. Keys of namespaces are left out
+//since they cannot be used by clients of the flat keyspace
+func localTokenKeys(token uint64) []string {
+	keys := []string{}
+	for _, key := range kvs.Keys(token) {
+		if !strings.HasPrefix(key, nsMarker) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+//Get the keys of the flat keyspace stored under a token from the node owning it
+func getTokenKeys(ctx context.Context, token kvs.Token) ([]string, error) {
+	if token.Endpoint == MyAddress {
+		return localTokenKeys(token.Value), nil
+	}
+
+	uri := fmt.Sprintf("http://%s/kvs/int/keys?token=%d", token.Endpoint, token.Value)
+	res, err := internalRequest(ctx, http.MethodGet, uri, nil, quickPolicy(true))
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Node %s returned status %d", token.Endpoint, res.StatusCode)
+	}
+
+	keys := []string{}
+	err = json.Unmarshal(res.Body, &keys)
+	return keys, err
+}
+
+//Handle internal get request for the keys of the flat keyspace stored under a token
+func internalKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Partition may not exist yet while a view change is in progress
+	b, err := json.Marshal(localTokenKeys(token))
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
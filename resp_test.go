@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		key     string
+		matched bool
+	}{
+		{"*", "", true},
+		{"*", "users/42", true},
+		{"user*", "users/42", true},
+		{"*/42", "users/42", true},
+		{"user*42", "users/1/42", true},
+		{"user*", "admin", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[ab", "ha", true},
+		{"**a", "bba", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, tt := range tests {
+		if matched := globMatch(tt.pattern, tt.key); matched != tt.matched {
+			t.Errorf("%q %q: Want: %v Got: %v", tt.pattern, tt.key, tt.matched, matched)
+		}
+	}
+}
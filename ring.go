@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Token in the ring with its share of the hash space and number of stored keys
+type ringToken struct {
+	Endpoint  string  `json:"endpoint"`
+	Value     uint64  `json:"value"`
+	Ownership float64 `json:"ownership"`
+	KeyCount  int     `json:"key-count"`
+}
+
+//Node in the ring with its total share of the hash space and number of stored keys
+type ringNode struct {
+	Address   string  `json:"address"`
+	Ownership float64 `json:"ownership"`
+	Tokens    int     `json:"tokens"`
+	KeyCount  int     `json:"key-count"`
+}
+
+//Get key counts of every token from all nodes in the view
+func getTokenCounts(ctx context.Context) (map[uint64]int, error) {
+	var wg sync.WaitGroup
+	wg.Add(len(MyView.Nodes))
+	var mutex = &sync.Mutex{}
+	counts := make(map[uint64]int)
+	nodesCounted := make(map[string]bool)
+	for _, node := range MyView.Nodes {
+		go getNodeTokenCounts(ctx, &wg, mutex, node, counts, nodesCounted)
+	}
+	wg.Wait()
+
+	if len(nodesCounted) == len(MyView.Nodes) {
+		return counts, nil
+	}
+	return nil, errors.New("Not all token counts were found")
+}
+
+//Get key counts of every token stored on a single node
+func getNodeTokenCounts(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, counts map[uint64]int, nodesCounted map[string]bool) {
+	defer wg.Done()
+
+	nodeCounts := make(map[uint64]int)
+	if node == MyAddress {
+		nodeCounts = kvs.TokenKeyCounts()
+	} else {
+		uri := fmt.Sprintf("http://%s/kvs/int/token-counts", node)
+		res, err := internalRequest(ctx, http.MethodGet, uri, nil, quickPolicy(true))
+		if err != nil || res.StatusCode != http.StatusOK {
+			return
+		}
+
+		err = json.Unmarshal(res.Body, &nodeCounts)
+		if err != nil {
+			return
+		}
+	}
+
+	mutex.Lock()
+	for token, count := range nodeCounts {
+		counts[token] = count
+	}
+	nodesCounted[node] = true
+	mutex.Unlock()
+}
+
+//Handle internal get request for the key counts of the node's tokens
+func internalTokenCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := json.Marshal(kvs.TokenKeyCounts())
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle external get request for the token layout and balance of the ring
+func ringHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	counts, err := getTokenCounts(r.Context())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tokens := make([]ringToken, len(MyView.Tokens))
+	nodes := make(map[string]*ringNode, len(MyView.Nodes))
+	for _, node := range MyView.Nodes {
+		nodes[node] = &ringNode{Address: node}
+	}
+
+	for i, ownership := range MyView.TokenOwnership() {
+		t := MyView.Tokens[i]
+		tokens[i] = ringToken{Endpoint: t.Endpoint, Value: t.Value, Ownership: ownership, KeyCount: counts[t.Value]}
+		if n, exists := nodes[t.Endpoint]; exists {
+			n.Ownership += ownership
+			n.Tokens++
+			n.KeyCount += counts[t.Value]
+		}
+	}
+
+	nodeArray := make([]ringNode, 0, len(nodes))
+	for _, node := range MyView.Nodes {
+		nodeArray = append(nodeArray, *nodes[node])
+	}
+
+	b, err := json.Marshal(struct {
+		Message         string      `json:"message"`
+		Nodes           []ringNode  `json:"nodes"`
+		Tokens          []ringToken `json:"tokens"`
+		OwnershipStdDev float64     `json:"ownership-stddev"`
+	}{
+		Message:         "Ring retrieved successfully",
+		Nodes:           nodeArray,
+		Tokens:          tokens,
+		OwnershipStdDev: MyView.OwnershipStdDev(),
+	})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle external post request to simulate a view change without applying it
+func ringSimulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := struct {
+		View string `json:"view"`
+	}{}
+	err = json.Unmarshal(b, &req)
+	if err != nil || req.View == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := parseView(req.View, MyConfig.Port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	counts, err := getTokenCounts(r.Context())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//Tokens for added nodes are random so the result is one possible outcome
+	proposed := MyView.Copy()
+	changes, addedNodes := proposed.ChangeView(nodes)
+
+	added := make([]string, 0, len(addedNodes))
+	for node := range addedNodes {
+		added = append(added, node)
+	}
+	sort.Strings(added)
+
+	removed := []string{}
+	for node, c := range changes {
+		if c.Removed {
+			removed = append(removed, node)
+		}
+	}
+	sort.Strings(removed)
+
+	b, err = json.Marshal(struct {
+		Message         string                 `json:"message"`
+		Changes         map[string]*kvs.Change `json:"changes"`
+		Added           []string               `json:"added"`
+		Removed         []string               `json:"removed"`
+		KeysMoved       int                    `json:"keys-moved"`
+		OwnershipStdDev float64                `json:"ownership-stddev"`
+	}{
+		Message:         "View change simulated successfully",
+		Changes:         changes,
+		Added:           added,
+		Removed:         removed,
+		KeysMoved:       MyView.EstimateKeysMoved(&proposed, counts),
+		OwnershipStdDev: proposed.OwnershipStdDev(),
+	})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
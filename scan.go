@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Keys returned in a page of a scan unless a limit is given, and the largest limit accepted
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+//Get up to limit sorted keys with a prefix after the given key from every node in the view. Returns
+//the keys and if there are more keys after them
+func scatterScan(ctx context.Context, prefix string, after string, limit int) ([]string, bool, error) {
+	//Keys of namespaces are not part of the flat keyspace
+	if strings.HasPrefix(prefix, nsMarker) {
+		return []string{}, false, nil
+	} else if prefix == "" && after < nsScanStart {
+		after = nsScanStart
+	}
+
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	var firstErr error
+	keys := []string{}
+
+	//One more key than the limit is requested from each node to tell if there is another page
+	wg.Add(len(MyView.Nodes))
+	for _, node := range MyView.Nodes {
+		go func(node string) {
+			defer wg.Done()
+
+			nodeKeys, err := scanNode(ctx, node, prefix, after, limit+1)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			keys = append(keys, nodeKeys...)
+		}(node)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, false, firstErr
+	}
+
+	//Keys being moved during a view change may be returned by two nodes
+	sort.Strings(keys)
+	unique := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+
+	if len(unique) > limit {
+		return unique[:limit], true, nil
+	}
+	return unique, false, nil
+}
+
+//Get up to limit sorted keys with a prefix after the given key from the partitions of a single node
+func scanNode(ctx context.Context, node string, prefix string, after string, limit int) ([]string, error) {
+	if node == MyAddress {
+		return kvs.Scan(prefix, after, limit), nil
+	}
+
+	query := url.Values{"prefix": {prefix}, "after": {after}, "limit": {strconv.Itoa(limit)}}
+	uri := fmt.Sprintf("http://%s/kvs/int/scan?%s", node, query.Encode())
+	res, err := internalRequest(ctx, http.MethodGet, uri, nil, quickPolicy(true))
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+
+	keys := []string{}
+	err = json.Unmarshal(res.Body, &keys)
+	return keys, err
+}
+
+//Handle external get request for a page of keys with a prefix. The cursor is the encoded last key
+//of the previous page so it stays valid when the view changes, although keys being moved by a view
+//change during the scan may be missed
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	res := struct {
+		Message string   `json:"message"`
+		Error   string   `json:"error,omitempty"`
+		Keys    []string `json:"keys"`
+		Cursor  string   `json:"cursor,omitempty"`
+	}{}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit := defaultScanLimit
+	var after []byte
+	var err error
+
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxScanLimit {
+			res.Error = fmt.Sprintf("Limit must be between 1 and %d", maxScanLimit)
+		}
+	}
+	if res.Error == "" {
+		after, err = base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+		if err != nil {
+			res.Error = "Cursor is invalid"
+		}
+	}
+
+	if res.Error != "" {
+		res.Message = "Error in SCAN"
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		keys, more, err := scatterScan(r.Context(), prefix, string(after), limit)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res.Message = "Keys retrieved successfully"
+		res.Keys = keys
+		if more {
+			res.Cursor = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, err := json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
+
+//Handle internal get request for the sorted keys with a prefix stored on this node
+func internalScanHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, err := json.Marshal(kvs.Scan(query.Get("prefix"), query.Get("after"), limit))
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
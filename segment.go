@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Routine to send a segment of a removed partition to the node owning its keys. If the node does not
+//accept it the keys are read from the segment and pushed like any other reshard
+func pushSegment(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, t kvs.SegmentTransfer, successfulTransfers map[string]bool) {
+	defer wg.Done()
+
+	err := sendSegment(ctx, t)
+	if err != nil {
+		log.Println(err)
+
+		shard, err := kvs.ReadSegment(t.Path)
+		if err != nil {
+			log.Println(err)
+			log.Printf("Keys of token %d left in %s\n", t.Token.Value, t.Path)
+			return
+		}
+
+		token := strconv.FormatUint(t.Token.Value, 10)
+		results := make(map[string]bool)
+		var pushWg sync.WaitGroup
+		pushWg.Add(1)
+		pushReshard(ctx, &pushWg, &sync.Mutex{}, t.Token.Endpoint, map[string]*kvs.Shard{token: shard}, results)
+		if !results[t.Token.Endpoint] {
+			log.Printf("Keys of token %d left in %s\n", t.Token.Value, t.Path)
+			return
+		}
+	}
+
+	t.Remove()
+	mutex.Lock()
+	successfulTransfers[t.Path] = true
+	mutex.Unlock()
+}
+
+//Stream a segment file to the node owning its token. The path is versioned by the segment format so
+//a node reading another format returns 404 and the keys are pushed instead
+func sendSegment(ctx context.Context, t kvs.SegmentTransfer) error {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bulkPolicy(true).timeout)
+	defer cancel()
+
+	uri := fmt.Sprintf("http://%s/kvs/int/segment/v2/%d", t.Token.Endpoint, t.Token.Value)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	setTimeoutHeader(req)
+
+	res, err := internalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Node %s returned status %d for segment of token %d", t.Token.Endpoint, res.StatusCode, t.Token.Value)
+	}
+	return nil
+}
+
+//Handle internal post request with a segment file holding the keys of a partition removed from
+//another node
+func internalSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	token, err := strconv.ParseUint(mux.Vars(r)["token"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f, err := ioutil.TempFile(os.TempDir(), "kvs-segment-")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	start := time.Now()
+	_, err = io.Copy(f, r.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	//The segment is moved into the partition so it is only removed here if it was not ingested
+	err = kvs.IngestSegment(token, f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Received segment of token %d in %v\n", token, time.Since(start))
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,33 +1,43 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/kailask/sharded-kvs/kvs"
+	"github.com/kailask/sharded-kvs/rpc"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-//Port number for all nodes in system
-const Port = "13800"
-
 //Global node state
 var (
 	MyView                = &kvs.View{} //Node's current view
 	AmActive              = false       //Is node currently active?
 	Setup     *setupState = nil         //Used if node is coordinating setup
+	MyConfig  *Config     = defaultConfig()
 	MyAddress string
+
+	viewChangeMutex = &sync.Mutex{} //Prevents concurrent view changes coordinated by this node
+	setupMutex      = &sync.Mutex{} //Guards setup state while nodes join
 )
 
 //Contains data for propogating an initial view to a newly added node
@@ -36,15 +46,54 @@ type viewInit struct {
 	Changes kvs.Change `json:"changes"`
 }
 
-//Used only during setup by first node
+//Used only during setup by the setup coordinator
 type setupState struct {
 	initialChanges map[string]*kvs.Change
 	joinedNodes    map[string]bool
+	epoch          uint64 //Epoch of the initial view, the changes are stale once it changes
+}
+
+//Setup status of a node used to elect a setup coordinator
+type nodeStatus struct {
+	Active       bool `json:"active"`
+	Coordinating bool `json:"coordinating"`
 }
 
+//Returned when the setup coordinator will not let this node join
+var errSetupRejected = errors.New("Setup coordinator rejected node")
+
+//Returned by a new node asked to change its view without its changes
+var errMissingChanges = errors.New("New node requires its changes to join the view")
+
 //Struct containing a value used in get and set handlers
 type keyValue struct {
-	Value *string `json:"value"`
+	Value  *string `json:"value"`
+	Binary []byte  `json:"binary,omitempty"` //Value which is not valid UTF-8, sent as base64 between nodes
+
+	TTL     *int64 `json:"ttl,omitempty"`     //Seconds until the key expires, given by clients
+	Expires int64  `json:"expires,omitempty"` //Unix nanoseconds the key expires at, sent between nodes
+
+	Revision     uint64            `json:"revision,omitempty"`
+	Precondition *kvs.Precondition `json:"precondition,omitempty"`
+}
+
+//Make a key value carrying a value between nodes. JSON strings would replace the invalid bytes of
+//values which are not valid UTF-8, so those are sent as binary
+func internalKeyValue(value string) keyValue {
+	if utf8.ValidString(value) {
+		return keyValue{Value: &value}
+	}
+	return keyValue{Binary: []byte(value)}
+}
+
+//Get the value carried by a key value, false if it has none
+func (v keyValue) value() (string, bool) {
+	if v.Binary != nil {
+		return string(v.Binary), true
+	} else if v.Value != nil {
+		return *v.Value, true
+	}
+	return "", false
 }
 
 //Key count struct used in building response to view change
@@ -81,6 +130,13 @@ func (rw *responseWriter) WriteHeader(code int) {
 	return
 }
 
+//Flush sends buffered data to the client so responses can be streamed
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -106,108 +162,351 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+//Normalize a node endpoint to host:port form, adding the default port if it is missing.
+//Hosts may be IP addresses, DNS names or bracketed IPv6 literals
+func normalizeEndpoint(endpoint string, defaultPort string) (string, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		//Assume only the host was given
+		host, port = strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]"), defaultPort
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("Endpoint %q is missing a host", endpoint)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return "", fmt.Errorf("Endpoint %q has an invalid port", endpoint)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+//Get a variable of the request path. The router matches escaped paths so keys may contain slashes,
+//leaving variables to be unescaped here
+func pathVar(r *http.Request, name string) string {
+	v := mux.Vars(r)[name]
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+//Check that an advertised endpoint belongs to the node a request came from. The full host:port is
+//compared when the request came from the endpoint's port. Otherwise the connection's port is
+//ephemeral and the host only identifies the node if no other node of the configured view is on it,
+//since any of several nodes on one host could claim to be another and must send the secret instead
+func fromEndpoint(r *http.Request, endpoint string) bool {
+	remoteHost, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+
+	remoteIP := net.ParseIP(remoteHost)
+	if !onHost(endpoint, remoteIP) {
+		return false
+	} else if remotePort == port || MyConfig.View == "" {
+		return true
+	}
+
+	for _, node := range strings.Split(MyConfig.View, ",") {
+		if node != endpoint && onHost(node, remoteIP) {
+			return false
+		}
+	}
+	return true
+}
+
+//Check if the host of an endpoint is the given IP. Host names are resolved
+func onHost(endpoint string, ip net.IP) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if hostIP := net.ParseIP(host); hostIP != nil {
+		return hostIP.Equal(ip)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, hostIP := range ips {
+		if hostIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Parse a comma separated list of endpoints into a view node list
+func parseView(view string, defaultPort string) ([]string, error) {
+	nodes := strings.Split(view, ",")
+	seen := make(map[string]bool, len(nodes))
+	for i, node := range nodes {
+		endpoint, err := normalizeEndpoint(node, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		if seen[endpoint] {
+			return nil, fmt.Errorf("Endpoint %q is in the view more than once", endpoint)
+		}
+
+		seen[endpoint] = true
+		nodes[i] = endpoint
+	}
+	return nodes, nil
+}
+
 //Registers node as joined during initial setup and ends setup if all nodes are joined
 func (s *setupState) nodeJoined(node string) {
 	s.joinedNodes[node] = true
 	if len(s.joinedNodes) == len(MyView.Nodes) {
-		MyView.Reshard(*Setup.initialChanges[MyAddress])
-		AmActive = true
+		s.activate()
 		Setup = nil
+	}
+}
+
+//Start serving the initial view
+func (s *setupState) activate() {
+	if !AmActive {
+		MyView.Reshard(*s.initialChanges[MyAddress])
+		AmActive = true
 		log.Println("Setup complete")
 	}
 }
 
-//Used to start setup if current node is first in list
-func coordinateSetup(nodes []string) {
-	//Remove port numbers
-	for i, node := range nodes {
-		nodes[i] = strings.Split(node, ":")[0]
+//Stop waiting for nodes which have not joined by the setup deadline. They can still join later
+//and take their tokens until the view changes
+func (s *setupState) expire() {
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
+
+	if Setup != s {
+		return
+	}
+
+	missing := []string{}
+	for _, node := range MyView.Nodes {
+		if !s.joinedNodes[node] {
+			missing = append(missing, node)
+		}
 	}
+	log.Println("Setup timed out waiting for", missing)
+	s.activate()
+}
+
+//Used to start setup if current node is the elected setup coordinator
+func coordinateSetup(nodes []string) {
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
 
 	//Initialize local view
 	initialChanges, _ := MyView.ChangeView(nodes)
 
 	joinedNodes := make(map[string]bool)
-	Setup = &setupState{initialChanges, joinedNodes}
-	Setup.nodeJoined(MyAddress)
+	s := &setupState{initialChanges, joinedNodes, MyView.Epoch}
+	Setup = s
+	s.nodeJoined(MyAddress)
+	if Setup == s {
+		time.AfterFunc(MyConfig.setupTimeout, s.expire)
+	}
 }
 
-//Try to join the view with the given leader
-func joinView(leader string) {
-	uri := fmt.Sprintf("http://%s/kvs/int/init", leader)
-	res, err := http.Get(uri)
-	if err == nil && res.StatusCode == http.StatusOK {
-		if res.Body != nil {
-			defer res.Body.Close()
+//Delay before retrying a request for the given attempt, doubling up to a maximum
+func backoff(attempt int) time.Duration {
+	delay := MyConfig.retryBackoff
+	for i := 0; i < attempt && delay < MyConfig.maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MyConfig.maxRetryBackoff {
+		delay = MyConfig.maxRetryBackoff
+	}
+	return delay
+}
+
+//Join the initial view. Candidates for setup coordinator are tried in view order and the next
+//candidate is elected if the current one stays unreachable for the setup timeout
+func setupView(nodes []string) {
+	for i, candidate := range nodes {
+		if candidate == MyAddress {
+			//Earlier candidates may have come up after all and finished setup without me
+			if node := findSetupNode(nodes); node != "" {
+				log.Println("Setup is already coordinated by", node)
+				joinCluster(node)
+				return
+			}
+
+			log.Println("Node coordinating setup")
+			coordinateSetup(nodes[i:])
+			return
 		}
 
-		b, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Fatalln(err)
+		err := joinView(candidate, MyConfig.setupTimeout)
+		if err == nil {
+			return
+		} else if err == errSetupRejected {
+			log.Println("Unable to join view")
+			return
 		}
+		log.Printf("Setup coordinator %s is unreachable: %v\n", candidate, err)
+	}
+	log.Println("Unable to join view")
+}
 
-		v := viewInit{}
-		err = json.Unmarshal(b, &v)
-		if err != nil {
-			log.Fatalln(err)
+//Find another node in the view that is already active or coordinating setup
+func findSetupNode(nodes []string) string {
+	for _, node := range nodes {
+		if node == MyAddress {
+			continue
 		}
 
-		*MyView = v.View
-		MyView.Reshard(v.Changes)
-		AmActive = true
+		uri := fmt.Sprintf("http://%s/kvs/int/status", node)
+		res, err := internalRequest(context.Background(), http.MethodGet, uri, nil, quickPolicy(true))
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
 
-		log.Println("Joined view")
+		status := nodeStatus{}
+		if json.Unmarshal(res.Body, &status) == nil && (status.Active || status.Coordinating) {
+			return node
+		}
+	}
+	return ""
+}
+
+//Try to join the view with the given leader, retrying with backoff until it is unreachable for longer than timeout
+func joinView(leader string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	uri := fmt.Sprintf("http://%s/kvs/int/init?address=%s", leader, url.QueryEscape(MyAddress))
+	var header http.Header
+	if MyConfig.Secret != "" {
+		header = http.Header{"Authorization": {"Bearer " + MyConfig.Secret}}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := sendInternal(context.Background(), http.MethodGet, uri, nil, header, quickPolicy(false))
+		if err == nil {
+			switch res.StatusCode {
+			case http.StatusOK:
+				v := viewInit{}
+				err = json.Unmarshal(res.Body, &v)
+				if err != nil {
+					log.Fatalln(err)
+				}
+
+				*MyView = v.View
+				MyView.Reshard(v.Changes)
+				AmActive = true
+
+				log.Println("Joined view")
+				return nil
+			case http.StatusForbidden, http.StatusConflict:
+				return errSetupRejected
+			}
+
+			//Leader is up but not coordinating yet
+			deadline = time.Now().Add(timeout)
+		} else if time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(backoff(attempt))
+	}
+}
+
+//Handle internal request for the node's setup status
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	setupMutex.Lock()
+	status := nodeStatus{Active: AmActive, Coordinating: Setup != nil}
+	setupMutex.Unlock()
+
+	b, err := json.Marshal(status)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
 	} else {
-		log.Println("Unable to join view")
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
 	}
 }
 
 //Handle internal setup request to join view
 func initHandler(w http.ResponseWriter, r *http.Request) {
-	if !AmActive && Setup != nil {
-		remoteAddress := strings.Split(r.RemoteAddr, ":")[0]
-		isInView := false
-
-		for _, endpoint := range MyView.Nodes {
-			if endpoint == remoteAddress {
-				isInView = true
-				break
-			}
+	//Nodes identify themselves by their advertised endpoint since the connection's port is ephemeral.
+	//The endpoint must belong to the node the request came from unless the request carries the secret
+	remoteAddress, err := normalizeEndpoint(r.URL.Query().Get("address"), MyConfig.Port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if !authenticate(r) && !fromEndpoint(r, remoteAddress) {
+		log.Printf("Setup request from %s claimed to be %s, nodes sharing a host must be given the secret\n", r.RemoteAddr, remoteAddress)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
+
+	if Setup != nil && Setup.epoch != MyView.Epoch {
+		//The view changed after setup timed out so the remaining initial changes are stale
+		Setup = nil
+	}
+
+	if Setup == nil && AmActive {
+		//Setup is already complete
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if Setup == nil {
+		//Not coordinating setup, at least not yet
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	isInView := false
+
+	for _, endpoint := range MyView.Nodes {
+		if endpoint == remoteAddress {
+			isInView = true
+			break
 		}
+	}
 
-		if isInView {
-			viewToSend := viewInit{View: *MyView, Changes: *Setup.initialChanges[remoteAddress]}
-			b, err := json.Marshal(viewToSend)
-			if err == nil {
-				w.WriteHeader(http.StatusOK)
-				w.Write(b)
+	if isInView {
+		viewToSend := viewInit{View: *MyView, Changes: *Setup.initialChanges[remoteAddress]}
+		b, err := json.Marshal(viewToSend)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			w.Write(b)
 
-				Setup.nodeJoined(remoteAddress)
-			} else {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			return
+			Setup.nodeJoined(remoteAddress)
+		} else {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
 		}
+		return
 	}
 	w.WriteHeader(http.StatusForbidden)
 }
 
 //Get keys counts from shards needed for view change response
-func getKeyCounts() ([]shardCount, error) {
+func getKeyCounts(ctx context.Context) ([]shardCount, error) {
 	var wg sync.WaitGroup
 	wg.Add(len(MyView.Nodes))
 	var mutex = &sync.Mutex{}
 	shards := map[string]int{}
 	for _, node := range MyView.Nodes {
-		go getNodeKeyCount(&wg, mutex, node, shards)
+		go getNodeKeyCount(ctx, &wg, mutex, node, shards)
 	}
 	wg.Wait()
 
 	if len(shards) == len(MyView.Nodes) {
 		shardArray := make([]shardCount, 0, len(MyView.Nodes))
 		for address, count := range shards {
-			shardArray = append(shardArray, shardCount{Address: address + ":" + Port, KeyCount: count})
+			shardArray = append(shardArray, shardCount{Address: address, KeyCount: count})
 		}
 		return shardArray, nil
 	}
@@ -216,7 +515,7 @@ func getKeyCounts() ([]shardCount, error) {
 }
 
 //Get key count for single node after view change
-func getNodeKeyCount(wg *sync.WaitGroup, mutex *sync.Mutex, node string, shards map[string]int) {
+func getNodeKeyCount(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, shards map[string]int) {
 	defer wg.Done()
 
 	if node == MyAddress {
@@ -224,22 +523,13 @@ func getNodeKeyCount(wg *sync.WaitGroup, mutex *sync.Mutex, node string, shards
 		shards[node] = kvs.KeyCount()
 		mutex.Unlock()
 	} else {
-		uri := fmt.Sprintf("http://%s:%s/kvs/key-count", node, Port)
-		res, err := http.Get(uri)
+		uri := fmt.Sprintf("http://%s/kvs/key-count", node)
+		res, err := internalRequest(ctx, http.MethodGet, uri, nil, quickPolicy(true))
 		if err == nil && res.StatusCode == http.StatusOK {
-			if res.Body != nil {
-				defer res.Body.Close()
-			}
-
-			b, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				return
-			}
-
 			k := struct {
 				KeyCount int `json:"key-count"`
 			}{}
-			err = json.Unmarshal(b, &k)
+			err = json.Unmarshal(res.Body, &k)
 			if err != nil {
 				return
 			}
@@ -251,24 +541,34 @@ func getNodeKeyCount(wg *sync.WaitGroup, mutex *sync.Mutex, node string, shards
 }
 
 //Notify all nodes of impending view change
-func notifyViewChanges(addedNodes map[string]bool, changes map[string]*kvs.Change) error {
+func notifyViewChanges(ctx context.Context, addedNodes map[string]bool, changes map[string]*kvs.Change) error {
 	var wg sync.WaitGroup
 	nodesAccepted := make(map[string]bool)
 	nodesNotified := 0
 	var mutex = &sync.Mutex{}
-	wg.Add(len(MyView.Nodes) - 1) //Don't need to notify myself
 
-	//Notify nodes of view change
+	//Notify nodes of view change, I don't need to notify myself
 	for _, node := range MyView.Nodes {
 		if addedNodes[node] {
 			//If node is newly added send viewInit instead of just view
 			nodesNotified++
+			wg.Add(1)
 			v := viewInit{View: *MyView, Changes: *changes[node]}
-			go notifyNewView(&wg, mutex, node, v, nodesAccepted)
+			go notifyNewView(ctx, &wg, mutex, node, v, nodesAccepted)
 			delete(changes, node)
 		} else if node != MyAddress {
 			nodesNotified++
-			go notifyViewChange(&wg, mutex, node, nodesAccepted)
+			wg.Add(1)
+			go notifyViewChange(ctx, &wg, mutex, node, nodesAccepted)
+		}
+	}
+
+	//Removed nodes need the new view to know where to push their keys
+	for node, c := range changes {
+		if c.Removed && node != MyAddress {
+			nodesNotified++
+			wg.Add(1)
+			go notifyViewChange(ctx, &wg, mutex, node, nodesAccepted)
 		}
 	}
 	wg.Wait()
@@ -280,7 +580,7 @@ func notifyViewChanges(addedNodes map[string]bool, changes map[string]*kvs.Chang
 }
 
 //Propagate changes to all necessary nodes
-func propagateViewChanges(changes map[string]*kvs.Change) error {
+func propagateViewChanges(ctx context.Context, changes map[string]*kvs.Change) error {
 	var wg sync.WaitGroup
 	changesPropagated := make(map[string]bool)
 	var mutex = &sync.Mutex{}
@@ -288,7 +588,7 @@ func propagateViewChanges(changes map[string]*kvs.Change) error {
 	//Propagate changes to existing and removed nodes
 	wg.Add(len(changes))
 	for node, c := range changes {
-		go propagateChange(&wg, mutex, node, *c, changesPropagated)
+		go propagateChange(ctx, &wg, mutex, node, *c, changesPropagated)
 	}
 
 	wg.Wait()
@@ -300,21 +600,21 @@ func propagateViewChanges(changes map[string]*kvs.Change) error {
 }
 
 //Makes post request to uri with given data, returns true on success
-func makePost(uri string, data interface{}) bool {
-	b, err := json.Marshal(data)
-	if err == nil {
-		res, err := http.Post(uri, "application/json", bytes.NewBuffer(b))
-		return err == nil && res.StatusCode == http.StatusOK
-	}
-	return false
+func makePost(ctx context.Context, uri string, data interface{}, policy requestPolicy) bool {
+	res, err := internalRequest(ctx, http.MethodPost, uri, data, policy)
+	return err == nil && res.StatusCode == http.StatusOK
 }
 
 //Routine to notify existing node of updated view
-func notifyViewChange(wg *sync.WaitGroup, mutex *sync.Mutex, node string, nodesAccepted map[string]bool) {
+func notifyViewChange(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, nodesAccepted map[string]bool) {
 	defer wg.Done()
 
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/view-change", node, Port)
-	if makePost(uri, *MyView) {
+	policy := bulkPolicy(true)
+	ok := postInternal(ctx, node, "/kvs/int/view-change", *MyView, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		_, err := client.ViewChange(ctx, &rpc.ViewChangeRequest{View: toProtoView(MyView)})
+		return err
+	})
+	if ok {
 		mutex.Lock()
 		nodesAccepted[node] = true
 		mutex.Unlock()
@@ -322,11 +622,16 @@ func notifyViewChange(wg *sync.WaitGroup, mutex *sync.Mutex, node string, nodesA
 }
 
 //Routine to notify new node of its initial view state
-func notifyNewView(wg *sync.WaitGroup, mutex *sync.Mutex, node string, v viewInit, nodesAccepted map[string]bool) {
+func notifyNewView(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, v viewInit, nodesAccepted map[string]bool) {
 	defer wg.Done()
 
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/view-change", node, Port)
-	if makePost(uri, v) {
+	policy := bulkPolicy(false)
+	ok := postInternal(ctx, node, "/kvs/int/view-change", v, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		changes := &rpc.Change{Removed: v.Changes.Removed, Tokens: v.Changes.Tokens}
+		_, err := client.ViewChange(ctx, &rpc.ViewChangeRequest{View: toProtoView(&v.View), Changes: changes})
+		return err
+	})
+	if ok {
 		mutex.Lock()
 		nodesAccepted[node] = true
 		mutex.Unlock()
@@ -334,11 +639,14 @@ func notifyNewView(wg *sync.WaitGroup, mutex *sync.Mutex, node string, v viewIni
 }
 
 //Routine to push reshard to changes to another node
-func pushReshard(wg *sync.WaitGroup, mutex *sync.Mutex, node string, shard map[string]kvs.KVS, successfulReshards map[string]bool) {
+func pushReshard(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, shard map[string]*kvs.Shard, successfulReshards map[string]bool) {
 	defer wg.Done()
 
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/push", node, Port)
-	if makePost(uri, shard) {
+	policy := bulkPolicy(true)
+	ok := postInternal(ctx, node, "/kvs/int/push", shard, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		return streamPush(ctx, client, shard)
+	})
+	if ok {
 		mutex.Lock()
 		successfulReshards[node] = true
 		mutex.Unlock()
@@ -359,7 +667,7 @@ func pushHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if AmActive {
-		newKeys := make(map[string]kvs.KVS)
+		newKeys := make(map[string]*kvs.Shard)
 		err = json.Unmarshal(b, &newKeys)
 		if err != nil {
 			log.Println(err)
@@ -381,125 +689,185 @@ func pushHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 //Routine to propagate a change to node
-func propagateChange(wg *sync.WaitGroup, mutex *sync.Mutex, node string, c kvs.Change, changesPropagated map[string]bool) {
+func propagateChange(ctx context.Context, wg *sync.WaitGroup, mutex *sync.Mutex, node string, c kvs.Change, changesPropagated map[string]bool) {
 	defer wg.Done()
 
 	if node != MyAddress {
-		uri := fmt.Sprintf("http://%s:%s/kvs/int/reshard", node, Port)
-		if makePost(uri, c) {
-			mutex.Lock()
-			changesPropagated[node] = true
-			mutex.Unlock()
-		}
-	} else {
-		shards := MyView.Reshard(c)
-		err := executeReshards(shards)
-		if err == nil {
+		policy := bulkPolicy(false)
+		ok := postInternal(ctx, node, "/kvs/int/reshard", c, policy, func(ctx context.Context, client rpc.InternalClient) error {
+			_, err := client.Reshard(ctx, &rpc.Change{Removed: c.Removed, Tokens: c.Tokens})
+			return err
+		})
+		if ok {
 			mutex.Lock()
 			changesPropagated[node] = true
 			mutex.Unlock()
 		}
+	} else if err := reshard(c); err == nil {
+		mutex.Lock()
+		changesPropagated[node] = true
+		mutex.Unlock()
+	}
+}
 
-		if c.Removed {
-			AmActive = false
-			log.Println("Left view")
-		}
+//Apply a change to this node and push moved keys to their new nodes. Keys are removed from this node
+//before they are pushed, so the pushes are not cancelled with the request asking for the reshard
+func reshard(c kvs.Change) error {
+	ctx, cancel := context.WithTimeout(context.Background(), MyConfig.reshardTimeout)
+	defer cancel()
+
+	shards, transfers := MyView.Reshard(c)
+	err := executeReshards(ctx, shards, transfers)
+
+	//Become inactive if removed from view
+	if c.Removed {
+		AmActive = false
+		log.Println("Left view")
 	}
+	return err
 }
 
-//Execute an internal get request to another node and return the value
-func executeGet(token kvs.Token, key string) (string, error) {
+//Execute an internal get request to another node and return the value with its expiry and revision
+func executeGet(ctx context.Context, token kvs.Token, key string) (string, kvs.Meta, error) {
 	var value string
+	var meta kvs.Meta
+	policy := quickPolicy(true)
+	handled, err := callGRPC(ctx, token.Endpoint, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		res, err := client.Get(ctx, &rpc.KeyRequest{Token: token.Value, Key: key})
+		value = string(res.GetValue())
+		meta = kvs.Meta{Expires: expiryTime(res.GetExpires()), Revision: res.GetRevision()}
+		return err
+	})
+	if handled {
+		return value, meta, err
+	}
+
 	tokenValue := strconv.FormatUint(token.Value, 10)
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/%s/%s", token.Endpoint, Port, tokenValue, key)
-	res, err := http.Get(uri)
+	uri := fmt.Sprintf("http://%s/kvs/int/%s/%s", token.Endpoint, tokenValue, url.PathEscape(key))
+	res, err := internalRequest(ctx, http.MethodGet, uri, nil, policy)
 	if err != nil {
-		return value, err
+		return value, meta, err
 	}
 
 	if res.StatusCode == http.StatusOK {
-		if res.Body != nil {
-			defer res.Body.Close()
-		}
-
-		b, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return value, err
-		}
-
 		v := keyValue{}
-		err = json.Unmarshal(b, &v)
+		err = json.Unmarshal(res.Body, &v)
 		if err != nil {
-			return value, err
+			return value, meta, err
 		}
-		value = *v.Value
-		return value, nil
+		value, _ = v.value()
+		return value, kvs.Meta{Expires: expiryTime(v.Expires), Revision: v.Revision}, nil
 	}
-	return value, errors.New("Node returned not-ok status")
+	return value, meta, errors.New("Node returned not-ok status")
 }
 
-//Execute an internal set request to another node and return if a key was updated
-func executeSet(token kvs.Token, key string, value keyValue) (bool, error) {
-	tokenValue := strconv.FormatUint(token.Value, 10)
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/%s/%s", token.Endpoint, Port, tokenValue, key)
-	b, err := json.Marshal(value)
-	if err != nil {
-		return false, err
+//Execute an internal set request to another node and return if a key was updated and its new
+//revision. Returns kvs.ErrConditionNotMet if the key does not meet the precondition of the value
+func executeSet(ctx context.Context, token kvs.Token, key string, value keyValue) (bool, uint64, error) {
+	var updated bool
+	var revision uint64
+	//Conditional sets are not retried since a set which succeeded would fail its condition when repeated
+	policy := quickPolicy(value.Precondition == nil)
+	handled, err := callGRPC(ctx, token.Endpoint, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		v, _ := value.value()
+		req := &rpc.SetRequest{Token: token.Value, Key: key, Value: []byte(v), Expires: value.Expires, Precondition: toProtoPrecondition(value.Precondition)}
+		res, err := client.Set(ctx, req)
+		updated, revision = res.GetUpdated(), res.GetRevision()
+		return err
+	})
+	if handled {
+		switch status.Code(err) {
+		case codes.FailedPrecondition:
+			return updated, revision, kvs.ErrConditionNotMet
+		case codes.Aborted:
+			return updated, revision, kvs.ErrLocked
+		}
+		return updated, revision, err
 	}
 
-	req, err := http.NewRequest(http.MethodPut, uri, bytes.NewBuffer(b))
+	tokenValue := strconv.FormatUint(token.Value, 10)
+	uri := fmt.Sprintf("http://%s/kvs/int/%s/%s", token.Endpoint, tokenValue, url.PathEscape(key))
+	res, err := internalRequest(ctx, http.MethodPut, uri, value, policy)
 	if err != nil {
-		return false, err
-	}
+		return false, 0, err
+	}
+
+	v := keyValue{}
+	json.Unmarshal(res.Body, &v)
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, v.Revision, nil
+	case http.StatusCreated:
+		return false, v.Revision, nil
+	case http.StatusPreconditionFailed:
+		return false, 0, kvs.ErrConditionNotMet
+	case http.StatusLocked:
+		return false, 0, kvs.ErrLocked
+	}
+	return false, 0, errors.New("Node returned bad status")
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false, err
+//Execute an internal delete request to another node and return if a key was deleted. Returns
+//kvs.ErrConditionNotMet if the key does not meet the precondition
+func executeDelete(ctx context.Context, token kvs.Token, key string, cond *kvs.Precondition) error {
+	policy := quickPolicy(false)
+	handled, err := callGRPC(ctx, token.Endpoint, policy, func(ctx context.Context, client rpc.InternalClient) error {
+		_, err := client.Delete(ctx, &rpc.KeyRequest{Token: token.Value, Key: key, Precondition: toProtoPrecondition(cond)})
+		return err
+	})
+	if handled {
+		switch status.Code(err) {
+		case codes.FailedPrecondition:
+			return kvs.ErrConditionNotMet
+		case codes.Aborted:
+			return kvs.ErrLocked
+		}
+		return err
 	}
 
-	if res.StatusCode == http.StatusOK {
-		return true, nil
-	} else if res.StatusCode == http.StatusCreated {
-		return false, nil
+	//Delete requests only have a body if they are conditional
+	var body interface{}
+	if cond != nil {
+		body = keyValue{Precondition: cond}
 	}
-	return false, errors.New("Node returned bad status")
-}
 
-//Execute an internal delete request to another node and return if a key was deleted
-func executeDelete(token kvs.Token, key string) error {
 	tokenValue := strconv.FormatUint(token.Value, 10)
-	uri := fmt.Sprintf("http://%s:%s/kvs/int/%s/%s", token.Endpoint, Port, tokenValue, key)
-	req, err := http.NewRequest(http.MethodDelete, uri, nil)
+	uri := fmt.Sprintf("http://%s/kvs/int/%s/%s", token.Endpoint, tokenValue, url.PathEscape(key))
+	res, err := internalRequest(ctx, http.MethodDelete, uri, body, policy)
 	if err != nil {
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-
-	if res.StatusCode == http.StatusOK {
+	switch res.StatusCode {
+	case http.StatusOK:
 		return nil
+	case http.StatusPreconditionFailed:
+		return kvs.ErrConditionNotMet
+	case http.StatusLocked:
+		return kvs.ErrLocked
 	}
 	return errors.New("Node returned bad status")
 }
 
 //Execute all reshards from this node
-func executeReshards(shards kvs.RemappedKVS) error {
+func executeReshards(ctx context.Context, shards kvs.RemappedKVS, transfers []kvs.SegmentTransfer) error {
 	var wg sync.WaitGroup
-	wg.Add(len(shards))
+	wg.Add(len(shards) + len(transfers))
 	var mutex = &sync.Mutex{}
 	successfulReshards := make(map[string]bool)
+	successfulTransfers := make(map[string]bool)
 
 	for node, shard := range shards {
 		//Push resharded keys to respective nodes
-		go pushReshard(&wg, mutex, node, shard, successfulReshards)
+		go pushReshard(ctx, &wg, mutex, node, shard, successfulReshards)
+	}
+	for _, t := range transfers {
+		go pushSegment(ctx, &wg, mutex, t, successfulTransfers)
 	}
 
 	wg.Wait()
 
-	if len(successfulReshards) == len(shards) {
+	if len(successfulReshards) == len(shards) && len(successfulTransfers) == len(transfers) {
 		return nil
 	}
 	return errors.New("Not all reshards completed")
@@ -527,20 +895,13 @@ func reshardHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		shards := MyView.Reshard(c)
-		err = executeReshards(shards)
+		err = reshard(c)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
 			w.WriteHeader(http.StatusOK)
 		}
-
-		//Become inactive if removed from view
-		if c.Removed {
-			AmActive = false
-			log.Println("Left view")
-		}
 	} else {
 		w.WriteHeader(http.StatusForbidden)
 	}
@@ -569,7 +930,7 @@ func internalViewChangeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		*MyView = v
+		applyViewChange(v, nil)
 		w.WriteHeader(http.StatusOK)
 	} else {
 		//I am a new node
@@ -581,13 +942,26 @@ func internalViewChangeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		*MyView = v.View
-		MyView.Reshard(v.Changes)
-		AmActive = true
+		applyViewChange(v.View, &v.Changes)
 		w.WriteHeader(http.StatusOK)
+	}
+}
 
-		log.Println("Joined view")
+//Replace the view of an active node. A new node is given its changes and joins the view
+func applyViewChange(v kvs.View, changes *kvs.Change) error {
+	if AmActive {
+		*MyView = v
+		closeGRPCConns(v.Nodes)
+		return nil
+	} else if changes == nil {
+		return errMissingChanges
 	}
+
+	*MyView = v
+	MyView.Reshard(*changes)
+	AmActive = true
+	log.Println("Joined view")
+	return nil
 }
 
 //Handle internal get request with token in url
@@ -598,12 +972,14 @@ func internalGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Key and token are in url
-	key := mux.Vars(r)["key"]
+	key := pathVar(r, "key")
 	token, _ := strconv.ParseUint(mux.Vars(r)["token"], 10, 64)
 
 	//Check specified token for key
-	if v, exists := kvs.Get(token, key); exists {
-		b, err := json.Marshal(keyValue{Value: &v})
+	if v, meta, exists := kvs.GetItem(token, key); exists {
+		res := internalKeyValue(v)
+		res.Expires, res.Revision = expiryNanos(meta.Expires), meta.Revision
+		b, err := json.Marshal(res)
 
 		if err == nil {
 			w.WriteHeader(http.StatusOK)
@@ -625,7 +1001,7 @@ func internalSetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Key and token are in url
-	key := mux.Vars(r)["key"]
+	key := pathVar(r, "key")
 	token, _ := strconv.ParseUint(mux.Vars(r)["token"], 10, 64)
 
 	if r.Body != nil {
@@ -647,8 +1023,27 @@ func internalSetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	v, ok := value.value()
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	//Try to set value
-	updated, err := kvs.Set(token, key, *value.Value)
+	updated, revision, err := kvs.Set(token, key, v, expiryTime(value.Expires), value.Precondition.Check)
+	if err == kvs.ErrConditionNotMet {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	} else if err == kvs.ErrLocked {
+		w.WriteHeader(http.StatusLocked)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	b, err = json.Marshal(keyValue{Revision: revision})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
@@ -660,6 +1055,7 @@ func internalSetHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
+	w.Write(b)
 }
 
 //Handle internal delete request with token in url
@@ -670,17 +1066,87 @@ func internalDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Key and token are in url
-	key := mux.Vars(r)["key"]
+	key := pathVar(r, "key")
 	token, _ := strconv.ParseUint(mux.Vars(r)["token"], 10, 64)
 
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	//Body only has a precondition if the delete is conditional
+	value := keyValue{}
+	b, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, &value)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	//Check specified token for key
-	if err := kvs.Delete(token, key); err == nil {
+	_, err = kvs.DeleteItem(token, key, value.Precondition.Check)
+	switch err {
+	case nil:
 		w.WriteHeader(http.StatusOK)
-	} else {
+	case kvs.ErrConditionNotMet:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case kvs.ErrLocked:
+		w.WriteHeader(http.StatusLocked)
+	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+//Change the view with this node as coordinator to the nodes returned by change, which is given the
+//nodes of the current view once no other view change is running. Returns key counts of the new shards
+func coordinateViewChange(change func([]string) ([]string, error)) ([]shardCount, error) {
+	viewChangeMutex.Lock()
+	defer viewChangeMutex.Unlock()
+
+	nodes, err := change(append([]string{}, MyView.Nodes...))
+	if err != nil {
+		return nil, err
+	}
+
+	//A view change stopped part way leaves nodes with different views, so it is not cancelled with
+	//the request which started it and only stops once its prepares would no longer be held
+	ctx, cancel := context.WithTimeout(context.Background(), txnHoldLease())
+	defer cancel()
+
+	oldNodes := append([]string{}, MyView.Nodes...)
+	publishClusterEvent(webhookEvent{Type: eventViewChangeStarted, View: nodes})
+
+	//Prepared transactions hold locks which do not move with their keys, so wait for them to be
+	//decided and refuse new prepares until the keys have moved
+	err = holdTxns(ctx, oldNodes)
+	defer releaseTxns(oldNodes)
+	if err != nil {
+		publishViewChange(oldNodes, nodes, err)
+		return nil, err
+	}
+
+	//Update my view
+	changes, addedNodes := MyView.ChangeView(nodes)
+
+	//Update other's views
+	err = notifyViewChanges(ctx, addedNodes, changes)
+	if err == nil {
+		// Propagate view changes
+		err = propagateViewChanges(ctx, changes)
+	}
+
+	publishViewChange(oldNodes, nodes, err)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("View updated to", nodes)
+
+	//Get keys counts from shards
+	return getKeyCounts(ctx)
+}
+
 //Handle external view change put request, node acts as coordinator
 func viewChangeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
@@ -709,35 +1175,23 @@ func viewChangeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes := strings.Split(req.View, ",")
-	for i, node := range nodes {
-		nodes[i] = strings.Split(node, ":")[0]
-	}
-
-	//Update my view
-	changes, addedNodes := MyView.ChangeView(nodes)
-
-	//Update other's views
-	err = notifyViewChanges(addedNodes, changes)
+	nodes, err := parseView(req.View, MyConfig.Port)
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Propagate view changes
-	err = propagateViewChanges(changes)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	shardCounts, err := coordinateViewChange(func([]string) ([]string, error) { return nodes, nil })
+	if err == errTxnsPrepared {
+		b, _ = json.Marshal(struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}{Message: "Error in VIEW-CHANGE", Error: err.Error()})
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(b)
 		return
-	}
-
-	log.Println("View updated to", nodes)
-
-	//Get keys counts from shards
-	shardCounts, err := getKeyCounts()
-	if err != nil {
+	} else if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -777,6 +1231,75 @@ func keyCountHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//Handle external get request for the view so clients can send requests to the node owning a key
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		Message string   `json:"message"`
+		View    kvs.View `json:"view"`
+		MaxHash uint64   `json:"max-hash"`
+	}{Message: "View retrieved successfully", View: *MyView, MaxHash: kvs.MaxHash})
+
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Get value of key with its expiry and revision from the node owning it. Address is the owning node
+//if it is not this node
+func routeGet(ctx context.Context, key string) (value string, meta kvs.Meta, exists bool, address string) {
+	token := MyView.FindToken(key)
+	if token.Endpoint == MyAddress {
+		//Key would be stored locally
+		value, meta, exists = kvs.GetItem(token.Value, key)
+		return value, meta, exists, ""
+	}
+
+	//Key would exist on other node
+	value, meta, err := executeGet(ctx, token, key)
+	return value, meta, err == nil, token.Endpoint
+}
+
+//Set value of key on the node owning it if the precondition holds and return if an existing key was
+//updated and its new revision. The key expires at the given time unless it is zero. Returns
+//kvs.ErrConditionNotMet if the precondition does not hold
+func routeSet(ctx context.Context, key string, value string, expires time.Time, cond *kvs.Precondition) (updated bool, revision uint64, address string, err error) {
+	token := MyView.FindToken(key)
+	if token.Endpoint == MyAddress {
+		//Key should be stored locally
+		updated, revision, err = kvs.Set(token.Value, key, value, expires, cond.Check)
+		return updated, revision, "", err
+	}
+
+	//Key should exist on other node
+	kv := internalKeyValue(value)
+	kv.Expires, kv.Precondition = expiryNanos(expires), cond
+	updated, revision, err = executeSet(ctx, token, key, kv)
+	return updated, revision, token.Endpoint, err
+}
+
+//Delete key from the node owning it if the precondition holds. Returns kvs.ErrConditionNotMet if the
+//precondition does not hold or another error if the key does not exist
+func routeDelete(ctx context.Context, key string, cond *kvs.Precondition) (address string, err error) {
+	token := MyView.FindToken(key)
+	if token.Endpoint == MyAddress {
+		//Key would be stored locally
+		_, err = kvs.DeleteItem(token.Value, key, cond.Check)
+		return "", err
+	}
+
+	//Key would exist on other node
+	return token.Endpoint, executeDelete(ctx, token, key, cond)
+}
+
 //Handle external get requests for key
 func getHandler(w http.ResponseWriter, r *http.Request) {
 	if !AmActive {
@@ -784,37 +1307,37 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := mux.Vars(r)["key"]
-	token := MyView.FindToken(key)
-	var value *string
+	key, _, keyError := requestKey(r)
 	res := struct {
 		DoesExist bool   `json:"doesExist"`
 		Error     string `json:"error,omitempty"`
 		Message   string `json:"message"`
 		Value     string `json:"value,omitempty"`
+		Binary    []byte `json:"binary,omitempty"` //Value which is not valid UTF-8, as base64
+		TTL       int64  `json:"ttl,omitempty"`
+		Revision  uint64 `json:"revision,omitempty"`
 		Address   string `json:"address,omitempty"`
 	}{}
 
-	if token.Endpoint == MyAddress {
-		//Key would be stored locally
-		if v, exists := kvs.Get(token.Value, key); exists {
-			value = &v
-		}
-	} else {
-		//Key would exist on other node
-		res.Address = token.Endpoint + ":" + Port
-		returnedValue, err := executeGet(token, key)
-		if err == nil {
-			value = &returnedValue
-		}
-	}
-
-	if value != nil {
+	if keyError != "" {
+		res.Error = keyError
+		res.Message = "Error in GET"
+		w.WriteHeader(http.StatusBadRequest)
+	} else if value, meta, exists, address := routeGet(r.Context(), key); exists {
+		res.Address = address
 		res.DoesExist = true
 		res.Message = "Retrieved successfully"
-		res.Value = *value
+		if utf8.ValidString(value) {
+			res.Value = value
+		} else {
+			res.Binary = []byte(value)
+		}
+		res.TTL = ttlRemaining(meta.Expires)
+		res.Revision = meta.Revision
+		w.Header().Set("ETag", etag(meta.Revision))
 		w.WriteHeader(http.StatusOK)
 	} else {
+		res.Address = address
 		res.DoesExist = false
 		res.Error = "Key does not exist"
 		res.Message = "Error in GET"
@@ -851,9 +1374,10 @@ func setHandler(w http.ResponseWriter, r *http.Request) {
 		Replaced bool   `json:"replaced"`
 		Error    string `json:"error,omitempty"`
 		Message  string `json:"message"`
+		Revision uint64 `json:"revision,omitempty"`
 		Address  string `json:"address,omitempty"`
 	}{}
-	key := mux.Vars(r)["key"]
+	key, settings, keyError := requestKey(r)
 	req := keyValue{}
 	err = json.Unmarshal(b, &req)
 	if err != nil {
@@ -862,43 +1386,69 @@ func setHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Value == nil {
+	expires, ttlError := parseTTL(r, req.TTL)
+	if expires.IsZero() && ttlError == "" && settings.DefaultTTL > 0 {
+		expires = time.Now().Add(time.Duration(settings.DefaultTTL) * time.Second)
+	}
+	cond, condError := parsePrecondition(r)
+	if cond == nil && condError == "" {
+		//Headers take priority over a precondition in the body
+		cond = req.Precondition
+	}
+
+	value, hasValue := req.value()
+	if !hasValue {
 		res.Error = "Value is missing"
 		res.Message = "Error in PUT"
 		w.WriteHeader(http.StatusBadRequest)
-	} else if len(key) > 50 {
+	} else if len(pathVar(r, "key")) > MyConfig.MaxKeyLength {
 		res.Error = "Key is too long"
 		res.Message = "Error in PUT"
 		w.WriteHeader(http.StatusBadRequest)
+	} else if keyError != "" {
+		res.Error = keyError
+		res.Message = "Error in PUT"
+		w.WriteHeader(http.StatusBadRequest)
+	} else if settings.MaxValueSize > 0 && len(value) > settings.MaxValueSize {
+		res.Error = fmt.Sprintf("Value is larger than %d bytes", settings.MaxValueSize)
+		res.Message = "Error in PUT"
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	} else if ttlError != "" {
+		res.Error = ttlError
+		res.Message = "Error in PUT"
+		w.WriteHeader(http.StatusBadRequest)
+	} else if condError != "" {
+		res.Error = condError
+		res.Message = "Error in PUT"
+		w.WriteHeader(http.StatusBadRequest)
 	} else {
-		//Find token for key
-		token := MyView.FindToken(key)
-		var updated bool
-		var err error
-
-		if token.Endpoint == MyAddress {
-			//Key should be stored locally
-			updated, err = kvs.Set(token.Value, key, *req.Value)
-
-		} else {
-			//Key should exist on other node
-			res.Address = token.Endpoint + ":" + Port
-			updated, err = executeSet(token, key, req)
-		}
-
-		if err != nil {
+		updated, revision, address, err := routeSet(r.Context(), key, value, expires, cond)
+		res.Address = address
+
+		if err == kvs.ErrConditionNotMet {
+			res.Error = "Precondition failed"
+			res.Message = "Error in PUT"
+			w.WriteHeader(http.StatusPreconditionFailed)
+		} else if err == kvs.ErrLocked {
+			res.Error = err.Error()
+			res.Message = "Error in PUT"
+			w.WriteHeader(http.StatusLocked)
+		} else if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Println(err)
 			return
-		}
-
-		res.Replaced = updated
-		if updated {
-			res.Message = "Updated successfully"
-			w.WriteHeader(http.StatusOK)
 		} else {
-			res.Message = "Added successfully"
-			w.WriteHeader(http.StatusCreated)
+			res.Replaced = updated
+			res.Revision = revision
+			w.Header().Set("ETag", etag(revision))
+
+			if updated {
+				res.Message = "Updated successfully"
+				w.WriteHeader(http.StatusOK)
+			} else {
+				res.Message = "Added successfully"
+				w.WriteHeader(http.StatusCreated)
+			}
 		}
 	}
 
@@ -917,8 +1467,7 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := mux.Vars(r)["key"]
-	token := MyView.FindToken(key)
+	key, _, keyError := requestKey(r)
 	res := struct {
 		DoesExist bool   `json:"doesExist"`
 		Error     string `json:"error,omitempty"`
@@ -926,21 +1475,33 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		Address   string `json:"address,omitempty"`
 	}{}
 
-	var err error
-	if token.Endpoint == MyAddress {
-		//Key would be stored locally
-		err = kvs.Delete(token.Value, key)
-	} else {
-		//Key would exist on other node
-		res.Address = token.Endpoint + ":" + Port
-		err = executeDelete(token, key)
-	}
-
-	if err == nil {
+	cond, condError := parsePrecondition(r)
+	if keyError != "" {
+		res.Error = keyError
+		res.Message = "Error in DELETE"
+		w.WriteHeader(http.StatusBadRequest)
+	} else if condError != "" {
+		res.Error = condError
+		res.Message = "Error in DELETE"
+		w.WriteHeader(http.StatusBadRequest)
+	} else if address, err := routeDelete(r.Context(), key, cond); err == nil {
+		res.Address = address
 		res.DoesExist = true
 		res.Message = "Deleted successfully"
 		w.WriteHeader(http.StatusOK)
+	} else if err == kvs.ErrConditionNotMet {
+		res.Address = address
+		res.Error = "Precondition failed"
+		res.Message = "Error in DELETE"
+		w.WriteHeader(http.StatusPreconditionFailed)
+	} else if err == kvs.ErrLocked {
+		res.Address = address
+		res.DoesExist = true
+		res.Error = err.Error()
+		res.Message = "Error in DELETE"
+		w.WriteHeader(http.StatusLocked)
 	} else {
+		res.Address = address
 		res.DoesExist = false
 		res.Error = "Key does not exist"
 		res.Message = "Error in DELETE"
@@ -958,7 +1519,7 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 //Print state of system
 func debugHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("**************************************")
-	fmt.Printf("Address: %s:%s Active: %v\n", MyAddress, Port, AmActive)
+	fmt.Printf("Address: %s Active: %v\n", MyAddress, AmActive)
 	fmt.Printf("Nodes: %v\n", MyView.Nodes)
 	fmt.Printf("Tokens: %v\n", MyView.Tokens)
 	fmt.Printf("Keys: %v\n", kvs.KeyCount())
@@ -971,7 +1532,7 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		for _, node := range MyView.Nodes {
 			if node != MyAddress {
-				makePost(fmt.Sprintf("http://%s:%s/kvs/debug", node, Port), struct{}{})
+				makePost(r.Context(), fmt.Sprintf("http://%s/kvs/debug", node), struct{}{}, quickPolicy(false))
 			}
 		}
 	}
@@ -980,43 +1541,131 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	r := mux.NewRouter()
+	r := mux.NewRouter().UseEncodedPath()
 	r.Use(loggingMiddleware)
+	r.Use(deadlineMiddleware)
+	r.Use(epochMiddleware)
 
-	viewArray, exists := os.LookupEnv("VIEW")
-	endpoint, _ := os.LookupEnv("ADDRESS")
-	MyAddress = strings.Split(endpoint, ":")[0]
-	nodes := strings.Split(viewArray, ",")
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+	MyConfig = config
+	internalClient = newInternalClient(config)
+	MyAddress = config.Address
+	kvs.NumTokens = config.NumTokens
+	kvs.MaxHash = config.MaxHash
+	kvs.NewStore = kvs.Engines[config.StorageEngine]
+	if config.StorageEngine == "disk" {
+		kvs.DataDir = config.DataDir
+		kvs.MemtableSize = config.MemtableSize
+		if err := kvs.InitDataDir(); err != nil {
+			log.Fatalln("Invalid data directory:", err)
+		}
+	}
+	go sweepExpiredKeys(config.expirySweepInterval)
+	kvs.ChangeLogSize = config.ChangeLogSize
+	startWebhooks(config)
 
-	log.Printf("Node starting at %s with view %v\n", endpoint, nodes)
+	if err := recoverTxns(config.TxnLog); err != nil {
+		log.Fatalln("Invalid transaction log:", err)
+	}
+	go resolveInDoubtTxns(config.txnTimeout)
 
-	//if address matches first ip_addr in view
-	if endpoint == nodes[0] {
-		log.Println("Node coordinating setup")
-		coordinateSetup(nodes)
-	} else if exists {
-		joinView(nodes[0])
+	var nodes []string
+	if config.View != "" {
+		nodes = strings.Split(config.View, ",")
 	}
 
+	log.Printf("Node starting at %s with view %v\n", MyAddress, nodes)
+
 	//Internal endpoints
 	r.HandleFunc("/kvs/int/init", initHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/status", statusHandler).Methods(http.MethodGet)
 	r.HandleFunc("/kvs/int/view-change", internalViewChangeHandler).Methods(http.MethodPost)
 	r.HandleFunc("/kvs/int/reshard", reshardHandler).Methods(http.MethodPost)
 	r.HandleFunc("/kvs/int/push", pushHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/segment/v2/{token}", internalSegmentHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/token-counts", internalTokenCountsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/keys", internalKeysHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/memcache", internalMemcacheHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/batch", internalBatchHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/txn", internalTxnHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/txn/prepare", internalTxnPrepareHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/txn/commit", internalTxnCommitHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/txn/abort", internalTxnAbortHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/txn/outcome", internalTxnOutcomeHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/txn/hold", internalTxnHoldHandler).Methods(http.MethodPost, http.MethodDelete)
+	r.HandleFunc("/kvs/int/scan", internalScanHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/watch", internalWatchHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/ns/{ns}", internalNamespaceHandler).Methods(http.MethodGet, http.MethodDelete)
 	r.HandleFunc("/kvs/int/{token}/{key}", internalGetHandler).Methods(http.MethodGet)
 	r.HandleFunc("/kvs/int/{token}/{key}", internalSetHandler).Methods(http.MethodPut)
 	r.HandleFunc("/kvs/int/{token}/{key}", internalDeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/kvs/int/{token}/{key}/incr", internalIncrHandler).Methods(http.MethodPost)
 
 	//External endpoints
 	r.HandleFunc("/kvs/view-change", viewChangeHandler).Methods(http.MethodPut)
+	r.HandleFunc("/kvs/join", joinHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/leave", leaveHandler).Methods(http.MethodPost)
 	r.HandleFunc("/kvs/key-count", keyCountHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/view", viewHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/ring", ringHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/ring/simulate", ringSimulateHandler).Methods(http.MethodPost)
 	//only key operations are affected by faults/partitions
+	r.HandleFunc("/kvs/keys", scanHandler).Methods(http.MethodGet)
 	r.HandleFunc("/kvs/keys/{key}", getHandler).Methods(http.MethodGet)
 	r.HandleFunc("/kvs/keys/{key}", setHandler).Methods(http.MethodPut)
 	r.HandleFunc("/kvs/keys/{key}", deleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/kvs/keys/{key}/incr", incrHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/keys/{key}/decr", decrHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/ns/{ns}", namespaceHandler).Methods(http.MethodGet, http.MethodDelete)
+	r.HandleFunc("/kvs/ns/{ns}/keys/{key}", getHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/ns/{ns}/keys/{key}", setHandler).Methods(http.MethodPut)
+	r.HandleFunc("/kvs/ns/{ns}/keys/{key}", deleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/kvs/ns/{ns}/keys/{key}/incr", incrHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/ns/{ns}/keys/{key}/decr", decrHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/batch", batchHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/txn", txnHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/watch", watchHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/changes", changesHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/webhooks", webhooksHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/webhooks/dead-letters", deadLettersHandler).Methods(http.MethodGet, http.MethodDelete)
+	r.HandleFunc("/kvs/config", configHandler).Methods(http.MethodGet)
 	r.HandleFunc("/kvs/debug", debugHandler)
 
-	http.Handle("/", r)
-	http.ListenAndServe(":"+Port, nil)
+	grpcServer := grpc.NewServer()
+	rpc.RegisterInternalServer(grpcServer, &internalServer{})
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if config.RESPListen != "" {
+		respListener, err := net.Listen("tcp", config.RESPListen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() { log.Fatalln(serveRESP(respListener)) }()
+	}
+
+	if config.MemcacheListen != "" {
+		memcacheListener, err := net.Listen("tcp", config.MemcacheListen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() { log.Fatalln(serveMemcache(memcacheListener)) }()
+	}
+
+	//Setup and joining require this node to already be reachable by other nodes
+	if len(nodes) > 0 {
+		go setupView(nodes)
+	} else if config.Join != "" {
+		go joinCluster(config.Join)
+	}
+
+	go handleSignals()
+	log.Fatalln(http.Serve(listener, h2c.NewHandler(grpcHandler(grpcServer, r), &http2.Server{})))
 
 }
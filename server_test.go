@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kailask/sharded-kvs/kvs"
+	"github.com/kailask/sharded-kvs/rpc"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+//Default config with its durations parsed
+func testConfig() *Config {
+	c := defaultConfig()
+	if err := c.parseDurations(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+//Start a node serving the internal key endpoints over HTTP and gRPC. The node shares the store of
+//the test, so a partition added for a token is on both sides of a request
+func startTestNode() *httptest.Server {
+	r := mux.NewRouter().UseEncodedPath()
+	r.HandleFunc("/kvs/int/{token}/{key}", internalGetHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kvs/int/{token}/{key}", internalSetHandler).Methods(http.MethodPut)
+	r.HandleFunc("/kvs/int/{token}/{key}", internalDeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/kvs/int/{token}/{key}/incr", internalIncrHandler).Methods(http.MethodPost)
+	r.HandleFunc("/kvs/int/batch", internalBatchHandler).Methods(http.MethodPost)
+
+	grpcServer := grpc.NewServer()
+	rpc.RegisterInternalServer(grpcServer, &internalServer{})
+	return httptest.NewServer(h2c.NewHandler(grpcHandler(grpcServer, r), &http2.Server{}))
+}
+
+func TestFromEndpoint(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = testConfig()
+
+	var tests = []struct {
+		name       string
+		view       string
+		remoteAddr string
+		endpoint   string
+		want       bool
+	}{
+		{"Same host", "10.0.0.2:8080,10.0.0.3:8080", "10.0.0.2:51234", "10.0.0.2:8080", true},
+		{"Other host", "10.0.0.2:8080,10.0.0.3:8080", "10.0.0.3:51234", "10.0.0.2:8080", false},
+		{"Same IPv6 host", "[::1]:8080", "[::1]:51234", "[::1]:8080", true},
+		{"IPv4 mapped", "10.0.0.2:8080", "[::ffff:10.0.0.2]:51234", "10.0.0.2:8080", true},
+		{"Bad endpoint", "10.0.0.2:8080", "10.0.0.2:51234", "10.0.0.2", false},
+		{"No view", "", "10.0.0.2:51234", "10.0.0.2:8080", true},
+		{"Host shared by nodes", "10.0.0.2:8080,10.0.0.2:8081", "10.0.0.2:51234", "10.0.0.2:8080", false},
+		{"Port of shared host", "10.0.0.2:8080,10.0.0.2:8081", "10.0.0.2:8080", "10.0.0.2:8080", true},
+		{"Other port of shared host", "10.0.0.2:8080,10.0.0.2:8081", "10.0.0.2:8081", "10.0.0.2:8080", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MyConfig.View = tt.view
+			r := httptest.NewRequest("GET", "/kvs/int/init", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if got := fromEndpoint(r, tt.endpoint); got != tt.want {
+				t.Errorf("Want: %v Got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExecuteSetGetBinary(t *testing.T) {
+	defer func(c *Config, active bool) { MyConfig, AmActive = c, active }(MyConfig, AmActive)
+	MyConfig, AmActive = testConfig(), true
+
+	server := startTestNode()
+	defer server.Close()
+
+	const tokenValue = 7
+	kvs.MyKVS[tokenValue] = kvs.NewStore(tokenValue)
+	defer delete(kvs.MyKVS, tokenValue)
+	token := kvs.Token{Endpoint: server.Listener.Addr().String(), Value: tokenValue}
+
+	var tests = []struct {
+		name     string
+		protocol string
+		value    string
+	}{
+		{"Text over gRPC", "grpc", "text"},
+		{"Binary over gRPC", "grpc", "\xff\xfe\x00binary"},
+		{"Text over HTTP", "http", "text"},
+		{"Binary over HTTP", "http", "\xff\xfe\x00binary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MyConfig.InternalProtocol = tt.protocol
+			ctx := context.Background()
+
+			if _, _, err := executeSet(ctx, token, "key", internalKeyValue(tt.value)); err != nil {
+				t.Fatal(err)
+			}
+			value, _, err := executeGet(ctx, token, "key")
+			if err != nil || value != tt.value {
+				t.Errorf("Want: %q Got: %q %v", tt.value, value, err)
+			}
+			if tt.protocol == "grpc" && useHTTP(token.Endpoint) {
+				t.Errorf("Want: request over gRPC Got: fell back to HTTP")
+			}
+		})
+	}
+}
+
+func TestExecuteEscapedKeys(t *testing.T) {
+	defer func(c *Config, active bool) { MyConfig, AmActive = c, active }(MyConfig, AmActive)
+	MyConfig, AmActive = testConfig(), true
+	MyConfig.InternalProtocol = "http"
+
+	server := startTestNode()
+	defer server.Close()
+
+	const tokenValue = 7
+	kvs.MyKVS[tokenValue] = kvs.NewStore(tokenValue)
+	defer delete(kvs.MyKVS, tokenValue)
+	token := kvs.Token{Endpoint: server.Listener.Addr().String(), Value: tokenValue}
+
+	var tests = []struct {
+		name string
+		key  string
+	}{
+		{"Slash", "a/b"},
+		{"Double slash", "a//b"},
+		{"Space", "a b"},
+		{"Percent", "50%"},
+		{"Query and fragment", "a?b#c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if _, _, err := executeSet(ctx, token, tt.key, internalKeyValue("1")); err != nil {
+				t.Fatal(err)
+			}
+			if value, _, exists := kvs.GetItem(tokenValue, tt.key); !exists || value != "1" {
+				t.Errorf("Want: %q stored Got: %q %v", tt.key, value, exists)
+			}
+			if value, _, err := executeGet(ctx, token, tt.key); err != nil || value != "1" {
+				t.Errorf("Want: 1 Got: %q %v", value, err)
+			}
+			if value, _, err := executeIncr(ctx, token, tt.key, 2); err != nil || value != 3 {
+				t.Errorf("Want: 3 Got: %v %v", value, err)
+			}
+			if err := executeDelete(ctx, token, tt.key, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, exists := kvs.GetItem(tokenValue, tt.key); exists {
+				t.Errorf("Want: %q deleted Got: exists", tt.key)
+			}
+		})
+	}
+}
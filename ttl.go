@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//TTLHeader gives the seconds until a key set by a put request expires, unless the body has a ttl
+const TTLHeader = "X-Kvs-Ttl"
+
+const (
+	maxTTL            = 100 * 365 * 24 * 60 * 60 //Largest TTL in seconds, so expiry times fit in unix nanoseconds
+	expirySweepSample = 20                       //Keys with an expiry checked in each sample of the sweep
+)
+
+//Get the time a key set by a put request expires from the ttl of its body or the TTL header. The
+//time is zero if the key never expires. Returns a message for the client if the TTL is invalid
+func parseTTL(r *http.Request, ttl *int64) (time.Time, string) {
+	if ttl == nil {
+		header := r.Header.Get(TTLHeader)
+		if header == "" {
+			return time.Time{}, ""
+		}
+
+		//Invalid headers are rejected by the range check below
+		seconds, _ := strconv.ParseInt(header, 10, 64)
+		ttl = &seconds
+	}
+
+	if *ttl < 1 || *ttl > maxTTL {
+		return time.Time{}, fmt.Sprintf("TTL must be between 1 and %d seconds", maxTTL)
+	}
+	return time.Now().Add(time.Duration(*ttl) * time.Second), ""
+}
+
+//Seconds until a key expires rounded up, or zero if it never expires
+func ttlRemaining(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+
+	remaining := time.Until(expires)
+	if remaining <= 0 {
+		return 0
+	}
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+//Convert an expiry time to unix nanoseconds sent between nodes, zero if the key never expires
+func expiryNanos(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.UnixNano()
+}
+
+//Convert unix nanoseconds sent between nodes to an expiry time
+func expiryTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+//Remove expired keys in the background. Expired keys are already hidden from reads, this frees
+//keys which are never read again
+func sweepExpiredKeys(interval time.Duration) {
+	for range time.Tick(interval) {
+		if removed := kvs.SweepExpired(expirySweepSample); removed > 0 {
+			log.Printf("Removed %d expired keys\n", removed)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Transaction of reads, conditions and writes. Transactions sent between nodes have keys stored under
+//one token, and the token and expiry of writes with a TTL are set by the receiving node
+type txnRequest struct {
+	Token      uint64         `json:"token,omitempty"`
+	Reads      []string       `json:"reads,omitempty"`
+	Conditions []txnCondition `json:"conditions,omitempty"`
+	Writes     []txnWrite     `json:"writes,omitempty"`
+}
+
+//Condition on the revision of a key with the semantics of the If-Match and If-None-Match headers
+type txnCondition struct {
+	Key string `json:"key"`
+	kvs.Precondition
+}
+
+//Write setting the value of a key or deleting it
+type txnWrite struct {
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+	Delete bool    `json:"delete,omitempty"`
+
+	TTL     *int64 `json:"ttl,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+//Value of a key read by a transaction
+type txnRead struct {
+	Key       string `json:"key"`
+	DoesExist bool   `json:"doesExist"`
+	Value     string `json:"value,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Revision  uint64 `json:"revision,omitempty"`
+}
+
+//Result of a transaction. Failed lists the keys whose condition did not hold, in which case nothing
+//was written
+type txnResult struct {
+	Reads     []txnRead         `json:"reads,omitempty"`
+	Revisions map[string]uint64 `json:"revisions,omitempty"`
+	Failed    []string          `json:"failed,omitempty"`
+}
+
+//Every key of a transaction in the order given
+func (t txnRequest) keys() []string {
+	keys := append([]string{}, t.Reads...)
+	for _, c := range t.Conditions {
+		keys = append(keys, c.Key)
+	}
+	for _, w := range t.Writes {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+//Check that a transaction can be executed. Returns a message for the client if it cannot
+func validateTxn(t txnRequest) string {
+	keys := t.keys()
+	if len(keys) == 0 {
+		return "Transaction has no reads, conditions or writes"
+	} else if len(keys) > maxBatchSize {
+		return fmt.Sprintf("Transaction has more than %d reads, conditions and writes", maxBatchSize)
+	}
+
+	for _, key := range keys {
+		if msg := keyError(key); msg != "" {
+			return msg
+		}
+	}
+
+	//A condition without a revision to match or not match would always hold
+	for i, c := range t.Conditions {
+		if len(c.Match) == 0 && !c.MatchAny && len(c.NoneMatch) == 0 && !c.NoneMatchAny {
+			return fmt.Sprintf("Condition %d must have match, match-any, none-match or none-match-any", i)
+		}
+	}
+
+	for i, w := range t.Writes {
+		if (w.Value == nil) == !w.Delete {
+			return fmt.Sprintf("Write %d must have either a value or delete", i)
+		} else if w.TTL != nil && (*w.TTL < 1 || *w.TTL > maxTTL) {
+			return fmt.Sprintf("TTL must be between 1 and %d seconds", maxTTL)
+		}
+	}
+	return ""
+}
+
+//Convert a transaction to the form executed by the store
+func (t txnRequest) toKVS() kvs.Txn {
+	txn := kvs.Txn{Reads: t.Reads, Writes: make([]kvs.Write, len(t.Writes))}
+	for _, c := range t.Conditions {
+		p := c.Precondition
+		txn.Conditions = append(txn.Conditions, kvs.KeyCondition{Key: c.Key, Cond: p.Check})
+	}
+	for i, w := range t.Writes {
+		txn.Writes[i] = kvs.Write{Key: w.Key, Value: w.Value, Expires: expiryTime(w.Expires)}
+	}
+	return txn
+}
+
+//Convert the result of a transaction from the store, listing the values read in the order given
+func fromKVSResult(reads []string, res kvs.TxnResult) txnResult {
+	result := txnResult{Revisions: res.Revisions, Failed: res.Failed}
+	for _, key := range reads {
+		item := res.Reads[key]
+		read := txnRead{Key: key, DoesExist: item.Exists, Value: item.Value, Revision: item.Meta.Revision}
+		read.TTL = ttlRemaining(item.Meta.Expires)
+		result.Reads = append(result.Reads, read)
+	}
+	return result
+}
+
+//Execute a transaction on the local partition of its token
+func applyTxn(t txnRequest) (txnResult, error) {
+	res, err := kvs.Transact(t.Token, t.toKVS())
+	return fromKVSResult(t.Reads, res), err
+}
+
+//Split a transaction into one transaction for each token its keys are stored under, grouped by the
+//node owning the token
+func splitTxn(t txnRequest) map[string][]txnRequest {
+	txns := make(map[uint64]*txnRequest)
+	endpoints := make(map[uint64]string)
+	find := func(key string) *txnRequest {
+		token := MyView.FindToken(key)
+		if _, exists := txns[token.Value]; !exists {
+			txns[token.Value] = &txnRequest{Token: token.Value}
+			endpoints[token.Value] = token.Endpoint
+		}
+		return txns[token.Value]
+	}
+
+	for _, key := range t.Reads {
+		txn := find(key)
+		txn.Reads = append(txn.Reads, key)
+	}
+	for _, c := range t.Conditions {
+		txn := find(c.Key)
+		txn.Conditions = append(txn.Conditions, c)
+	}
+	for _, w := range t.Writes {
+		txn := find(w.Key)
+		txn.Writes = append(txn.Writes, w)
+	}
+
+	nodes := make(map[string][]txnRequest)
+	for token, txn := range txns {
+		nodes[endpoints[token]] = append(nodes[endpoints[token]], *txn)
+	}
+	return nodes
+}
+
+//Execute a transaction on the node owning its token. Returns kvs.ErrConditionNotMet along with the
+//result if a condition did not hold or kvs.ErrLocked if a distributed transaction has locked its keys
+func executeTxn(ctx context.Context, node string, t txnRequest) (txnResult, error) {
+	result := txnResult{}
+	//Transactions are not retried since a transaction which committed would fail its conditions or
+	//be applied again when repeated
+	uri := fmt.Sprintf("http://%s/kvs/int/txn", node)
+	res, err := internalRequest(ctx, http.MethodPost, uri, t, quickPolicy(false))
+	if err != nil {
+		return result, err
+	} else if res.StatusCode == http.StatusLocked {
+		return result, kvs.ErrLocked
+	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPreconditionFailed {
+		return result, fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		return result, err
+	} else if res.StatusCode == http.StatusPreconditionFailed {
+		return result, kvs.ErrConditionNotMet
+	}
+	return result, nil
+}
+
+//Execute a transaction on the nodes owning its keys. Keys stored under one token are handled by the
+//owning node alone while other transactions are coordinated by this node with two phase commit.
+//Address is the owning node if it is a single node other than this node
+func routeTxn(ctx context.Context, t txnRequest) (result txnResult, address string, err error) {
+	now := time.Now()
+	for i, w := range t.Writes {
+		t.Writes[i].Expires = 0
+		if w.TTL != nil {
+			t.Writes[i].Expires = now.Add(time.Duration(*w.TTL) * time.Second).UnixNano()
+		}
+	}
+
+	nodes := splitTxn(t)
+	for node, txns := range nodes {
+		if len(nodes) > 1 || len(txns) > 1 {
+			result, err = coordinateTxn(ctx, t, nodes)
+			return result, "", err
+		}
+
+		if node == MyAddress {
+			result, err = applyTxn(txns[0])
+			return result, "", err
+		}
+		result, err = executeTxn(ctx, node, txns[0])
+		return result, node, err
+	}
+	return result, "", nil
+}
+
+//Handle external post request with a transaction
+func txnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := txnRequest{}
+	res := struct {
+		Message string `json:"message"`
+		Error   string `json:"error,omitempty"`
+		txnResult
+		Address string `json:"address,omitempty"`
+	}{}
+
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		res.Error = "Invalid request body"
+	} else {
+		res.Error = validateTxn(req)
+	}
+
+	if res.Error != "" {
+		res.Message = "Error in TXN"
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		result, address, err := routeTxn(r.Context(), req)
+		res.txnResult, res.Address = result, address
+
+		if err == kvs.ErrConditionNotMet {
+			res.Error = "Precondition failed"
+			res.Message = "Error in TXN"
+			w.WriteHeader(http.StatusPreconditionFailed)
+		} else if err == kvs.ErrLocked {
+			res.Error = "Keys are locked by another transaction"
+			res.Message = "Error in TXN"
+			w.WriteHeader(http.StatusLocked)
+		} else if err == errTxnUnavailable {
+			res.Error = err.Error()
+			res.Message = "Error in TXN"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		} else {
+			res.Message = "Transaction committed"
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	b, err = json.Marshal(res)
+	if err == nil {
+		w.Write(b)
+	} else {
+		log.Println(err)
+	}
+}
+
+//Handle internal post request with a transaction on keys stored on this node. Returns 412 with the
+//result if a condition did not hold and 423 if its keys are locked
+func internalTxnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	req := txnRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil || validateTxn(req) != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := applyTxn(req)
+	if err == kvs.ErrLocked {
+		w.WriteHeader(http.StatusLocked)
+		return
+	} else if err != nil && err != kvs.ErrConditionNotMet {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	b, err = json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	} else if len(result.Failed) > 0 {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
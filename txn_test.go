@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+func TestValidateTxn(t *testing.T) {
+	value := "1"
+	var tests = []struct {
+		name string
+		txn  txnRequest
+		want string
+	}{
+		{"Read", txnRequest{Reads: []string{"a"}}, ""},
+		{"Empty", txnRequest{}, "Transaction has no reads, conditions or writes"},
+		{"Condition with match", txnRequest{Conditions: []txnCondition{{"a", kvs.Precondition{Match: []uint64{1}}}}}, ""},
+		{"Condition with none-match-any", txnRequest{Conditions: []txnCondition{{"a", kvs.Precondition{NoneMatchAny: true}}}}, ""},
+		{"Condition without match", txnRequest{Conditions: []txnCondition{{"a", kvs.Precondition{MatchAny: true}}, {"b", kvs.Precondition{}}}}, "Condition 1 must have match, match-any, none-match or none-match-any"},
+		{"Write with value", txnRequest{Writes: []txnWrite{{Key: "a", Value: &value}}}, ""},
+		{"Write without value", txnRequest{Writes: []txnWrite{{Key: "a"}}}, "Write 0 must have either a value or delete"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateTxn(tt.txn); got != tt.want {
+				t.Errorf("Want: %q Got: %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+const (
+	watchBuffer    = 256              //Events kept for a watcher which is not keeping up
+	watchHeartbeat = 10 * time.Second //Time between heartbeats on idle watch streams
+	watchViewCheck = time.Second      //Time between checks for view changes moving watched keys
+)
+
+//Type of the event telling a watcher that changes may have been missed, after which it should read
+//the watched keys again
+const watchReset = "reset"
+
+//Client for watch streams between nodes, kept apart so long-lived streams do not use up the
+//connections of internalClient
+var watchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	},
+}
+
+//Change to a watched key streamed between nodes and to clients
+type watchEvent struct {
+	Type     string `json:"type"`
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Reason   string `json:"reason,omitempty"` //Why changes may have been missed, for reset events
+}
+
+//Key or prefix of the keys being watched
+type watchFilter struct {
+	key    string
+	prefix string
+	all    bool //Watch every key starting with prefix instead of a single key
+}
+
+//Get the filter of a watch request. Returns a message for the client if it is invalid
+func parseWatchFilter(r *http.Request) (watchFilter, string) {
+	query := r.URL.Query()
+	_, hasKey := query["key"]
+	_, hasPrefix := query["prefix"]
+
+	f := watchFilter{key: query.Get("key"), prefix: query.Get("prefix"), all: hasPrefix}
+	if hasKey == hasPrefix {
+		return f, "Either key or prefix must be given"
+	} else if len(f.key) > MyConfig.MaxKeyLength || len(f.prefix) > MyConfig.MaxKeyLength {
+		return f, "Key is too long"
+	} else if hasKey && f.key == "" {
+		return f, "Key is missing"
+	}
+	return f, ""
+}
+
+//Check if a key is watched
+func (f watchFilter) match(key string) bool {
+	if strings.HasPrefix(key, nsMarker) {
+		//Keys of namespaces are not part of the flat keyspace
+		return false
+	} else if f.all {
+		return strings.HasPrefix(key, f.prefix)
+	}
+	return key == f.key
+}
+
+//Query string of the filter for watch requests to other nodes
+func (f watchFilter) query() string {
+	if f.all {
+		return "prefix=" + url.QueryEscape(f.prefix)
+	}
+	return "key=" + url.QueryEscape(f.key)
+}
+
+//Nodes owning the watched keys in the current view
+func (f watchFilter) nodes() map[string]bool {
+	nodes := make(map[string]bool)
+	if !f.all {
+		nodes[MyView.FindToken(f.key).Endpoint] = true
+		return nodes
+	}
+
+	//Keys with a prefix can be stored under any token
+	for _, node := range MyView.Nodes {
+		nodes[node] = true
+	}
+	return nodes
+}
+
+//Stream the events of watched keys on a node until the context is done, subscribing again if the
+//stream is interrupted. Connected is called each time the node accepts the watch. Changes made while
+//the stream was interrupted are missed, so once subscribed again a reset event is sent with the
+//reason, as it is on the first subscription if reset is given
+func streamWatch(ctx context.Context, node string, f watchFilter, events chan<- watchEvent, reset string, connected func()) {
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		subscribed := func() {
+			attempt = 0
+			connected()
+			if reset != "" {
+				select {
+				case events <- watchEvent{Type: watchReset, Reason: reset}:
+				case <-ctx.Done():
+				}
+				reset = ""
+			}
+		}
+
+		var err error
+		if node == MyAddress {
+			err = streamLocalWatch(ctx, f, events, subscribed)
+		} else {
+			err = streamRemoteWatch(ctx, node, f, events, subscribed)
+		}
+
+		if ctx.Err() == nil {
+			log.Printf("Watch of %s on %s interrupted: %v\n", f.query(), node, err)
+			reset = fmt.Sprintf("Watch of node %s was interrupted: %v", node, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff(attempt)):
+			}
+		}
+	}
+}
+
+//Forward the events of watched keys stored on this node. Subscribed is called once the subscription
+//is made. Returns once the context is done or the subscription fell behind
+func streamLocalWatch(ctx context.Context, f watchFilter, events chan<- watchEvent, subscribed func()) error {
+	sub := kvs.Subscribe(f.match, watchBuffer)
+	defer sub.Cancel()
+	subscribed()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, open := <-sub.Events:
+			if !open {
+				return errors.New("Watcher fell behind")
+			}
+
+			select {
+			case events <- watchEvent{Type: e.Type, Key: e.Key, Value: e.Value, Revision: e.Revision}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+//Forward the events of watched keys streamed by another node. Connected is called once the node
+//has accepted the watch. Returns once the context is done or the stream ends
+func streamRemoteWatch(ctx context.Context, node string, f watchFilter, events chan<- watchEvent, connected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	uri := fmt.Sprintf("http://%s/kvs/int/watch?%s", node, f.query())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := watchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Node %s returned status %d", node, res.StatusCode)
+	}
+	connected()
+
+	//Nodes send heartbeats so a stream which stays silent is from a node which is gone
+	idle := time.AfterFunc(3*watchHeartbeat, cancel)
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		idle.Reset(3 * watchHeartbeat)
+
+		e := watchEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		} else if e.Type == "heartbeat" {
+			continue
+		}
+
+		select {
+		case events <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Node %s closed the stream", node)
+}
+
+//Handle external get request to watch a key or every key with a prefix. Changes are streamed as
+//server-sent events from the nodes owning the keys, following the keys when a view change moves them
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Response writer does not support streaming")
+		return
+	}
+
+	f, errMessage := parseWatchFilter(r)
+	if errMessage != "" {
+		b, err := json.Marshal(struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}{Error: errMessage, Message: "Error in WATCH"})
+
+		w.WriteHeader(http.StatusBadRequest)
+		if err == nil {
+			w.Write(b)
+		} else {
+			log.Println(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	events := make(chan watchEvent, watchBuffer)
+	streams := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range streams {
+			cancel()
+		}
+	}()
+
+	//Subscribe to nodes which now own watched keys and stop streams from nodes which no longer do once
+	//the new streams are subscribed. Keys moved to a node may have changed before it was subscribed
+	//to, so its stream starts with the reset given
+	follow := func(reset string) {
+		nodes := f.nodes()
+		var retired []context.CancelFunc
+		for node, cancel := range streams {
+			if !nodes[node] {
+				retired = append(retired, cancel)
+				delete(streams, node)
+			}
+		}
+
+		var added []string
+		for node := range nodes {
+			if _, exists := streams[node]; !exists {
+				added = append(added, node)
+			}
+		}
+
+		retire := retireAfter(len(added), retired)
+		for _, node := range added {
+			streamCtx, cancel := context.WithCancel(ctx)
+			streams[node] = cancel
+			once := &sync.Once{}
+			go streamWatch(streamCtx, node, f, events, reset, func() { once.Do(retire) })
+		}
+	}
+	follow("")
+
+	viewCheck := time.NewTicker(watchViewCheck)
+	defer viewCheck.Stop()
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-viewCheck.C:
+			if AmActive {
+				follow("View change moved watched keys")
+			}
+		case <-heartbeat.C:
+			//Comments are ignored by clients but keep proxies from closing idle streams
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+			flusher.Flush()
+		}
+	}
+}
+
+//Get a function to call once each of n new streams is subscribed, which then stops the retired streams
+func retireAfter(n int, retired []context.CancelFunc) func() {
+	stop := func() {
+		for _, cancel := range retired {
+			cancel()
+		}
+	}
+	if n == 0 {
+		stop()
+		return stop
+	}
+
+	mutex := &sync.Mutex{}
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		n--
+		if n == 0 {
+			stop()
+		}
+	}
+}
+
+//Handle internal get request to watch keys stored on this node. Events are streamed as lines of
+//json with heartbeats while idle until the requesting node closes the stream
+func internalWatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Response writer does not support streaming")
+		return
+	}
+
+	f, errMessage := parseWatchFilter(r)
+	if errMessage != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sub := kvs.Subscribe(f.match, watchBuffer)
+	defer sub.Cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	encoder := json.NewEncoder(w)
+	for {
+		var e watchEvent
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			e = watchEvent{Type: "heartbeat"}
+		case event, open := <-sub.Events:
+			if !open {
+				//The requesting node subscribes again after falling behind
+				return
+			}
+			e = watchEvent{Type: event.Type, Key: event.Key, Value: event.Value, Revision: event.Revision}
+		}
+
+		if err := encoder.Encode(e); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kailask/sharded-kvs/kvs"
+)
+
+//Types of cluster events sent to webhooks. Changes to keys are sent with the types of kvs events
+const (
+	eventViewChangeStarted   = "view-change-started"
+	eventViewChangeCompleted = "view-change-completed"
+	eventViewChangeFailed    = "view-change-failed"
+	eventNodeJoined          = "node-joined"
+	eventNodeLeft            = "node-left"
+)
+
+//Types of events webhooks can be registered for
+var webhookEventTypes = map[string]bool{
+	kvs.EventSet: true, kvs.EventDelete: true, kvs.EventExpire: true,
+	eventViewChangeStarted: true, eventViewChangeCompleted: true, eventViewChangeFailed: true,
+	eventNodeJoined: true, eventNodeLeft: true,
+}
+
+//Cluster events waiting to be sent to each webhook before further events are dead-lettered
+const webhookQueueSize = 1000
+
+//WebhookConfig registers a URL for events. Key changes are only sent for keys starting with
+//prefix, and only events of the listed types are sent unless none are listed
+type WebhookConfig struct {
+	URL    string   `json:"url" yaml:"url" toml:"url"`
+	Prefix string   `json:"prefix,omitempty" yaml:"prefix" toml:"prefix"`
+	Events []string `json:"events,omitempty" yaml:"events" toml:"events"`
+}
+
+//Event sent to webhooks
+type webhookEvent struct {
+	Type      string   `json:"type"`
+	Namespace string   `json:"namespace,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	Revision  uint64   `json:"revision,omitempty"`
+	Node      string   `json:"node,omitempty"` //Node which joined or left the view
+	View      []string `json:"view,omitempty"` //Nodes of the view being changed to
+	Error     string   `json:"error,omitempty"`
+	Time      int64    `json:"time"` //Unix nanoseconds
+}
+
+//Batch of events which could not be delivered to a webhook
+type deadLetter struct {
+	ID       uint64         `json:"id"`
+	URL      string         `json:"url"`
+	Events   []webhookEvent `json:"events"`
+	Error    string         `json:"error"`
+	Attempts int            `json:"attempts"`
+	Time     int64          `json:"time"` //Unix nanoseconds
+}
+
+//Webhook with its pending events and delivery counts
+type webhook struct {
+	config  WebhookConfig
+	types   map[string]bool
+	cluster chan webhookEvent
+
+	batch    []webhookEvent
+	deadline <-chan time.Time //Fires once the oldest event in the batch has waited long enough
+
+	delivered int //Events delivered, guarded by webhooksMutex
+	failed    int //Events dead-lettered, guarded by webhooksMutex
+}
+
+//Webhooks of this node and the batches they failed to deliver, oldest first
+var (
+	webhooks      []*webhook
+	deadLetters   []deadLetter
+	lastLetterID  uint64
+	webhooksMutex = &sync.Mutex{}
+)
+
+//Client for requests to webhooks, kept apart from internalClient as webhooks are outside the cluster
+var webhookClient = &http.Client{}
+
+//Check that webhooks have valid URLs and event types
+func validateWebhooks(hooks []WebhookConfig) error {
+	for _, h := range hooks {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Webhook URL %q must be an http or https URL", h.URL)
+		}
+
+		for _, t := range h.Events {
+			if !webhookEventTypes[t] {
+				return fmt.Errorf("Webhook event type %q is not known", t)
+			}
+		}
+	}
+	return nil
+}
+
+//Start delivering events to the configured webhooks
+func startWebhooks(c *Config) {
+	webhookClient.Timeout = c.webhookTimeout
+
+	for _, hc := range c.Webhooks {
+		h := &webhook{config: hc, types: make(map[string]bool), cluster: make(chan webhookEvent, webhookQueueSize)}
+		for _, t := range hc.Events {
+			h.types[t] = true
+		}
+		webhooks = append(webhooks, h)
+		go h.run(c.WebhookBatchSize, c.webhookBatchDelay)
+	}
+}
+
+//Check if the webhook is registered for events of a type
+func (h *webhook) wants(eventType string) bool {
+	return len(h.types) == 0 || h.types[eventType]
+}
+
+//Queue a cluster event for every webhook registered for it. Events for a webhook whose queue is
+//full are dead-lettered rather than holding up the view change
+func publishClusterEvent(e webhookEvent) {
+	e.Time = time.Now().UnixNano()
+	for _, h := range webhooks {
+		if !h.wants(e.Type) {
+			continue
+		}
+
+		select {
+		case h.cluster <- e:
+		default:
+			addDeadLetter(h, []webhookEvent{e}, "Webhook queue is full", 0)
+		}
+	}
+}
+
+//Publish the events of a view change coordinated by this node once it has finished
+func publishViewChange(oldNodes []string, nodes []string, err error) {
+	if err != nil {
+		publishClusterEvent(webhookEvent{Type: eventViewChangeFailed, View: nodes, Error: err.Error()})
+		return
+	}
+	publishClusterEvent(webhookEvent{Type: eventViewChangeCompleted, View: nodes})
+
+	inOld, inNew := make(map[string]bool), make(map[string]bool)
+	for _, node := range oldNodes {
+		inOld[node] = true
+	}
+	for _, node := range nodes {
+		inNew[node] = true
+		if !inOld[node] {
+			publishClusterEvent(webhookEvent{Type: eventNodeJoined, Node: node, View: nodes})
+		}
+	}
+	for _, node := range oldNodes {
+		if !inNew[node] {
+			publishClusterEvent(webhookEvent{Type: eventNodeLeft, Node: node, View: nodes})
+		}
+	}
+}
+
+//Read changes to keys on this node from the change log along with queued cluster events, sending
+//them in batches once a batch is full or its oldest event has waited for the batch delay
+func (h *webhook) run(batchSize int, batchDelay time.Duration) {
+	_, _, cursor, _ := kvs.Changes(0, 0)
+
+	for {
+		events, oldest, last, next := kvs.Changes(cursor, batchSize)
+		if cursor < oldest-1 {
+			//The change log dropped changes before they were read
+			addDeadLetter(h, nil, fmt.Sprintf("Changes %d to %d were dropped from the change log", cursor+1, oldest-1), 0)
+			cursor = oldest - 1
+			continue
+		}
+
+		for _, e := range events {
+			cursor = e.Seq
+			if e.Type == kvs.EventMoveIn || e.Type == kvs.EventMoveOut {
+				continue
+			} else if h.wants(e.Type) && strings.HasPrefix(e.Key, h.config.Prefix) {
+				event := webhookEvent{Type: e.Type, Value: e.Value, Revision: e.Revision, Time: e.Time.UnixNano()}
+				event.Namespace, event.Key = splitNamespace(e.Key)
+				h.add(event, batchSize, batchDelay)
+			}
+		}
+		if cursor < last {
+			continue
+		}
+
+		select {
+		case <-next:
+		case e := <-h.cluster:
+			h.add(e, batchSize, batchDelay)
+		case <-h.deadline:
+			h.flush()
+		}
+	}
+}
+
+//Add an event to the batch, sending the batch if it is full
+func (h *webhook) add(e webhookEvent, batchSize int, batchDelay time.Duration) {
+	if len(h.batch) == 0 {
+		h.deadline = time.After(batchDelay)
+	}
+
+	h.batch = append(h.batch, e)
+	if len(h.batch) >= batchSize {
+		h.flush()
+	}
+}
+
+//Send the batch, dead-lettering it if every attempt fails
+func (h *webhook) flush() {
+	if len(h.batch) == 0 {
+		return
+	}
+
+	attempts, err := h.deliver(h.batch)
+	if err != nil {
+		log.Printf("Unable to deliver %d events to webhook %s: %v\n", len(h.batch), h.config.URL, err)
+		addDeadLetter(h, h.batch, err.Error(), attempts)
+	} else {
+		webhooksMutex.Lock()
+		h.delivered += len(h.batch)
+		webhooksMutex.Unlock()
+	}
+	h.batch, h.deadline = nil, nil
+}
+
+//Post events to the webhook, retrying with backoff. Client errors other than timeouts and rate
+//limits are not retried. Returns the number of attempts made
+func (h *webhook) deliver(events []webhookEvent) (int, error) {
+	b, err := json.Marshal(struct {
+		Node   string         `json:"node"`
+		Events []webhookEvent `json:"events"`
+	}{Node: MyAddress, Events: events})
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		var res *http.Response
+		res, err = webhookClient.Post(h.config.URL, "application/json", bytes.NewReader(b))
+		if err == nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return attempt + 1, nil
+			}
+			err = fmt.Errorf("Webhook returned status %d", res.StatusCode)
+
+			retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout ||
+				res.StatusCode == http.StatusTooManyRequests
+			if !retry {
+				return attempt + 1, err
+			}
+		}
+
+		if attempt >= MyConfig.WebhookRetries {
+			return attempt + 1, err
+		}
+		time.Sleep(backoff(attempt))
+	}
+}
+
+//Record events a webhook failed to receive, dropping the oldest dead letters once the list is full
+func addDeadLetter(h *webhook, events []webhookEvent, errMessage string, attempts int) {
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	lastLetterID++
+	deadLetters = append(deadLetters, deadLetter{ID: lastLetterID, URL: h.config.URL, Events: events,
+		Error: errMessage, Attempts: attempts, Time: time.Now().UnixNano()})
+	if len(deadLetters) > MyConfig.DeadLetterSize {
+		deadLetters = deadLetters[len(deadLetters)-MyConfig.DeadLetterSize:]
+	}
+	h.failed += len(events)
+}
+
+//Handle external get request for the webhooks of this node and how many events they were sent
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	type webhookStatus struct {
+		WebhookConfig
+		Delivered int `json:"delivered"`
+		Failed    int `json:"failed"`
+	}
+
+	res := struct {
+		Message  string          `json:"message"`
+		Webhooks []webhookStatus `json:"webhooks"`
+	}{Message: "Webhooks retrieved successfully", Webhooks: []webhookStatus{}}
+
+	webhooksMutex.Lock()
+	for _, h := range webhooks {
+		res.Webhooks = append(res.Webhooks, webhookStatus{WebhookConfig: h.config, Delivered: h.delivered, Failed: h.failed})
+	}
+	webhooksMutex.Unlock()
+
+	b, err := json.Marshal(res)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+//Handle external get request for the events this node failed to deliver to webhooks, or delete
+//request to clear them once handled
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !AmActive {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	res := struct {
+		Message     string       `json:"message"`
+		DeadLetters []deadLetter `json:"dead-letters"`
+	}{DeadLetters: []deadLetter{}}
+
+	webhooksMutex.Lock()
+	if r.Method == http.MethodDelete {
+		deadLetters = nil
+		res.Message = "Dead letters cleared successfully"
+	} else {
+		res.DeadLetters = append(res.DeadLetters, deadLetters...)
+		res.Message = "Dead letters retrieved successfully"
+	}
+	webhooksMutex.Unlock()
+
+	b, err := json.Marshal(res)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliver(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = &Config{WebhookRetries: 2, retryBackoff: time.Millisecond, maxRetryBackoff: time.Millisecond}
+
+	var tests = []struct {
+		name     string
+		statuses []int //Returned for each attempt, the last is repeated
+		attempts int
+		ok       bool
+	}{
+		{"Delivered", []int{http.StatusOK}, 1, true},
+		{"Any success status", []int{http.StatusNoContent}, 1, true},
+		{"Retried server error", []int{http.StatusInternalServerError, http.StatusOK}, 2, true},
+		{"Retried timeout and rate limit", []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusOK}, 3, true},
+		{"Client error not retried", []int{http.StatusBadRequest}, 1, false},
+		{"Retries run out", []int{http.StatusServiceUnavailable}, 3, false},
+	}
+
+	events := []webhookEvent{{Type: eventNodeJoined, Node: "10.0.0.1:8080", Time: 1}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			received := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := struct {
+					Node   string         `json:"node"`
+					Events []webhookEvent `json:"events"`
+				}{}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !reflect.DeepEqual(body.Events, events) {
+					t.Errorf("Want: %v Got: %v %v", events, body.Events, err)
+				}
+
+				mutex.Lock()
+				status := tt.statuses[len(tt.statuses)-1]
+				if received < len(tt.statuses) {
+					status = tt.statuses[received]
+				}
+				received++
+				mutex.Unlock()
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			h := &webhook{config: WebhookConfig{URL: server.URL}}
+			attempts, err := h.deliver(events)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if attempts != tt.attempts || (err == nil) != tt.ok || received != tt.attempts {
+				t.Errorf("Want: %d %v Got: %d %v with %d requests", tt.attempts, tt.ok, attempts, err, received)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliverUnreachable(t *testing.T) {
+	defer func(c *Config) { MyConfig = c }(MyConfig)
+	MyConfig = &Config{WebhookRetries: 1, retryBackoff: time.Millisecond, maxRetryBackoff: time.Millisecond}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	h := &webhook{config: WebhookConfig{URL: server.URL}}
+	if attempts, err := h.deliver(nil); attempts != 2 || err == nil {
+		t.Errorf("Want: 2 attempts and an error Got: %d %v", attempts, err)
+	}
+}